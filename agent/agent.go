@@ -2,12 +2,13 @@ package agent
 
 import (
 	"crypto/ed25519"
-	"encoding/json"
 	"math/rand/v2"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/isletnet/uptp/gateway"
@@ -15,6 +16,9 @@ import (
 	"github.com/isletnet/uptp/logging"
 	"github.com/isletnet/uptp/p2pengine"
 	"github.com/isletnet/uptp/portmap"
+	"github.com/isletnet/uptp/proxyroute"
+	"github.com/isletnet/uptp/socks5"
+	"github.com/isletnet/uptp/store"
 	"github.com/isletnet/uptp/types"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
@@ -26,9 +30,35 @@ type agent struct {
 	pm  *portmap.Portmap
 	db  *leveldb.DB
 	am  *gateway.PortmapAppMgr
+	rm  atomic.Pointer[reverseMgr]
 
 	*proxyMgr
 
+	lpMtx      sync.Mutex
+	localProxy *socks5.LocalServer
+
+	domain atomic.Pointer[domainRoute]
+
+	tunMtx     sync.Mutex
+	tunPrimary string
+	tunDown    map[string]bool // 故障切换时判定不可用的网关，恢复前不参与TUN路由
+	tunDialer  *proxyDialer
+	tunDNSOn   bool // VPN的DNS指向tunDNSAddr，切换网关后仍需在TUN内提供DNS
+	tunRouter  atomic.Pointer[proxyroute.Router[string]]
+
+	monMtx  sync.Mutex
+	monitor *proxyMonitor
+
+	events eventBus
+
+	ctlMtx      sync.Mutex
+	ctlListener net.Listener
+	ctlToken    string
+
+	consoleMtx sync.Mutex
+	consoles   map[string]*ConsoleProxy
+
+	workDir string
 	running bool
 }
 
@@ -46,7 +76,7 @@ func agentIns() *agent {
 
 func (ag *agent) setLog(workDir string) {
 	gLog := logger.NewLogger(workDir, "uptp-agent", 0, 1024*1024, logger.LogFileAndConsole)
-	logging.SetLogger(gLog)
+	logging.SetLogger(&eventLogger{Logger: gLog, ag: ag})
 }
 
 func (ag *agent) start(workDir string, withPortmap bool) error {
@@ -66,7 +96,12 @@ func (ag *agent) start(workDir string, withPortmap bool) error {
 	if err != nil {
 		return err
 	}
+	if err := store.Migrate(db, agentMigrations); err != nil {
+		db.Close()
+		return err
+	}
 	ag.db = db
+	ag.workDir = workDir
 
 	us, err := os.ReadFile(filepath.Join(workDir, "uuid"))
 	if err != nil && os.IsExist(err) {
@@ -104,6 +139,10 @@ func (ag *agent) start(workDir string, withPortmap bool) error {
 		return err
 	}
 	ag.running = true
+	ag.startEvents(ag.p2p)
+	go ag.watchPeers()
+	ag.restoreProxyDomain()
+	ag.restoreLocalProxy()
 	return nil
 }
 func (ag *agent) startPortmap(workDir string) error {
@@ -112,40 +151,37 @@ func (ag *agent) startPortmap(workDir string) error {
 		return err
 	}
 	ag.pm = portmap.NewPortMap(ag.p2p.Libp2pHost())
-	ag.pm.SetGetHandshakeFunc(func(network, ip string, port int) (peerID string, handshake []byte) {
+	ag.pm.SetGetHandshakeFunc(func(network, ip string, port int) (up portmap.Upstream, handshake []byte) {
 		app := ag.am.FindAppWithPort(network, port)
 		if app.ResID == 0 {
 			return
 		}
-		peerID = app.PeerID
-		hs := gateway.PortmapAppHandshake{
-			ResID:      types.ID(app.ResID),
-			Network:    app.Network,
-			TargetAddr: app.TargetAddr,
-			TargetPort: app.TargetPort,
-		}
-		handshake, err = json.Marshal(hs)
-		if err != nil {
-			return
-		}
-		return
+		return app.Handshake(port)
 	})
-	ag.pm.Start(false)
+	// 反向映射需要处理网关转发回来的连接
+	ag.pm.SetHandleHandshakeFunc(ag.handleReverseHandshake)
+	ag.pm.Start(true)
 	for _, a := range apps {
 		if !a.Running {
 			continue
 		}
-		_, err = ag.pm.AddListener(a.Network, a.LocalIP, a.LocalPort)
+		err = a.AddListeners(ag.pm)
 		if err != nil {
 			a.Err = ""
 			a.Running = false
 			ag.am.UpdatePortmapApp(&a)
 			logging.Error("add portmap listener error: %s", err)
+			ag.emitPortmapError(&a, err)
 		}
 	}
-	return nil
+	return ag.startReverse()
 }
 func (ag *agent) close() {
+	ag.stopControl()
+	ag.stopLocalServer()
+	ag.stopConsoles()
+	ag.stopReverse()
+	ag.stopEvents()
 	if ag.pm != nil {
 		ag.pm.Close()
 		ag.pm = nil
@@ -169,6 +205,9 @@ func (ag *agent) initAppMgr(workDir string) ([]gateway.PortmapApp, error) {
 }
 
 func (ag *agent) addApp(a *gateway.PortmapApp) error {
+	if err := a.ValidateUpstream(); err != nil {
+		return err
+	}
 	a.ID = types.ID(rand.Uint64())
 	rsp, err := gateway.ResourceAuthorize(ag.p2p.Libp2pHost(), a.PeerID, gateway.AuthorizeReq{
 		Type: gateway.AuthorizeTypePortmap,
@@ -176,25 +215,34 @@ func (ag *agent) addApp(a *gateway.PortmapApp) error {
 			ResourceID: types.ID(a.ResID),
 		},
 	})
+	if err == nil && rsp.Err != "" {
+		err = errors.New(rsp.Err)
+	} else if err == nil && rsp.Portmap == nil {
+		err = errors.New("portmap resource auth failed")
+	}
 	if err != nil {
+		ag.emit(EventAuthFailed, AuthFailedEvent{PeerID: a.PeerID, Type: gateway.AuthorizeTypePortmap, Err: err.Error()})
 		return err
 	}
-	if rsp.Err != "" {
-		return errors.New(rsp.Err)
-	}
-	if rsp.Portmap == nil {
-		return errors.New("portmap resource auth failed")
-	}
 	if !rsp.Portmap.IsTrial {
 		a.TargetAddr = ""
 		a.TargetPort = 0
 	}
 	a.PeerName = rsp.NodeName
+	a.TargetStatus = rsp.Portmap.TargetStatus
+	a.TargetLatency = rsp.Portmap.TargetLatency
+	if err := a.SetTargetPorts(rsp.Portmap.Ports); err != nil {
+		return err
+	}
+	if err := gateway.AuthorizeBackupPeers(ag.p2p.Libp2pHost(), a); err != nil {
+		return err
+	}
 	if a.Running {
-		_, err := ag.pm.AddListener(a.Network, a.LocalIP, a.LocalPort)
+		err := a.AddListeners(ag.pm)
 		if err != nil {
 			a.Running = false
 			a.Err = err.Error()
+			ag.emitPortmapError(a, err)
 		}
 	}
 	return ag.am.UpdatePortmapApp(a)
@@ -208,27 +256,40 @@ func (ag *agent) updateAPP(a *gateway.PortmapApp) error {
 	if exist == nil {
 		return errors.New("app not exists")
 	}
+	if err := a.ValidateUpstream(); err != nil {
+		return err
+	}
+	old := *exist
+	if !gateway.SameBackupPeers(exist.BackupPeers, a.BackupPeers) {
+		exist.BackupPeers = a.BackupPeers
+		if err := gateway.AuthorizeBackupPeers(ag.p2p.Libp2pHost(), exist); err != nil {
+			return err
+		}
+	}
+	exist.Policy = a.Policy
 	exist.Running = a.Running
 	exist.Name = a.Name
 	exist.Network = a.Network
 	exist.LocalIP = a.LocalIP
 	exist.LocalPort = a.LocalPort
+	exist.LocalPorts = a.LocalPorts
 	if exist.TargetAddr != "" {
 		exist.TargetAddr = a.TargetAddr
 		exist.TargetPort = a.TargetPort
 	}
-	if a.Running {
-		if exist.Running &&
-			exist.Network != a.Network || exist.LocalIP != a.LocalIP || exist.LocalPort != a.LocalPort {
-			ag.pm.DeleteListener(exist.Network, exist.LocalIP, exist.LocalPort)
-		}
-		_, err := ag.pm.AddListener(a.Network, a.LocalIP, a.LocalPort)
+	if err := exist.SetTargetPorts(exist.TargetPorts); err != nil {
+		return err
+	}
+	if old.Running {
+		old.DelListeners(ag.pm)
+	}
+	if exist.Running {
+		err := exist.AddListeners(ag.pm)
 		if err != nil {
 			exist.Running = false
 			exist.Err = err.Error()
+			ag.emitPortmapError(exist, err)
 		}
-	} else {
-		ag.pm.DeleteListener(a.Network, a.LocalIP, a.LocalPort)
 	}
 	return ag.am.UpdatePortmapApp(exist)
 }
@@ -237,10 +298,22 @@ func (ag *agent) delApp(a *gateway.PortmapApp) error {
 	if !ag.running {
 		return errors.New("agent not running")
 	}
-	ag.pm.DeleteListener(a.Network, a.LocalIP, a.LocalPort)
+	if exist := ag.am.GetPortmapApp(a.ID.Uint64()); exist != nil {
+		a = exist
+	}
+	if a.Running {
+		a.DelListeners(ag.pm)
+	}
 	return ag.am.DelPortmapApp(a.ID.Uint64())
 }
 
+func (ag *agent) getPeerStats() []portmap.PeerStat {
+	if !ag.running || ag.pm == nil {
+		return nil
+	}
+	return ag.pm.PeerStats()
+}
+
 func (ag *agent) getApps() []gateway.PortmapApp {
 	if !ag.running {
 		return nil
@@ -7,8 +7,11 @@ import (
 )
 
 type runConfig struct {
-	verbose  bool
-	logLevel int
+	daemonMode bool
+	verbose    bool
+	logLevel   int
+	ctl        string
+	workDir    string
 }
 
 func parseRunParams(cmd string, args []string) runConfig {
@@ -17,10 +20,16 @@ func parseRunParams(cmd string, args []string) runConfig {
 		return ret
 	}
 	flagSet := flag.NewFlagSet(cmd, flag.ExitOnError)
+	daemonMode := flagSet.Bool("d", false, "daemonMode")
 	verbose := flagSet.Bool("v", false, "log console")
 	logLevel := flagSet.Int("log-level", logging.LevelWarn, "log level")
+	ctl := flagSet.String("ctl", "", "control api listen address")
+	workDir := flagSet.String("dir", "", "work dir, default is the dir of the executable")
 	flagSet.Parse(args)
+	ret.daemonMode = *daemonMode
 	ret.verbose = *verbose
 	ret.logLevel = *logLevel
+	ret.ctl = *ctl
+	ret.workDir = *workDir
 	return ret
 }
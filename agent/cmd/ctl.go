@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isletnet/uptp/agent"
+	apiutil "github.com/isletnet/uptp/apiutil.go"
+	"github.com/isletnet/uptp/gateway"
+	"github.com/isletnet/uptp/types"
+)
+
+const ctlUsage = `Usage:
+  uptp-agent status
+  uptp-agent app list
+  uptp-agent app add -name <name> -peer <peer_id> -res <res_id> [-network tcp] [-local-ip 0.0.0.0] [-local-port <port>]
+  uptp-agent app update <id> [-name <name>] [-network <network>] [-local-ip <ip>] [-local-port <port>]
+  uptp-agent app del|start|stop <id>
+  uptp-agent proxy list
+  uptp-agent proxy add <peer_id> <token>
+  uptp-agent proxy start <id> [-listen 127.0.0.1:1080] [-tun <device>]
+  uptp-agent proxy stop [-tun]
+  uptp-agent console list
+  uptp-agent console start <peer_id> <manage_token> [-listen 127.0.0.1:0]
+  uptp-agent console stop <peer_id>
+环境变量UPTP_AGENT_CTL指定控制接口地址，默认` + agent.DefaultControlAddr + `
+token从agent工作目录下的` + agent.ControlTokenFile + `读取，UPTP_AGENT_DIR指定工作目录，默认是程序所在目录，
+也可以用UPTP_AGENT_CTL_TOKEN直接指定`
+
+// ctlClient 访问运行中agent的本地控制接口
+type ctlClient struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func newCtlClient() *ctlClient {
+	addr := os.Getenv("UPTP_AGENT_CTL")
+	if addr == "" {
+		addr = agent.DefaultControlAddr
+	}
+	return &ctlClient{
+		addr:   addr,
+		token:  ctlToken(),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func ctlToken() string {
+	if t := os.Getenv("UPTP_AGENT_CTL_TOKEN"); t != "" {
+		return t
+	}
+	dir := os.Getenv("UPTP_AGENT_DIR")
+	if dir == "" {
+		dir = filepath.Dir(os.Args[0])
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, agent.ControlTokenFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(buf))
+}
+
+func (c *ctlClient) do(method, path string, req, data any) error {
+	var body bytes.Buffer
+	if req != nil {
+		if err := json.NewEncoder(&body).Encode(req); err != nil {
+			return err
+		}
+	}
+	hreq, err := http.NewRequest(method, "http://"+c.addr+path, &body)
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("Authorization", "Bearer "+c.token)
+	rsp, err := c.client.Do(hreq)
+	if err != nil {
+		return fmt.Errorf("agent not running? %w", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return errors.New(rsp.Status)
+	}
+	ar := apiutil.ApiResponse{Data: data}
+	if err := json.NewDecoder(rsp.Body).Decode(&ar); err != nil {
+		return err
+	}
+	if ar.Code != 0 {
+		return errors.New(ar.Message)
+	}
+	return nil
+}
+
+// runCtl 处理控制命令，返回false表示不是控制命令
+func runCtl(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	var err error
+	c := newCtlClient()
+	switch args[0] {
+	case "status":
+		var st agent.AgentStatus
+		if err = c.do(http.MethodGet, "/status/", nil, &st); err == nil {
+			printJSON(st)
+		}
+	case "app":
+		err = c.appCmd(args[1:])
+	case "proxy":
+		err = c.proxyCmd(args[1:])
+	case "console":
+		err = c.consoleCmd(args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(ctlUsage)
+	default:
+		return false
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return true
+}
+
+func (c *ctlClient) appCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New(ctlUsage)
+	}
+	switch args[0] {
+	case "list":
+		var apps []gateway.PortmapApp
+		if err := c.do(http.MethodGet, "/app/list", nil, &apps); err != nil {
+			return err
+		}
+		printJSON(apps)
+		return nil
+	case "add":
+		app := gateway.PortmapApp{
+			Network: "tcp",
+			LocalIP: "0.0.0.0",
+			Running: true,
+		}
+		var resID uint64
+		fs := appFlags(&app)
+		fs.Uint64Var(&resID, "res", 0, "resource id")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if app.PeerID == "" || resID == 0 {
+			return errors.New("peer and res are required")
+		}
+		app.ResID = types.ID(resID)
+		var ret gateway.PortmapApp
+		if err := c.do(http.MethodPost, "/app/add", app, &ret); err != nil {
+			return err
+		}
+		printJSON(ret)
+		return nil
+	case "update":
+		id, err := parseCtlID(args[1:])
+		if err != nil {
+			return err
+		}
+		app, err := c.getApp(id)
+		if err != nil {
+			return err
+		}
+		if err := appFlags(app).Parse(args[2:]); err != nil {
+			return err
+		}
+		return c.ok(c.do(http.MethodPost, "/app/update", app, nil))
+	case "del", "start", "stop":
+		id, err := parseCtlID(args[1:])
+		if err != nil {
+			return err
+		}
+		path := "/app/" + args[0]
+		if args[0] == "del" {
+			path = "/app/delete"
+		}
+		return c.ok(c.do(http.MethodPost, path, map[string]types.ID{"id": id}, nil))
+	}
+	return errors.New(ctlUsage)
+}
+
+func (c *ctlClient) getApp(id types.ID) (*gateway.PortmapApp, error) {
+	var apps []gateway.PortmapApp
+	if err := c.do(http.MethodGet, "/app/list", nil, &apps); err != nil {
+		return nil, err
+	}
+	for i := range apps {
+		if apps[i].ID == id {
+			return &apps[i], nil
+		}
+	}
+	return nil, errors.New("app not exists")
+}
+
+func appFlags(app *gateway.PortmapApp) *flag.FlagSet {
+	fs := flag.NewFlagSet("app", flag.ContinueOnError)
+	fs.StringVar(&app.Name, "name", app.Name, "app name")
+	fs.StringVar(&app.PeerID, "peer", app.PeerID, "gateway peer id")
+	fs.StringVar(&app.Network, "network", app.Network, "tcp or udp")
+	fs.StringVar(&app.LocalIP, "local-ip", app.LocalIP, "local listen ip")
+	fs.IntVar(&app.LocalPort, "local-port", app.LocalPort, "local listen port")
+	return fs
+}
+
+func (c *ctlClient) proxyCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New(ctlUsage)
+	}
+	switch args[0] {
+	case "list":
+		var l []json.RawMessage
+		if err := c.do(http.MethodGet, "/proxy/list", nil, &l); err != nil {
+			return err
+		}
+		printJSON(l)
+		return nil
+	case "add":
+		if len(args) < 3 {
+			return errors.New(ctlUsage)
+		}
+		var id types.ID
+		err := c.do(http.MethodPost, "/proxy/add", map[string]string{"peer_id": args[1], "token": args[2]}, &id)
+		if err != nil {
+			return err
+		}
+		fmt.Println(id)
+		return nil
+	case "start":
+		id, err := parseCtlID(args[1:])
+		if err != nil {
+			return err
+		}
+		fs := flag.NewFlagSet("proxy start", flag.ContinueOnError)
+		listen := fs.String("listen", "", "local socks5/http proxy listen address")
+		tun := fs.String("tun", "", "tun device")
+		if err := fs.Parse(args[2:]); err != nil {
+			return err
+		}
+		req := map[string]any{"id": id, "listen": *listen, "tun": *tun}
+		return c.ok(c.do(http.MethodPost, "/proxy/start", req, nil))
+	case "stop":
+		fs := flag.NewFlagSet("proxy stop", flag.ContinueOnError)
+		tun := fs.Bool("tun", false, "stop tun proxy")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return c.ok(c.do(http.MethodPost, "/proxy/stop", map[string]bool{"tun": *tun}, nil))
+	}
+	return errors.New(ctlUsage)
+}
+
+// consoleCmd 在本地端口打开网关的web控制台，用浏览器访问输出的地址
+func (c *ctlClient) consoleCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New(ctlUsage)
+	}
+	switch args[0] {
+	case "list":
+		var l []agent.ConsoleProxy
+		if err := c.do(http.MethodGet, "/console/list", nil, &l); err != nil {
+			return err
+		}
+		printJSON(l)
+		return nil
+	case "start":
+		if len(args) < 3 {
+			return errors.New("peer_id and manage_token are required")
+		}
+		token, err := parseCtlID(args[2:])
+		if err != nil {
+			return err
+		}
+		fs := flag.NewFlagSet("console start", flag.ContinueOnError)
+		listen := fs.String("listen", "", "local console listen address")
+		if err := fs.Parse(args[3:]); err != nil {
+			return err
+		}
+		var cp agent.ConsoleProxy
+		req := map[string]any{"peer_id": args[1], "listen": *listen, "token": token}
+		err = c.do(http.MethodPost, "/console/start", req, &cp)
+		if err != nil {
+			return err
+		}
+		fmt.Println("http://" + cp.Listen)
+		return nil
+	case "stop":
+		if len(args) < 2 {
+			return errors.New("peer_id is required")
+		}
+		return c.ok(c.do(http.MethodPost, "/console/stop", map[string]string{"peer_id": args[1]}, nil))
+	}
+	return errors.New(ctlUsage)
+}
+
+func (c *ctlClient) ok(err error) error {
+	if err == nil {
+		fmt.Println("ok")
+	}
+	return err
+}
+
+func parseCtlID(args []string) (types.ID, error) {
+	if len(args) == 0 {
+		return 0, errors.New("id is required")
+	}
+	v, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", args[0])
+	}
+	return types.ID(v), nil
+}
+
+func printJSON(v any) {
+	buf, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(buf))
+}
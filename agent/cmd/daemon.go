@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/isletnet/uptp/daemon"
+)
+
+func serviceControl(ctrlComm string, exeAbsPath string, args []string) error {
+	return daemon.Control(ProductName, ctrlComm, exeAbsPath, args)
+}
+
+func daemonStart() error {
+	return daemon.Run(daemon.Options{Name: ProductName})
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/isletnet/uptp/logger"
+	"github.com/isletnet/uptp/logging"
+)
+
+// install 安装为systemd服务，-dir指定数据目录，默认与程序在同一目录
+func install(args []string) {
+	gLog := logger.NewLogger("", "", logging.LevelDebug, 0, logger.LogConsole)
+	flagSet := flag.NewFlagSet("install", flag.ExitOnError)
+	workDir := flagSet.String("dir", defaultInstallPath, "work dir")
+	ctl := flagSet.String("ctl", "", "control api listen address")
+	flagSet.Parse(args)
+
+	err := os.MkdirAll(defaultInstallPath, 0775)
+	if err != nil {
+		gLog.Error("MkdirAll %s error:%s", defaultInstallPath, err)
+		os.Exit(1)
+	}
+	err = os.MkdirAll(*workDir, 0775)
+	if err != nil {
+		gLog.Error("MkdirAll %s error:%s", *workDir, err)
+		os.Exit(1)
+	}
+	err = os.Chdir(defaultInstallPath)
+	if err != nil {
+		gLog.Error("cd error: %s", err)
+		os.Exit(1)
+	}
+
+	uninstall()
+	targetPath := filepath.Join(defaultInstallPath, defaultBinName)
+	// copy files
+
+	binPath, _ := os.Executable()
+	src, errFiles := os.Open(binPath)
+	if errFiles != nil {
+		gLog.Error("os.OpenFile %s error:%s", os.Args[0], errFiles)
+		os.Exit(1)
+	}
+
+	dst, errFiles := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0775)
+	if errFiles != nil {
+		gLog.Error("os.OpenFile %s error:%s", targetPath, errFiles)
+		os.Exit(1)
+	}
+
+	_, errFiles = io.Copy(dst, src)
+	if errFiles != nil {
+		gLog.Error("io.Copy error:%s", errFiles)
+		os.Exit(1)
+	}
+	src.Close()
+	dst.Close()
+
+	// install system service
+	gLog.Info("targetPath: %s, workDir: %s", targetPath, *workDir)
+	svcArgs := []string{"-d", "-dir", *workDir}
+	if *ctl != "" {
+		svcArgs = append(svcArgs, "-ctl", *ctl)
+	}
+	err = serviceControl("install", targetPath, svcArgs)
+	if err != nil {
+		gLog.Error("install system service error: %s", err)
+		os.Exit(1)
+	}
+	gLog.Info("install system service ok.")
+	time.Sleep(time.Second * 2)
+	err = serviceControl("start", targetPath, svcArgs)
+	if err != nil {
+		gLog.Error("start %s service error: %s", ProductName, err)
+		os.Exit(1)
+	} else {
+		gLog.Info("start %s service ok.", ProductName)
+	}
+}
+
+// uninstall 只删除服务和程序，保留数据目录
+func uninstall() {
+	gLog := logger.NewLogger("", "", logging.LevelDebug, 0, logger.LogConsole)
+	defer gLog.Info("uninstall end")
+	err := serviceControl("stop", "", nil)
+	if err != nil { // service maybe not install
+		gLog.Error("stop service fail: %s", err)
+	}
+	err = serviceControl("uninstall", "", nil)
+	if err != nil {
+		gLog.Error("uninstall system service error: %s", err)
+		return
+	} else {
+		gLog.Info("uninstall system service ok.")
+	}
+	binPath := filepath.Join(defaultInstallPath, defaultBinName)
+	os.Remove(binPath)
+}
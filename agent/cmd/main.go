@@ -2,70 +2,75 @@ package main
 
 import (
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
+	"syscall"
 
 	"github.com/isletnet/uptp/agent"
-	"github.com/isletnet/uptp/gateway"
 	"github.com/isletnet/uptp/logger"
 	"github.com/isletnet/uptp/logging"
 )
 
-func parseInt(s string) int {
-	i, _ := strconv.Atoi(s)
-	return i
-}
-
 func main() {
-	baseDir := filepath.Dir(os.Args[0])
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "install":
+			install(os.Args[2:])
+			return
+		case "uninstall":
+			uninstall()
+			return
+		case "start":
+			serviceControl("start", "", nil)
+			return
+		case "restart":
+			serviceControl("restart", "", nil)
+			return
+		case "stop":
+			serviceControl("stop", "", nil)
+			return
+		}
+	}
+	// 控制命令交给运行中的agent处理
+	if runCtl(os.Args[1:]) {
+		return
+	}
+
 	rc := parseRunParams("", os.Args[1:])
+	workDir := rc.workDir
+	if workDir == "" {
+		workDir = filepath.Dir(os.Args[0])
+	}
+	if err := os.MkdirAll(workDir, 0775); err != nil {
+		logging.Error("create work dir error: %s", err)
+		return
+	}
+	if rc.daemonMode {
+		gLog := logger.NewLogger(workDir, "daemon", rc.logLevel, 1024*1024, logger.LogFile)
+		logging.SetLogger(gLog)
+		os.Chdir(workDir)
+		daemonStart()
+		return
+	}
 
 	// Initialize logging first
 	lm := logger.LogFile
 	if rc.verbose {
 		lm = logger.LogFileAndConsole
 	}
-	logging.SetLogger(logger.NewLogger(baseDir, "uptp-agent", rc.logLevel, 1024*1024, lm))
-
-	if len(os.Args) > 1 {
-		switch os.Args[1] {
-		case "add":
-			if len(os.Args) < 8 {
-				logging.Error("Usage: uptp-agent add <name> <peer_id> <network> <local_ip> <local_port> <target_addr> <target_port>")
-				return
-			}
-			app := &gateway.PortmapApp{
-				Name:       os.Args[2],
-				PeerID:     os.Args[3],
-				Network:    os.Args[4],
-				LocalIP:    os.Args[5],
-				LocalPort:  parseInt(os.Args[6]),
-				TargetAddr: os.Args[7],
-				TargetPort: parseInt(os.Args[8]),
-				Running:    true,
-			}
-			if err := agent.AddApp(app); err != nil {
-				logging.Error("add app error: %v", err)
-			}
-			return
-
-		case "del":
-			if len(os.Args) < 3 {
-				logging.Error("Usage: uptp-agent del <name>")
-				return
-			}
-			if err := agent.DelApp(&gateway.PortmapApp{Name: os.Args[2]}); err != nil {
-				logging.Error("del app error: %v", err)
-			}
-			return
-		}
-	}
+	logging.SetLogger(logger.NewLogger(workDir, "uptp-agent", rc.logLevel, 1024*1024, lm))
 
 	// Normal agent start mode
-	if err := agent.Start(baseDir, true); err != nil {
+	if err := agent.Start(workDir, true); err != nil {
 		logging.Error("agent run error: %s", err)
 		return
 	}
+	if err := agent.StartControl(rc.ctl); err != nil {
+		logging.Error("start control api error: %s", err)
+	}
 	logging.Info("uptp agent started")
-	select {}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	agent.Close()
 }
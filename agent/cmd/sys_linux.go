@@ -0,0 +1,6 @@
+package main
+
+const (
+	defaultInstallPath = "/usr/local/uptp-agent"
+	defaultBinName     = "uptp-agent"
+)
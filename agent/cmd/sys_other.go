@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// 目前只支持安装为Linux的systemd服务
+
+func install(args []string) {
+	fmt.Fprintln(os.Stderr, "install is only supported on linux")
+	os.Exit(1)
+}
+
+func uninstall() {
+	fmt.Fprintln(os.Stderr, "uninstall is only supported on linux")
+	os.Exit(1)
+}
@@ -0,0 +1,5 @@
+package main
+
+const ProductName = "uptp-agent"
+
+var Version = "0.1.0"
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+
+	"github.com/isletnet/uptp/gateway"
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/types"
+	p2phttp "github.com/libp2p/go-libp2p-http"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// defaultConsoleAddr 默认监听回环地址的随机端口
+const defaultConsoleAddr = "127.0.0.1:0"
+
+// ConsoleProxy 本地端口代理到网关的web控制台，token是网关签发给本节点的管理凭证，不保存，agent重启后需要重新打开
+type ConsoleProxy struct {
+	PeerID string `json:"peer_id"`
+	Listen string `json:"listen"`
+	token  types.ID
+
+	server *http.Server
+}
+
+func (ag *agent) startConsole(peerID, listen string, token types.ID) (*ConsoleProxy, error) {
+	if !ag.running {
+		return nil, errors.New("agent not running")
+	}
+	if _, err := peer.Decode(peerID); err != nil {
+		return nil, err
+	}
+	if token == 0 {
+		return nil, errors.New("manage token is required")
+	}
+	if listen == "" {
+		listen = defaultConsoleAddr
+	}
+	ag.consoleMtx.Lock()
+	defer ag.consoleMtx.Unlock()
+	if cp, ok := ag.consoles[peerID]; ok && cp.token == token {
+		return cp, nil
+	} else if ok {
+		cp.server.Close()
+		delete(ag.consoles, peerID)
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	target := &url.URL{Scheme: "libp2p", Host: peerID}
+	rp := &httputil.ReverseProxy{
+		// RoundTripper优先按Host找节点，SetURL会清空Host
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Header.Set(gateway.ConsoleTokenHeader, strconv.FormatUint(token.Uint64(), 10))
+		},
+		Transport: p2phttp.NewTransport(ag.p2p.Libp2pHost(), p2phttp.ProtocolOption(gateway.ConsoleProtocolID)),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logging.Error("console proxy to %s error: %s", peerID, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+	cp := &ConsoleProxy{
+		PeerID: peerID,
+		Listen: ln.Addr().String(),
+		token:  token,
+		server: &http.Server{Handler: rp},
+	}
+	if ag.consoles == nil {
+		ag.consoles = make(map[string]*ConsoleProxy)
+	}
+	ag.consoles[peerID] = cp
+	logging.Info("console proxy listen on %s to gateway %s", cp.Listen, peerID)
+	go func() {
+		err := cp.server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			logging.Error("console proxy serve error: %s", err)
+		}
+	}()
+	return cp, nil
+}
+
+func (ag *agent) stopConsole(peerID string) error {
+	ag.consoleMtx.Lock()
+	defer ag.consoleMtx.Unlock()
+	cp, ok := ag.consoles[peerID]
+	if !ok {
+		return errors.New("console not started")
+	}
+	delete(ag.consoles, peerID)
+	return cp.server.Close()
+}
+
+func (ag *agent) stopConsoles() {
+	ag.consoleMtx.Lock()
+	defer ag.consoleMtx.Unlock()
+	for id, cp := range ag.consoles {
+		cp.server.Close()
+		delete(ag.consoles, id)
+	}
+}
+
+func (ag *agent) getConsoles() []ConsoleProxy {
+	ag.consoleMtx.Lock()
+	defer ag.consoleMtx.Unlock()
+	ret := make([]ConsoleProxy, 0, len(ag.consoles))
+	for _, cp := range ag.consoles {
+		ret = append(ret, *cp)
+	}
+	return ret
+}
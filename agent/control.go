@@ -0,0 +1,327 @@
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi"
+	apiutil "github.com/isletnet/uptp/apiutil.go"
+	"github.com/isletnet/uptp/gateway"
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/types"
+)
+
+// DefaultControlAddr 本地控制接口默认只监听回环地址
+const DefaultControlAddr = "127.0.0.1:3001"
+
+// ControlTokenFile 控制接口的token保存在工作目录下，只有本用户可读，
+// 请求需要带Authorization: Bearer <token>，防止网页跨站请求和其他用户调用
+const ControlTokenFile = "ctl_token"
+
+// AgentStatus 控制接口的状态信息
+type AgentStatus struct {
+	PeerID     string          `json:"peer_id"`
+	Apps       int             `json:"apps"`
+	Gateways   int             `json:"gateways"`
+	TunProxy   *ProxyState     `json:"tun_proxy,omitempty"`
+	LocalProxy *LocalProxyConf `json:"local_proxy,omitempty"`
+}
+
+type controlIDReq struct {
+	ID types.ID `json:"id"`
+}
+
+type controlProxyAddReq struct {
+	PeerID string `json:"peer_id"`
+	Token  string `json:"token"`
+}
+
+// controlProxyStartReq Tun不为空时启动TUN代理，否则在Listen上启动本地代理
+type controlProxyStartReq struct {
+	ID     types.ID `json:"id"`
+	Listen string   `json:"listen"`
+	Tun    string   `json:"tun"`
+}
+
+type controlProxyStopReq struct {
+	Tun bool `json:"tun"`
+}
+
+type controlConsoleReq struct {
+	PeerID string   `json:"peer_id"`
+	Listen string   `json:"listen"`
+	Token  types.ID `json:"token"`
+}
+
+func (ag *agent) startControl(listen string) error {
+	if !ag.running {
+		return errors.New("agent not running")
+	}
+	if listen == "" {
+		listen = DefaultControlAddr
+	}
+	token, err := loadControlToken(ag.workDir)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+		logging.Warn("agent control api listen on non-loopback address %s", ln.Addr())
+	}
+	ser := apiutil.NewApiServer()
+	ser.Use(ag.ctlAuth)
+	ag.controlRouter(ser)
+	ag.ctlMtx.Lock()
+	ag.ctlListener = ln
+	ag.ctlToken = token
+	ag.ctlMtx.Unlock()
+	logging.Info("agent control api listen on %s", ln.Addr())
+	go func() {
+		err := ser.Serve(ln)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logging.Error("agent control api serve error: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (ag *agent) stopControl() {
+	ag.ctlMtx.Lock()
+	defer ag.ctlMtx.Unlock()
+	if ag.ctlListener != nil {
+		ag.ctlListener.Close()
+		ag.ctlListener = nil
+	}
+}
+
+// loadControlToken 读取工作目录下的token，没有时生成
+func loadControlToken(workDir string) (string, error) {
+	p := filepath.Join(workDir, ControlTokenFile)
+	if buf, err := os.ReadFile(p); err == nil && len(strings.TrimSpace(string(buf))) > 0 {
+		return strings.TrimSpace(string(buf)), nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err := os.WriteFile(p, []byte(token), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ctlAuth 校验token，修改类请求只接受application/json，浏览器跨站表单无法构造
+func (ag *agent) ctlAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ag.ctlMtx.Lock()
+		token := ag.ctlToken
+		ag.ctlMtx.Unlock()
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mt != "application/json" {
+				http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ag *agent) controlRouter(ser *apiutil.ApiServer) {
+	ser.AddRoute("/status", func(r chi.Router) {
+		r.Get("/", ag.ctlStatus)
+	})
+	ser.AddRoute("/proxy", func(r chi.Router) {
+		r.Get("/list", ag.ctlListProxys)
+		r.Post("/add", ag.ctlAddProxy)
+		r.Post("/start", ag.ctlStartProxy)
+		r.Post("/stop", ag.ctlStopProxy)
+	})
+	ser.AddRoute("/console", func(r chi.Router) {
+		r.Get("/list", ag.ctlListConsoles)
+		r.Post("/start", ag.ctlStartConsole)
+		r.Post("/stop", ag.ctlStopConsole)
+	})
+	// 没有启用端口映射时不提供应用管理
+	if ag.am == nil {
+		return
+	}
+	ser.AddRoute("/app", func(r chi.Router) {
+		r.Get("/list", ag.ctlListApps)
+		r.Post("/add", ag.ctlAddApp)
+		r.Post("/update", ag.ctlUpdateApp)
+		r.Post("/delete", ag.ctlDelApp)
+		r.Post("/start", ag.ctlRunApp(true))
+		r.Post("/stop", ag.ctlRunApp(false))
+	})
+}
+
+// readCtlReq 解析失败时已经返回错误响应
+func readCtlReq(w http.ResponseWriter, r *http.Request, v any) bool {
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, v)
+	}
+	if err != nil {
+		apiutil.SendAPIRespWithOk(w, apiutil.ApiResponse{Code: 400, Message: err.Error()})
+		return false
+	}
+	return true
+}
+
+func sendCtlResult(w http.ResponseWriter, data any, err error) {
+	rsp := apiutil.ApiResponse{}
+	if err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	rsp.Data = data
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (ag *agent) ctlStatus(w http.ResponseWriter, r *http.Request) {
+	st := AgentStatus{
+		PeerID:     ag.p2p.Libp2pHost().ID().String(),
+		Apps:       len(ag.getApps()),
+		Gateways:   len(ag.proxyMgr.getProxys()),
+		TunProxy:   ag.getProxyState(),
+		LocalProxy: ag.getLocalProxy(),
+	}
+	sendCtlResult(w, st, nil)
+}
+
+func (ag *agent) ctlListApps(w http.ResponseWriter, r *http.Request) {
+	sendCtlResult(w, ag.getApps(), nil)
+}
+
+func (ag *agent) ctlAddApp(w http.ResponseWriter, r *http.Request) {
+	var app gateway.PortmapApp
+	if !readCtlReq(w, r, &app) {
+		return
+	}
+	err := ag.addApp(&app)
+	sendCtlResult(w, app, err)
+}
+
+func (ag *agent) ctlUpdateApp(w http.ResponseWriter, r *http.Request) {
+	var app gateway.PortmapApp
+	if !readCtlReq(w, r, &app) {
+		return
+	}
+	sendCtlResult(w, nil, ag.updateAPP(&app))
+}
+
+func (ag *agent) ctlDelApp(w http.ResponseWriter, r *http.Request) {
+	var req controlIDReq
+	if !readCtlReq(w, r, &req) {
+		return
+	}
+	if ag.am.GetPortmapApp(req.ID.Uint64()) == nil {
+		sendCtlResult(w, nil, errors.New("app not exists"))
+		return
+	}
+	sendCtlResult(w, nil, ag.delApp(&gateway.PortmapApp{ID: req.ID}))
+}
+
+func (ag *agent) ctlRunApp(running bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req controlIDReq
+		if !readCtlReq(w, r, &req) {
+			return
+		}
+		exist := ag.am.GetPortmapApp(req.ID.Uint64())
+		if exist == nil {
+			sendCtlResult(w, nil, errors.New("app not exists"))
+			return
+		}
+		app := *exist
+		app.Running = running
+		err := ag.updateAPP(&app)
+		if err == nil && running {
+			// 监听失败时updateAPP只记录在Err中
+			if a := ag.am.GetPortmapApp(req.ID.Uint64()); a != nil && !a.Running {
+				err = errors.New(a.Err)
+			}
+		}
+		sendCtlResult(w, nil, err)
+	}
+}
+
+func (ag *agent) ctlListProxys(w http.ResponseWriter, r *http.Request) {
+	sendCtlResult(w, ag.getProxyGatewayList(), nil)
+}
+
+func (ag *agent) ctlAddProxy(w http.ResponseWriter, r *http.Request) {
+	var req controlProxyAddReq
+	if !readCtlReq(w, r, &req) {
+		return
+	}
+	id, err := ag.addProxyGateway(req.PeerID, req.Token)
+	sendCtlResult(w, id, err)
+}
+
+func (ag *agent) ctlStartProxy(w http.ResponseWriter, r *http.Request) {
+	var req controlProxyStartReq
+	if !readCtlReq(w, r, &req) {
+		return
+	}
+	if req.Tun != "" {
+		sendCtlResult(w, nil, ag.startTunProxy(req.Tun, req.ID))
+		return
+	}
+	sendCtlResult(w, nil, ag.startLocalProxy(req.Listen, req.ID))
+}
+
+func (ag *agent) ctlStopProxy(w http.ResponseWriter, r *http.Request) {
+	var req controlProxyStopReq
+	if !readCtlReq(w, r, &req) {
+		return
+	}
+	if req.Tun {
+		sendCtlResult(w, nil, ag.stopTunProxy())
+		return
+	}
+	sendCtlResult(w, nil, ag.stopLocalProxy())
+}
+
+func (ag *agent) ctlListConsoles(w http.ResponseWriter, r *http.Request) {
+	sendCtlResult(w, ag.getConsoles(), nil)
+}
+
+func (ag *agent) ctlStartConsole(w http.ResponseWriter, r *http.Request) {
+	var req controlConsoleReq
+	if !readCtlReq(w, r, &req) {
+		return
+	}
+	cp, err := ag.startConsole(req.PeerID, req.Listen, req.Token)
+	sendCtlResult(w, cp, err)
+}
+
+func (ag *agent) ctlStopConsole(w http.ResponseWriter, r *http.Request) {
+	var req controlConsoleReq
+	if !readCtlReq(w, r, &req) {
+		return
+	}
+	sendCtlResult(w, nil, ag.stopConsole(req.PeerID))
+}
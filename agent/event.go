@@ -0,0 +1,322 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isletnet/uptp/gateway"
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/p2pengine"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+const (
+	EventPeerConnected    = "peer_connected"
+	EventPeerDisconnected = "peer_disconnected"
+	EventAuthFailed       = "auth_failed"
+	EventProxyStarted     = "proxy_started"
+	EventProxyStopped     = "proxy_stopped"
+	EventProxyState       = "proxy_state"
+	EventTraffic          = "traffic"
+	EventLog              = "log"
+	EventPortmapError     = "portmap_error"
+)
+
+const (
+	eventQueueSize  = 256
+	trafficInterval = 5 * time.Second
+	logEventLimit   = 20 // 每秒最多上报的日志事件
+)
+
+// 日志事件的级别，默认不上报
+const (
+	logEventOff = iota
+	logEventInfo
+	logEventWarn
+	logEventError
+)
+
+// EventListener 由宿主应用实现，kind为Event*常量，data为JSON，
+// 回调在同一个协程中按顺序调用，队列满时丢弃事件
+type EventListener interface {
+	OnEvent(kind string, data string)
+}
+
+type PeerEvent struct {
+	PeerID string `json:"peer_id"`
+	Name   string `json:"name,omitempty"`
+}
+
+type AuthFailedEvent struct {
+	PeerID string `json:"peer_id"`
+	Type   int    `json:"type"`
+	Err    string `json:"err"`
+}
+
+// ProxyEvent Mode为tun或local，Listen只在本地代理时有值
+type ProxyEvent struct {
+	Mode   string `json:"mode"`
+	PeerID string `json:"peer_id,omitempty"`
+	Listen string `json:"listen,omitempty"`
+	Err    string `json:"err,omitempty"`
+}
+
+type TrafficEvent struct {
+	TotalIn  int64   `json:"total_in"`
+	TotalOut int64   `json:"total_out"`
+	RateIn   float64 `json:"rate_in"`
+	RateOut  float64 `json:"rate_out"`
+}
+
+type LogEvent struct {
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+type PortmapErrorEvent struct {
+	AppID string `json:"app_id"`
+	Name  string `json:"name"`
+	Err   string `json:"err"`
+}
+
+type agentEvent struct {
+	kind string
+	data string
+}
+
+type eventBus struct {
+	mtx sync.Mutex
+	l   EventListener
+
+	ch   chan agentEvent
+	exit chan struct{}
+	// p2p 流量统计使用，close时先清空再关闭引擎
+	p2p atomic.Pointer[p2pengine.P2PEngine]
+
+	logLevel  atomic.Int32
+	logMtx    sync.Mutex
+	logWindow time.Time
+	logCount  int
+}
+
+func (ag *agent) setEventListener(l EventListener) {
+	ag.events.mtx.Lock()
+	defer ag.events.mtx.Unlock()
+	ag.events.l = l
+	ag.startEventsLocked()
+}
+
+// startEvents agent启动时调用，已注册监听时重新启动分发协程
+func (ag *agent) startEvents(p2p *p2pengine.P2PEngine) {
+	ag.events.p2p.Store(p2p)
+	ag.events.mtx.Lock()
+	defer ag.events.mtx.Unlock()
+	ag.startEventsLocked()
+}
+
+func (ag *agent) startEventsLocked() {
+	if ag.events.l == nil || ag.events.ch != nil {
+		return
+	}
+	ag.events.ch = make(chan agentEvent, eventQueueSize)
+	ag.events.exit = make(chan struct{})
+	go ag.dispatchEvents(ag.events.ch, ag.events.exit)
+}
+
+// stopEvents 停止分发协程，监听保留到下次启动
+func (ag *agent) stopEvents() {
+	ag.events.p2p.Store(nil)
+	ag.events.mtx.Lock()
+	defer ag.events.mtx.Unlock()
+	if ag.events.exit != nil {
+		close(ag.events.exit)
+		ag.events.ch = nil
+		ag.events.exit = nil
+	}
+}
+
+// setLogEventLevel 设置上报日志事件的最低级别，off或空字符串表示不上报
+func (ag *agent) setLogEventLevel(level string) error {
+	var l int32
+	switch level {
+	case "", "off":
+		l = logEventOff
+	case "info":
+		l = logEventInfo
+	case "warn":
+		l = logEventWarn
+	case "error":
+		l = logEventError
+	default:
+		return errors.New("invalid log event level")
+	}
+	ag.events.logLevel.Store(l)
+	return nil
+}
+
+// allowLog 按级别过滤日志事件，超过每秒上限的丢弃
+func (ag *agent) allowLog(level int32) bool {
+	want := ag.events.logLevel.Load()
+	if want == logEventOff || level < want {
+		return false
+	}
+	ag.events.logMtx.Lock()
+	defer ag.events.logMtx.Unlock()
+	now := time.Now()
+	if now.Sub(ag.events.logWindow) >= time.Second {
+		ag.events.logWindow = now
+		ag.events.logCount = 0
+	}
+	if ag.events.logCount >= logEventLimit {
+		return false
+	}
+	ag.events.logCount++
+	return true
+}
+
+func (ag *agent) eventListener() EventListener {
+	ag.events.mtx.Lock()
+	defer ag.events.mtx.Unlock()
+	return ag.events.l
+}
+
+// emit 没有注册监听时直接丢弃，不能在这里打日志，否则日志事件会循环
+func (ag *agent) emit(kind string, v any) {
+	ag.events.mtx.Lock()
+	l, ch := ag.events.l, ag.events.ch
+	ag.events.mtx.Unlock()
+	if l == nil || ch == nil {
+		return
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	select {
+	case ch <- agentEvent{kind: kind, data: string(buf)}:
+	default:
+	}
+}
+
+func (ag *agent) dispatchEvents(ch chan agentEvent, exit chan struct{}) {
+	tk := time.NewTicker(trafficInterval)
+	defer tk.Stop()
+	var last TrafficEvent
+	for {
+		select {
+		case e := <-ch:
+			ag.deliverEvent(e)
+		case <-exit:
+			// 把关闭过程中产生的事件发完再退出
+			for {
+				select {
+				case e := <-ch:
+					ag.deliverEvent(e)
+				default:
+					return
+				}
+			}
+		case <-tk.C:
+			p2p := ag.events.p2p.Load()
+			if p2p == nil {
+				continue
+			}
+			bw := p2p.Bandwidth()
+			te := TrafficEvent{
+				TotalIn:  bw.TotalIn,
+				TotalOut: bw.TotalOut,
+				RateIn:   bw.RateIn,
+				RateOut:  bw.RateOut,
+			}
+			if te != last {
+				last = te
+				ag.emit(EventTraffic, te)
+			}
+		}
+	}
+}
+
+func (ag *agent) deliverEvent(e agentEvent) {
+	if l := ag.eventListener(); l != nil {
+		l.OnEvent(e.kind, e.data)
+	}
+}
+
+// watchPeers 只上报代理网关和端口映射网关的连接变化
+func (ag *agent) watchPeers() {
+	sub, err := ag.p2p.Libp2pHost().EventBus().Subscribe(new(event.EvtPeerConnectednessChanged))
+	if err != nil {
+		logging.Error("subscribe peer connectedness event error: %s", err)
+		return
+	}
+	defer sub.Close()
+	for evt := range sub.Out() {
+		e := evt.(event.EvtPeerConnectednessChanged)
+		name, ok := ag.knownPeer(e.Peer.String())
+		if !ok {
+			continue
+		}
+		kind := EventPeerDisconnected
+		if e.Connectedness == network.Connected {
+			kind = EventPeerConnected
+		}
+		ag.emit(kind, PeerEvent{PeerID: e.Peer.String(), Name: name})
+	}
+}
+
+func (ag *agent) knownPeer(peerID string) (string, bool) {
+	if ag.proxyMgr != nil {
+		if pg := ag.proxyMgr.getProxyByPeerID(peerID); pg != nil {
+			return pg.Name, true
+		}
+	}
+	if ag.am != nil {
+		for _, a := range ag.am.GetPortmapApps() {
+			if a.PeerID == peerID {
+				return a.PeerName, true
+			}
+			if slices.ContainsFunc(a.BackupPeers, func(p gateway.BackupPeer) bool { return p.PeerID == peerID }) {
+				return "", true
+			}
+		}
+	}
+	return "", false
+}
+
+func (ag *agent) emitPortmapError(a *gateway.PortmapApp, err error) {
+	ag.emit(EventPortmapError, PortmapErrorEvent{AppID: a.ID.String(), Name: a.Name, Err: err.Error()})
+}
+
+// eventLogger 在写日志的同时把达到设置级别的日志作为事件上报，默认不上报
+type eventLogger struct {
+	logging.Logger
+	ag *agent
+}
+
+func (l *eventLogger) Info(format string, v ...interface{}) {
+	l.Logger.Info(format, v...)
+	l.emitLog(logEventInfo, "info", format, v...)
+}
+
+func (l *eventLogger) Warn(format string, v ...interface{}) {
+	l.Logger.Warn(format, v...)
+	l.emitLog(logEventWarn, "warn", format, v...)
+}
+
+func (l *eventLogger) Error(format string, v ...interface{}) {
+	l.Logger.Error(format, v...)
+	l.emitLog(logEventError, "error", format, v...)
+}
+
+func (l *eventLogger) emitLog(level int32, name, format string, v ...interface{}) {
+	if l.ag.eventListener() == nil || !l.ag.allowLog(level) {
+		return
+	}
+	l.ag.emit(EventLog, LogEvent{Level: name, Msg: fmt.Sprintf(format, v...)})
+}
@@ -2,8 +2,11 @@ package agent
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 
 	"github.com/isletnet/uptp/gateway"
+	"github.com/isletnet/uptp/types"
 )
 
 func Start(workDir string, withPortmap bool) error {
@@ -30,12 +33,84 @@ func GetApps() []gateway.PortmapApp {
 	return agentIns().getApps()
 }
 
-func AddProxyGateway(peerID string, token string) error {
-	return agentIns().addProxyGateway(peerID, token)
+// GetPortmapPeerStatsJson 返回各网关的连接数、延迟和可用状态
+func GetPortmapPeerStatsJson() string {
+	l := agentIns().getPeerStats()
+	if l == nil {
+		return ""
+	}
+	buf, _ := json.Marshal(l)
+	return string(buf)
+}
+
+func AddReverseService(rs *ReverseService) error {
+	return agentIns().addReverseService(rs)
+}
+
+func UpdateReverseService(rs *ReverseService) error {
+	return agentIns().updateReverseService(rs)
+}
+
+func DelReverseService(id string) error {
+	rid, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	return agentIns().delReverseService(rid)
+}
+
+func GetReverseServices() []ReverseService {
+	return agentIns().getReverseServices()
+}
+
+func GetReverseServicesJson() string {
+	l := GetReverseServices()
+	if l == nil {
+		return ""
+	}
+	buf, _ := json.Marshal(l)
+	return string(buf)
+}
+
+// AddProxyGateway 授权并添加代理网关，返回网关ID，相同的网关不能重复添加
+func AddProxyGateway(peerID string, token string) (string, error) {
+	id, err := agentIns().addProxyGateway(peerID, token)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+func DelProxyGateway(id string) error {
+	gid, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	return agentIns().delProxyGateway(gid)
 }
 
-func DelProxyGateway(index int) error {
-	return agentIns().delProxyGateway(index)
+func RenameProxyGateway(id string, name string) error {
+	gid, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	return agentIns().renameProxyGateway(gid, name)
+}
+
+// RefreshProxyGateway 重新授权并更新网关下发的路由和DNS，token为空时使用原来的token
+func RefreshProxyGateway(id string, token string) error {
+	gid, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	var uToken uint64
+	if token != "" {
+		uToken, err = strconv.ParseUint(token, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	return agentIns().refreshProxyGateway(gid, uToken)
 }
 
 func GetProxyGateways() []proxyGateway {
@@ -51,18 +126,190 @@ func GetProxyGatewaysJson() string {
 	return string(buf)
 }
 
-func StartTunProxy(tunDevice string, gatewayIdx int) error {
-	return agentIns().startTunProxy(tunDevice, gatewayIdx)
+func StartTunProxy(tunDevice string, gatewayID string) error {
+	gid, err := parseID(gatewayID)
+	if err != nil {
+		return err
+	}
+	return agentIns().startTunProxy(tunDevice, gid)
 }
 
 func StopTunProxy() error {
 	return agentIns().stopTunProxy()
 }
 
+// SetProxyGatewayEnabled 网关是否参与TUN按网段分流，TUN运行中立即生效
+func SetProxyGatewayEnabled(id string, enable bool) error {
+	gid, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	return agentIns().setProxyGatewayEnabled(gid, enable)
+}
+
+// GetTunRoutesJson 启用的网关和主网关下发的网段，用于设置VPN路由
+func GetTunRoutesJson(gatewayID string) string {
+	gid, err := parseID(gatewayID)
+	if err != nil {
+		return ""
+	}
+	l := agentIns().tunRoutes(gid)
+	if l == nil {
+		return ""
+	}
+	buf, _ := json.Marshal(l)
+	return string(buf)
+}
+
+// GetTunRouteStatsJson TUN路由表和每条路由的连接统计
+func GetTunRouteStatsJson() string {
+	l := agentIns().listTunRoutes()
+	if l == nil {
+		return ""
+	}
+	buf, _ := json.Marshal(l)
+	return string(buf)
+}
+
+// StartLocalProxy 在listen地址上启动SOCKS5/HTTP代理，通过指定的代理网关转发，listen为空时使用127.0.0.1:1080
+func StartLocalProxy(listen string, gatewayID string) error {
+	gid, err := parseID(gatewayID)
+	if err != nil {
+		return err
+	}
+	return agentIns().startLocalProxy(listen, gid)
+}
+
+func StopLocalProxy() error {
+	return agentIns().stopLocalProxy()
+}
+
+func GetLocalProxyJson() string {
+	conf := agentIns().getLocalProxy()
+	if conf == nil {
+		return ""
+	}
+	buf, _ := json.Marshal(conf)
+	return string(buf)
+}
+
+// StartConsole 在本地端口代理指定网关的web控制台，token是该网关签发给本节点的管理凭证，
+// 返回实际监听地址，listen为空时监听127.0.0.1的随机端口
+func StartConsole(peerID string, listen string, token string) (string, error) {
+	t, err := parseID(token)
+	if err != nil {
+		return "", err
+	}
+	cp, err := agentIns().startConsole(peerID, listen, t)
+	if err != nil {
+		return "", err
+	}
+	return cp.Listen, nil
+}
+
+func StopConsole(peerID string) error {
+	return agentIns().stopConsole(peerID)
+}
+
+// SetProxyDomainJson 设置域名分流配置，格式见ProxyDomainConf，对TUN代理和本地代理立即生效
+func SetProxyDomainJson(conf string) error {
+	var c ProxyDomainConf
+	err := json.Unmarshal([]byte(conf), &c)
+	if err != nil {
+		return err
+	}
+	return agentIns().setProxyDomain(&c)
+}
+
+func GetProxyDomainJson() string {
+	conf := agentIns().getProxyDomain()
+	if conf == nil {
+		return ""
+	}
+	buf, _ := json.Marshal(conf)
+	return string(buf)
+}
+
+// SetTunDNSJson 设置TUN内DNS的按域名解析服务器，格式见TunDNSConf，下次启动TUN代理时生效
+func SetTunDNSJson(conf string) error {
+	var c TunDNSConf
+	err := json.Unmarshal([]byte(conf), &c)
+	if err != nil {
+		return err
+	}
+	return agentIns().setTunDNS(&c)
+}
+
+func GetTunDNSJson() string {
+	conf := agentIns().getTunDNS()
+	if conf == nil {
+		return ""
+	}
+	buf, _ := json.Marshal(conf)
+	return string(buf)
+}
+
 // func SetLog(d string) {
 // 	agentIns().setLog(d)
 // }
 
-func PingProxyGateway(idx int) error {
-	return agentIns().pingProxyGateway(idx)
+// SetProxyMonitorJson 设置TUN代理的网关监控，目前只有是否自动切换网关
+func SetProxyMonitorJson(conf string) error {
+	var c ProxyMonitorConf
+	err := json.Unmarshal([]byte(conf), &c)
+	if err != nil {
+		return err
+	}
+	return agentIns().setProxyMonitor(&c)
+}
+
+func GetProxyMonitorJson() string {
+	c := agentIns().getProxyMonitor()
+	if c == nil {
+		return ""
+	}
+	buf, _ := json.Marshal(c)
+	return string(buf)
+}
+
+// GetProxyStateJson TUN代理当前网关的状态，未启动TUN代理时为空，
+// 状态变化通过SetEventListener注册的监听以proxy_state事件通知
+func GetProxyStateJson() string {
+	st := agentIns().getProxyState()
+	if st == nil {
+		return ""
+	}
+	buf, _ := json.Marshal(st)
+	return string(buf)
+}
+
+// StartControl 启动本地控制接口，listen为空时使用DefaultControlAddr
+func StartControl(listen string) error {
+	return agentIns().startControl(listen)
+}
+
+// SetEventListener 注册事件监听，传nil取消
+func SetEventListener(l EventListener) {
+	agentIns().setEventListener(l)
+}
+
+// SetLogEventLevel 开启日志事件，level为info、warn、error或off，默认off
+func SetLogEventLevel(level string) error {
+	return agentIns().setLogEventLevel(level)
+}
+
+func PingProxyGateway(id string) error {
+	gid, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	return agentIns().pingProxyGateway(gid)
+}
+
+func parseID(id string) (types.ID, error) {
+	v, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", id)
+	}
+	return types.ID(v), nil
 }
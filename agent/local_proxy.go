@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/socks5"
+	"github.com/isletnet/uptp/types"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	defaultLocalProxyAddr = "127.0.0.1:1080"
+)
+
+var (
+	keyLocalProxy = []byte("local_proxy")
+)
+
+// LocalProxyConf 本地SOCKS5/HTTP代理配置，Running时agent启动后自动监听
+type LocalProxyConf struct {
+	Listen    string   `json:"listen"`
+	GatewayID types.ID `json:"gateway_id"`
+	Running   bool     `json:"running"`
+	Err       string   `json:"err,omitempty"`
+}
+
+func (ag *agent) loadLocalProxyConf() (conf LocalProxyConf, err error) {
+	v, err := ag.db.Get(keyLocalProxy, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(v, &conf)
+	return
+}
+
+func (ag *agent) saveLocalProxyConf(conf *LocalProxyConf) error {
+	buf, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	return ag.db.Put(keyLocalProxy, buf, nil)
+}
+
+// restoreLocalProxy agent启动时恢复上次运行的本地代理
+func (ag *agent) restoreLocalProxy() {
+	conf, err := ag.loadLocalProxyConf()
+	if err != nil {
+		logging.Error("load local proxy config error: %s", err)
+		return
+	}
+	if !conf.Running {
+		return
+	}
+	err = ag.listenLocalProxy(conf.Listen, conf.GatewayID)
+	if err != nil {
+		logging.Error("start local proxy error: %s", err)
+	}
+}
+
+func (ag *agent) startLocalProxy(listen string, gatewayID types.ID) error {
+	if !ag.running {
+		return errors.New("agent not running")
+	}
+	if listen == "" {
+		listen = defaultLocalProxyAddr
+	}
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return err
+	}
+	ag.stopLocalServer()
+	err := ag.listenLocalProxy(listen, gatewayID)
+	if err != nil {
+		return err
+	}
+	return ag.saveLocalProxyConf(&LocalProxyConf{
+		Listen:    listen,
+		GatewayID: gatewayID,
+		Running:   true,
+	})
+}
+
+func (ag *agent) listenLocalProxy(listen string, gatewayID types.ID) error {
+	pg := ag.proxyMgr.getProxy(gatewayID)
+	if pg == nil {
+		return errGatewayNotFound
+	}
+	dialer := socks5.NewDialer(ag.p2p.Libp2pHost(), pg.peer.ID, pg.peer.UserName, pg.peer.Password)
+	ls, err := socks5.NewLocalServer(listen, ag.splitDial(dialer.DialContext))
+	if err != nil {
+		return err
+	}
+	ag.lpMtx.Lock()
+	ag.localProxy = ls
+	ag.lpMtx.Unlock()
+	logging.Info("local proxy listen on %s to gateway %s", ls.Addr(), pg.peer.ID.ShortString())
+	ag.emit(EventProxyStarted, ProxyEvent{Mode: "local", PeerID: pg.PeerID, Listen: ls.Addr().String()})
+	go func() {
+		err := ls.Serve()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logging.Error("local proxy serve error: %s", err)
+			ag.emit(EventProxyStopped, ProxyEvent{Mode: "local", Listen: ls.Addr().String(), Err: err.Error()})
+		}
+	}()
+	return nil
+}
+
+func (ag *agent) stopLocalServer() {
+	ag.lpMtx.Lock()
+	defer ag.lpMtx.Unlock()
+	if ag.localProxy != nil {
+		ag.localProxy.Close()
+		ag.localProxy = nil
+	}
+}
+
+func (ag *agent) stopLocalProxy() error {
+	ag.stopLocalServer()
+	ag.emit(EventProxyStopped, ProxyEvent{Mode: "local"})
+	if ag.db == nil {
+		return nil
+	}
+	conf, err := ag.loadLocalProxyConf()
+	if err != nil {
+		return err
+	}
+	conf.Running = false
+	return ag.saveLocalProxyConf(&conf)
+}
+
+func (ag *agent) getLocalProxy() *LocalProxyConf {
+	if !ag.running {
+		return nil
+	}
+	conf, err := ag.loadLocalProxyConf()
+	if err != nil {
+		return nil
+	}
+	ag.lpMtx.Lock()
+	defer ag.lpMtx.Unlock()
+	if conf.Running && ag.localProxy == nil {
+		conf.Err = "not listening"
+	}
+	if ag.localProxy != nil {
+		conf.Listen = ag.localProxy.Addr().String()
+	}
+	return &conf
+}
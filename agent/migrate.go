@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+
+	"github.com/isletnet/uptp/gateway"
+	"github.com/isletnet/uptp/store"
+	"github.com/isletnet/uptp/types"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// 集合类数据每条记录一个key，格式为<prefix>/<id>
+const (
+	prefixProxy   = "proxy"
+	prefixReverse = "reverse"
+)
+
+// agentMigrations 只能在末尾追加，已发布的升级不能修改
+var agentMigrations = []store.Migration{
+	{Version: 1, Name: "split collections into records", Run: func(db *leveldb.DB, b *leveldb.Batch) error {
+		if err := gateway.MigratePortmapApps(db, b); err != nil {
+			return err
+		}
+		return splitProxys(db, b)
+	}},
+}
+
+// splitProxys 旧版本的网关列表整体保存为数组，早期的网关没有ID
+func splitProxys(db *leveldb.DB, b *leveldb.Batch) error {
+	v, err := db.Get([]byte("proxys"), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var l []map[string]json.RawMessage
+	if err := json.Unmarshal(v, &l); err != nil {
+		return err
+	}
+	for _, p := range l {
+		if p == nil {
+			continue
+		}
+		var id types.ID
+		if raw, ok := p["id"]; ok {
+			json.Unmarshal(raw, &id)
+		}
+		if id == 0 {
+			id = types.ID(rand.Uint64())
+			p["id"], _ = json.Marshal(id)
+		}
+		if err := store.PutRecord(b, prefixProxy, id, p); err != nil {
+			return err
+		}
+	}
+	b.Delete([]byte("proxys"))
+	return nil
+}
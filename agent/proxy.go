@@ -3,16 +3,18 @@ package agent
 import (
 	"context"
 	"encoding/binary"
-	"encoding/json"
-	"fmt"
+	"math/rand/v2"
 	"net"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/isletnet/uptp/dnsfwd"
 	"github.com/isletnet/uptp/gateway"
 	"github.com/isletnet/uptp/logging"
 	"github.com/isletnet/uptp/socks5"
+	"github.com/isletnet/uptp/splitroute"
+	"github.com/isletnet/uptp/store"
 	"github.com/isletnet/uptp/types"
 
 	tunstack "github.com/isletnet/uptp/tun_stack"
@@ -35,80 +37,192 @@ func stopTun2socks() error {
 	return tunstack.Stop()
 }
 
-func (ag *agent) addProxyGateway(peerID string, token string) error {
+// authorizeProxy 向网关授权，返回的网关信息不包含ID
+func (ag *agent) authorizeProxy(peerID string, token uint64) (*proxyGateway, error) {
 	pid, err := peer.Decode(peerID)
 	if err != nil {
-		return err
-	}
-	uToken, err := strconv.ParseUint(token, 10, 64)
-	if err != nil {
-		return err
+		return nil, err
 	}
 	rsp, err := gateway.ResourceAuthorize(ag.p2p.Libp2pHost(), peerID, gateway.AuthorizeReq{
 		Type: gateway.AuthorizeTypeProxy,
 		Proxy: &gateway.AuthorizeProxyInfo{
-			Token: types.ID(uToken),
+			Token: types.ID(token),
 		},
 	})
+	if err == nil && rsp.Err != "" {
+		err = errors.New(rsp.Err)
+	} else if err == nil && rsp.Proxy == nil {
+		err = errors.New("proxy auth failed")
+	}
+	if err != nil {
+		ag.emit(EventAuthFailed, AuthFailedEvent{PeerID: peerID, Type: gateway.AuthorizeTypeProxy, Err: err.Error()})
+		return nil, err
+	}
+	pg := &proxyGateway{
+		Name:      rsp.NodeName,
+		PeerID:    peerID,
+		Token:     token,
+		Route:     rsp.Proxy.Route,
+		Dns:       rsp.Proxy.Dns,
+		DnsStream: rsp.Proxy.DnsStream,
+	}
+	// 网关支持DNS-over-stream时由agent在TUN地址上提供DNS
+	if pg.DnsStream {
+		pg.Dns = tunDNSAddr.String()
+	}
+	pg.setPeer(pid)
+	return pg, nil
+}
+
+func (ag *agent) addProxyGateway(peerID string, token string) (types.ID, error) {
+	uToken, err := strconv.ParseUint(token, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if ag.proxyMgr.getProxyByPeerID(peerID) != nil {
+		return 0, errors.New("gateway already exists")
+	}
+	pg, err := ag.authorizeProxy(peerID, uToken)
+	if err != nil {
+		return 0, err
+	}
+	pg.ID = types.ID(rand.Uint64())
+	err = ag.proxyMgr.addProxy(pg)
+	if err != nil {
+		return 0, err
+	}
+	ag.rebuildTunRouter()
+	return pg.ID, nil
+}
+
+// refreshProxyGateway 重新授权并更新网关下发的路由和DNS，token为0时使用原来的token，名称不变
+func (ag *agent) refreshProxyGateway(id types.ID, token uint64) error {
+	old := ag.proxyMgr.getProxy(id)
+	if old == nil {
+		return errGatewayNotFound
+	}
+	if token == 0 {
+		token = old.Token
+	}
+	pg, err := ag.authorizeProxy(old.PeerID, token)
 	if err != nil {
 		return err
 	}
-	if rsp.Err != "" {
-		return errors.New(rsp.Err)
+	err = ag.proxyMgr.updateProxy(id, func(p *proxyGateway) {
+		p.Token = pg.Token
+		p.Route = pg.Route
+		p.Dns = pg.Dns
+		p.DnsStream = pg.DnsStream
+		p.peer = pg.peer
+	})
+	if err != nil {
+		return err
 	}
-	if rsp.Proxy == nil {
-		return errors.New("proxy auth failed")
+	ag.rebuildTunRouter()
+	return nil
+}
+
+func (ag *agent) renameProxyGateway(id types.ID, name string) error {
+	if name == "" {
+		return errors.New("gateway name is empty")
 	}
-	tokenByte := make([]byte, 8)
-	binary.LittleEndian.PutUint64(tokenByte, uToken)
-	return ag.proxyMgr.addProxy(&proxyGateway{
-		peer: socks5.PeerWithAuth{
-			ID:       pid,
-			UserName: tokenByte,
-			Password: tokenByte,
-		},
-		Name:   rsp.NodeName,
-		PeerID: peerID,
-		Token:  uToken,
-		Route:  rsp.Proxy.Route,
-		Dns:    rsp.Proxy.Dns,
+	return ag.proxyMgr.updateProxy(id, func(p *proxyGateway) {
+		p.Name = name
 	})
 }
 
-func (ag *agent) delProxyGateway(index int) error {
-	return ag.proxyMgr.delProxyByIndex(index)
+func (ag *agent) delProxyGateway(id types.ID) error {
+	err := ag.proxyMgr.delProxy(id)
+	if err != nil {
+		return err
+	}
+	ag.rebuildTunRouter()
+	return nil
 }
 
 func (ag *agent) getProxyGatewayList() []proxyGateway {
 	return ag.proxyMgr.getProxys()
 }
 
-func (ag *agent) startTunProxy(tunDevice string, gatewayIdx int) error {
-	pg := ag.proxyMgr.getProxyByIndex(gatewayIdx)
+func (ag *agent) startTunProxy(tunDevice string, id types.ID) error {
+	pg := ag.proxyMgr.getProxy(id)
 	if pg == nil {
-		return fmt.Errorf("gateway not found")
+		return errGatewayNotFound
 	}
 	err := startTun2socks(tunDevice)
 	if err != nil {
 		return err
 	}
-	logging.Info("start proxy to gateway %s with %x", pg.peer.ID.ShortString(), pg.peer.Password)
 	ag.p2p.DHT().ForceRefresh()
-	tunstack.SetProxyDialer(&proxyDialer{
-		dialer: socks5.NewDialer(ag.p2p.Libp2pHost(), pg.peer.ID, pg.peer.UserName, pg.peer.Password),
-	})
+	ag.tunMtx.Lock()
+	ag.tunDNSOn = pg.DnsStream
+	ag.tunMtx.Unlock()
+	// VPN的DNS已经指向tunDNSAddr，TUN内的DNS启动失败时所有解析都会失败
+	if err := ag.useTunGateway(pg); err != nil {
+		stopTun2socks()
+		return err
+	}
+	ag.startProxyMonitor(pg)
+	ag.emit(EventProxyStarted, ProxyEvent{Mode: "tun", PeerID: pg.PeerID})
 	return nil
 }
 
+// useTunGateway 切换TUN的主网关，已建立的连接不受影响
+func (ag *agent) useTunGateway(pg *proxyGateway) error {
+	logging.Info("start proxy to gateway %s with %x", pg.peer.ID.ShortString(), pg.peer.Password)
+	d := socks5.NewDialer(ag.p2p.Libp2pHost(), pg.peer.ID, pg.peer.UserName, pg.peer.Password)
+	pd := &proxyDialer{
+		ag:     ag,
+		dialer: d,
+	}
+	pd.dial = ag.splitDial(pd.dialByRoute)
+	ag.tunMtx.Lock()
+	dnsOn := ag.tunDNSOn
+	ag.tunMtx.Unlock()
+	var err error
+	if pg.DnsStream {
+		pd.dns, err = ag.newTunDNS(pg)
+	} else if dnsOn {
+		// VPN的DNS在建立时已经固定为tunDNSAddr，切换到不支持DNS-over-stream的网关后改为经网关UDP转发
+		pd.dns, err = ag.newTunUDPDNS(pg, d)
+	}
+	if err != nil {
+		logging.Error("start tun dns error: %s", err)
+		return err
+	}
+	ag.resetTunRouter(pg.PeerID)
+	ag.swapTunDialer(pd)
+	return nil
+}
+
+// swapTunDialer 替换TUN使用的dialer，关闭旧dialer的DNS转发
+func (ag *agent) swapTunDialer(pd *proxyDialer) {
+	ag.tunMtx.Lock()
+	old := ag.tunDialer
+	ag.tunDialer = pd
+	ag.tunMtx.Unlock()
+	if pd == nil {
+		tunstack.SetProxyDialer(nil)
+	} else {
+		tunstack.SetProxyDialer(pd)
+	}
+	if old != nil && old.dns != nil {
+		old.dns.Close()
+	}
+}
+
 func (ag *agent) stopTunProxy() error {
-	tunstack.SetProxyDialer(nil)
+	ag.stopProxyMonitor()
+	ag.swapTunDialer(nil)
+	ag.resetTunRouter("")
+	ag.emit(EventProxyStopped, ProxyEvent{Mode: "tun"})
 	return stopTun2socks()
 }
 
-func (ag *agent) pingProxyGateway(idx int) error {
-	pg := ag.proxyMgr.getProxyByIndex(idx)
+func (ag *agent) pingProxyGateway(id types.ID) error {
+	pg := ag.proxyMgr.getProxy(id)
 	if pg == nil {
-		return fmt.Errorf("gateway not found")
+		return errGatewayNotFound
 	}
 	err := ag.p2p.DHT().Ping(context.Background(), pg.peer.ID)
 	if err != nil {
@@ -117,58 +231,58 @@ func (ag *agent) pingProxyGateway(idx int) error {
 	return nil
 }
 
+var errGatewayNotFound = errors.New("gateway not found")
+
 type proxyMgr struct {
 	db     *leveldb.DB
 	proxys []*proxyGateway
 	mtx    sync.Mutex
 }
 
-var (
-	keyProxys = []byte("proxys")
-)
-
 func (pm *proxyMgr) loadProxys() error {
 	pm.mtx.Lock()
 	defer pm.mtx.Unlock()
-	v, err := pm.db.Get(keyProxys, nil)
-	if err != nil {
-		if err != leveldb.ErrNotFound {
-			return err
-		}
-		return nil
-	}
-	err = json.Unmarshal(v, &pm.proxys)
-	if err != nil {
-		return err
-	}
-	for _, p := range pm.proxys {
-		p.peer.ID, err = peer.Decode(p.PeerID)
+	pm.proxys = nil
+	return store.LoadRecords(pm.db, prefixProxy, func(id types.ID, p *proxyGateway) {
+		pid, err := peer.Decode(p.PeerID)
 		if err != nil {
 			logging.Error("wrong proxy gateway id")
-			continue
+		} else {
+			p.setPeer(pid)
 		}
-		tokenBytes := make([]byte, 8)
-		binary.LittleEndian.PutUint64(tokenBytes, p.Token)
-		p.peer.Password = tokenBytes
-		p.peer.UserName = tokenBytes
-	}
-	return nil
+		pm.proxys = append(pm.proxys, p)
+	})
 }
 
 func (pm *proxyMgr) addProxy(p *proxyGateway) error {
 	pm.mtx.Lock()
 	defer pm.mtx.Unlock()
 	pm.proxys = append(pm.proxys, p)
-	return pm.saveProxys()
+	return pm.saveProxy(p)
 }
-func (pm *proxyMgr) getProxyByIndex(idx int) *proxyGateway {
+
+func (pm *proxyMgr) getProxy(id types.ID) *proxyGateway {
 	pm.mtx.Lock()
 	defer pm.mtx.Unlock()
-	if len(pm.proxys) <= idx {
-		return nil
+	for _, p := range pm.proxys {
+		if p.ID == id {
+			return p
+		}
 	}
-	return pm.proxys[idx]
+	return nil
+}
+
+func (pm *proxyMgr) getProxyByPeerID(peerID string) *proxyGateway {
+	pm.mtx.Lock()
+	defer pm.mtx.Unlock()
+	for _, p := range pm.proxys {
+		if p.PeerID == peerID {
+			return p
+		}
+	}
+	return nil
 }
+
 func (pm *proxyMgr) getProxys() []proxyGateway {
 	pm.mtx.Lock()
 	defer pm.mtx.Unlock()
@@ -179,42 +293,71 @@ func (pm *proxyMgr) getProxys() []proxyGateway {
 	return proxys
 }
 
-func (pm *proxyMgr) delProxyByIndex(index int) error {
+func (pm *proxyMgr) delProxy(id types.ID) error {
 	pm.mtx.Lock()
 	defer pm.mtx.Unlock()
-	if len(pm.proxys) <= index {
-		return nil
+	for i, p := range pm.proxys {
+		if p.ID == id {
+			pm.proxys = append(pm.proxys[:i], pm.proxys[i+1:]...)
+			return store.Update(pm.db, func(b *leveldb.Batch) error {
+				store.DeleteRecord(b, prefixProxy, id)
+				return nil
+			})
+		}
 	}
-	pm.proxys = append(pm.proxys[:index], pm.proxys[index+1:]...)
-	return pm.saveProxys()
+	return errGatewayNotFound
 }
 
-func (pm *proxyMgr) saveProxys() error {
-	if pm.proxys == nil {
-		return pm.db.Delete(keyProxys, nil)
-	}
-	buf, err := json.Marshal(pm.proxys)
-	if err != nil {
-		return err
-	}
-	err = pm.db.Put(keyProxys, buf, nil)
-	if err != nil {
-		return err
+// updateProxy 修改副本后替换，其他地方持有的旧指针不受影响
+func (pm *proxyMgr) updateProxy(id types.ID, f func(p *proxyGateway)) error {
+	pm.mtx.Lock()
+	defer pm.mtx.Unlock()
+	for i, p := range pm.proxys {
+		if p.ID == id {
+			np := *p
+			f(&np)
+			pm.proxys[i] = &np
+			return pm.saveProxy(&np)
+		}
 	}
-	return nil
+	return errGatewayNotFound
+}
+
+func (pm *proxyMgr) saveProxy(p *proxyGateway) error {
+	return store.Update(pm.db, func(b *leveldb.Batch) error {
+		return store.PutRecord(b, prefixProxy, p.ID, p)
+	})
 }
 
 type proxyGateway struct {
 	peer   socks5.PeerWithAuth `json:"-"`
+	ID     types.ID            `json:"id"`
 	Name   string              `json:"name"`
 	PeerID string              `json:"peer_id"`
 	Token  uint64              `json:"token"`
 	Route  string              `json:"route"`
 	Dns    string              `json:"dns"`
+	// DnsStream 网关支持DNS-over-stream，Dns为agent在TUN上提供DNS的地址
+	DnsStream bool `json:"dns_stream,omitempty"`
+	// Disabled 不参与TUN按网段分流，作为主网关时仍然使用
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+func (pg *proxyGateway) setPeer(pid peer.ID) {
+	tokenBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tokenBytes, pg.Token)
+	pg.peer = socks5.PeerWithAuth{
+		ID:       pid,
+		UserName: tokenBytes,
+		Password: tokenBytes,
+	}
 }
 
 type proxyDialer struct {
+	ag     *agent
 	dialer *socks5.Dialer
+	dial   socks5.DialFunc
+	dns    *dnsfwd.Forwarder
 }
 
 // func (pd *proxyDialer) proxyRoute(metadata *M.Metadata) peer.ID {
@@ -227,9 +370,10 @@ func (pd *proxyDialer) DialContext(ctx context.Context, metadata *M.Metadata) (n
 		return nil, errors.New("metadata is nil")
 	}
 	targetAddr := net.JoinHostPort(metadata.DstIP.String(), strconv.Itoa(int(metadata.DstPort)))
-	ret, err := pd.dialer.DialContext(ctx, metadata.Addr().Network(), targetAddr)
+	ret, err := pd.dial(ctx, metadata.Addr().Network(), targetAddr)
 	if err != nil {
 		logging.Error("proxy dialer dial context error: %v", err)
+		pd.ag.checkProxyNow()
 		return nil, err
 	}
 	return ret, nil
@@ -239,6 +383,35 @@ func (pd *proxyDialer) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
 	if metadata == nil {
 		return nil, errors.New("metadata is nil")
 	}
-	targetAddr := fmt.Sprintf("%s:%d", metadata.DstIP, metadata.DstPort)
-	return pd.dialer.DialUDPConn(metadata.Network.String(), targetAddr)
+	targetAddr := net.JoinHostPort(metadata.DstIP.String(), strconv.Itoa(int(metadata.DstPort)))
+	dr := pd.ag.domain.Load()
+	if pd.dns != nil && metadata.DstPort == 53 && metadata.DstIP == tunDNSAddr {
+		return dnsfwd.NewPacketConn(pd.tunDNSExchange(dr), &net.UDPAddr{}, metadata.UDPAddr()), nil
+	}
+	if dr == nil {
+		d := pd.dialer
+		if r := pd.ag.tunRoute(metadata.DstIP.Unmap()); r != nil {
+			d = r.Dialer
+		}
+		return d.DialUDPConn(metadata.Network.String(), targetAddr)
+	}
+	// DNS查询在本地按规则应答，其他查询按默认动作转发
+	if metadata.DstPort == 53 {
+		return dr.sr.NewDNSPacketConn(&net.UDPAddr{}, metadata.UDPAddr(), func() (net.PacketConn, error) {
+			if dr.defaultDirect {
+				c, err := dialDirect(context.Background(), "udp", targetAddr)
+				if err != nil {
+					return nil, err
+				}
+				return splitroute.NewFixedAddrPacketConn(c, metadata.UDPAddr()), nil
+			}
+			return pd.dialer.DialUDPConn("udp", targetAddr)
+		}), nil
+	}
+	c, err := pd.dial(context.Background(), "udp", targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	// 应答来源需要是原目标地址
+	return splitroute.NewFixedAddrPacketConn(c, metadata.UDPAddr()), nil
 }
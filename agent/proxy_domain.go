@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/socks5"
+	"github.com/isletnet/uptp/splitroute"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var (
+	keyProxyDomain = []byte("proxy_domain")
+)
+
+// ProxyDomainConf 域名分流配置，TUN内的DNS查询命中规则时返回假IP，
+// 规则的Target为代理网关的peer id，为空时使用当前代理网关；
+// DefaultAction为direct时没有命中规则的流量不经过网关
+type ProxyDomainConf struct {
+	Enable        bool             `json:"enable"`
+	FakeIPRange   string           `json:"fake_ip_range"`
+	DefaultAction string           `json:"default_action"`
+	Rules         splitroute.Rules `json:"rules"`
+}
+
+// domainRoute 运行中的域名分流
+type domainRoute struct {
+	sr            *splitroute.Router
+	defaultDirect bool
+}
+
+func (ag *agent) loadProxyDomainConf() (conf ProxyDomainConf, err error) {
+	v, err := ag.db.Get(keyProxyDomain, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(v, &conf)
+	return
+}
+
+// restoreProxyDomain agent启动时加载域名分流规则
+func (ag *agent) restoreProxyDomain() {
+	conf, err := ag.loadProxyDomainConf()
+	if err != nil {
+		logging.Error("load proxy domain config error: %s", err)
+		return
+	}
+	if !conf.Enable {
+		return
+	}
+	dr, err := newDomainRoute(&conf)
+	if err != nil {
+		logging.Error("start proxy domain route error: %s", err)
+		return
+	}
+	ag.domain.Store(dr)
+}
+
+func newDomainRoute(conf *ProxyDomainConf) (*domainRoute, error) {
+	switch conf.DefaultAction {
+	case "", splitroute.ActionProxy, splitroute.ActionDirect:
+	default:
+		return nil, fmt.Errorf("unknown default action %q", conf.DefaultAction)
+	}
+	sr, err := splitroute.NewRouter(conf.FakeIPRange, conf.Rules)
+	if err != nil {
+		return nil, err
+	}
+	return &domainRoute{
+		sr:            sr,
+		defaultDirect: conf.DefaultAction == splitroute.ActionDirect,
+	}, nil
+}
+
+func (ag *agent) setProxyDomain(conf *ProxyDomainConf) error {
+	if !ag.running {
+		return errors.New("agent not running")
+	}
+	var dr *domainRoute
+	if conf.Enable {
+		var err error
+		dr, err = newDomainRoute(conf)
+		if err != nil {
+			return err
+		}
+	}
+	buf, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	err = ag.db.Put(keyProxyDomain, buf, nil)
+	if err != nil {
+		return err
+	}
+	ag.domain.Store(dr)
+	return nil
+}
+
+func (ag *agent) getProxyDomain() *ProxyDomainConf {
+	if !ag.running {
+		return nil
+	}
+	conf, err := ag.loadProxyDomainConf()
+	if err != nil {
+		return nil
+	}
+	if conf.FakeIPRange == "" {
+		conf.FakeIPRange = splitroute.DefaultFakeIPRange
+	}
+	if conf.DefaultAction == "" {
+		conf.DefaultAction = splitroute.ActionProxy
+	}
+	return &conf
+}
+
+// gatewayDialer 按peer id找到已添加的代理网关
+func (ag *agent) gatewayDialer(peerID string) (*socks5.Dialer, error) {
+	for _, pg := range ag.proxyMgr.getProxys() {
+		if pg.PeerID == peerID {
+			return socks5.NewDialer(ag.p2p.Libp2pHost(), pg.peer.ID, pg.peer.UserName, pg.peer.Password), nil
+		}
+	}
+	return nil, fmt.Errorf("proxy gateway %s not found", peerID)
+}
+
+// dialDirect 不经过网关直接连接，TUN模式下需要把agent自身排除在VPN之外，
+// 否则直连的流量会再次进入TUN
+func dialDirect(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// dialDomain 按规则连接域名，def为当前代理网关的出站，规则已删除时按默认动作处理
+func (ag *agent) dialDomain(ctx context.Context, dr *domainRoute, def socks5.DialFunc, network, domain, port string, rule splitroute.Rule) (net.Conn, error) {
+	address := net.JoinHostPort(domain, port)
+	action := rule.Action
+	if action == "" {
+		action = splitroute.ActionProxy
+		if dr.defaultDirect {
+			action = splitroute.ActionDirect
+		}
+	}
+	switch action {
+	case splitroute.ActionReject:
+		return nil, splitroute.ErrRejected
+	case splitroute.ActionDirect:
+		return dialDirect(ctx, network, address)
+	}
+	if rule.Target != "" {
+		d, err := ag.gatewayDialer(rule.Target)
+		if err != nil {
+			return nil, err
+		}
+		return d.DialContext(ctx, network, address)
+	}
+	return def(ctx, network, address)
+}
+
+// splitDial 本地代理的出站，先按域名规则处理，没有命中时使用默认动作
+func (ag *agent) splitDial(def socks5.DialFunc) socks5.DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		dr := ag.domain.Load()
+		if dr == nil {
+			return def(ctx, network, address)
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		host = strings.Trim(host, "[]")
+		if ip, err := netip.ParseAddr(host); err == nil {
+			if dr.sr.IsFakeIP(ip) {
+				domain, rule, err := dr.sr.LookupFakeIP(ip)
+				if err != nil {
+					return nil, err
+				}
+				return ag.dialDomain(ctx, dr, def, network, domain, port, rule)
+			}
+		} else if rule, ok := dr.sr.MatchDomain(host); ok {
+			return ag.dialDomain(ctx, dr, def, network, host, port, rule)
+		}
+		if dr.defaultDirect {
+			return dialDirect(ctx, network, address)
+		}
+		return def(ctx, network, address)
+	}
+}
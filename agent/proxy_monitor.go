@@ -0,0 +1,283 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/types"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	proxyMonitorInterval = 15 * time.Second
+	proxyPingTimeout     = 5 * time.Second
+	proxyCheckMinGap     = 2 * time.Second
+	proxyFailThreshold   = 3
+)
+
+const (
+	ProxyStateConnecting = "connecting"
+	ProxyStateUp         = "up"
+	ProxyStateDown       = "down"
+)
+
+var (
+	keyProxyMonitor = []byte("proxy_monitor")
+)
+
+// ProxyMonitorConf Failover为true时当前网关不可用后切换到其他启用的网关
+type ProxyMonitorConf struct {
+	Failover bool `json:"failover"`
+}
+
+// ProxyState TUN代理当前网关的状态
+type ProxyState struct {
+	ID        types.ID `json:"id"`
+	PeerID    string   `json:"peer_id"`
+	Name      string   `json:"name"`
+	State     string   `json:"state"`
+	RttMs     int64    `json:"rtt_ms"`
+	Fails     int      `json:"fails"`
+	Err       string   `json:"err,omitempty"`
+	ChangedAt int64    `json:"changed_at"`
+}
+
+type proxyMonitor struct {
+	mtx   sync.Mutex
+	state ProxyState
+
+	kickCh chan struct{}
+	exitCh chan struct{}
+	once   sync.Once
+}
+
+func (ag *agent) loadProxyMonitorConf() (conf ProxyMonitorConf, err error) {
+	v, err := ag.db.Get(keyProxyMonitor, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(v, &conf)
+	return
+}
+
+// setProxyMonitor 保存配置，每次检查时读取，立即生效
+func (ag *agent) setProxyMonitor(conf *ProxyMonitorConf) error {
+	if !ag.running {
+		return errors.New("agent not running")
+	}
+	buf, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	return ag.db.Put(keyProxyMonitor, buf, nil)
+}
+
+func (ag *agent) getProxyMonitor() *ProxyMonitorConf {
+	if !ag.running {
+		return nil
+	}
+	conf, err := ag.loadProxyMonitorConf()
+	if err != nil {
+		return nil
+	}
+	return &conf
+}
+
+func (ag *agent) startProxyMonitor(pg *proxyGateway) {
+	ag.stopProxyMonitor()
+	pm := &proxyMonitor{
+		kickCh: make(chan struct{}, 1),
+		exitCh: make(chan struct{}),
+	}
+	ag.monMtx.Lock()
+	ag.monitor = pm
+	ag.monMtx.Unlock()
+	ag.reportProxyState(pm, ProxyState{ID: pg.ID, PeerID: pg.PeerID, Name: pg.Name, State: ProxyStateConnecting})
+	go ag.runProxyMonitor(pm)
+}
+
+func (ag *agent) stopProxyMonitor() {
+	ag.monMtx.Lock()
+	pm := ag.monitor
+	ag.monitor = nil
+	ag.monMtx.Unlock()
+	if pm != nil {
+		pm.once.Do(func() {
+			close(pm.exitCh)
+		})
+	}
+}
+
+// checkProxyNow 连接失败时尽快检查网关，不等待下一个周期
+func (ag *agent) checkProxyNow() {
+	ag.monMtx.Lock()
+	defer ag.monMtx.Unlock()
+	if ag.monitor == nil {
+		return
+	}
+	select {
+	case ag.monitor.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+func (ag *agent) getProxyState() *ProxyState {
+	ag.monMtx.Lock()
+	pm := ag.monitor
+	ag.monMtx.Unlock()
+	if pm == nil {
+		return nil
+	}
+	pm.mtx.Lock()
+	st := pm.state
+	pm.mtx.Unlock()
+	return &st
+}
+
+func (ag *agent) runProxyMonitor(pm *proxyMonitor) {
+	tk := time.NewTicker(proxyMonitorInterval)
+	defer tk.Stop()
+	var last time.Time
+	for {
+		if time.Since(last) >= proxyCheckMinGap {
+			last = time.Now()
+			ag.checkProxy(pm)
+		}
+		select {
+		case <-pm.exitCh:
+			return
+		case <-tk.C:
+		case <-pm.kickCh:
+		}
+	}
+}
+
+func (ag *agent) checkProxy(pm *proxyMonitor) {
+	pm.mtx.Lock()
+	st := pm.state
+	pm.mtx.Unlock()
+	pg := ag.proxyMgr.getProxyByPeerID(st.PeerID)
+	if pg == nil {
+		return
+	}
+	st.ID = pg.ID
+	st.Name = pg.Name
+	rtt, err := ag.pingGateway(pg.peer.ID)
+	if err == nil {
+		st.State = ProxyStateUp
+		st.RttMs = rtt.Milliseconds()
+		st.Fails = 0
+		st.Err = ""
+		ag.reportProxyState(pm, st)
+		ag.recheckTunGateways()
+		return
+	}
+	logging.Warn("ping proxy gateway %s error: %s", pg.peer.ID.ShortString(), err)
+	st.Fails++
+	st.Err = err.Error()
+	if st.Fails < proxyFailThreshold {
+		ag.reportProxyState(pm, st)
+		return
+	}
+	st.State = ProxyStateDown
+	ag.reportProxyState(pm, st)
+	if conf, err := ag.loadProxyMonitorConf(); err == nil && conf.Failover {
+		ag.failoverProxy(pm, pg.PeerID)
+	}
+}
+
+// failoverProxy 按列表顺序选择第一个可用的其他网关，不可用的网关从TUN路由中移除
+func (ag *agent) failoverProxy(pm *proxyMonitor, current string) {
+	ag.setTunGatewayDown(current, true)
+	for _, pg := range ag.proxyMgr.getProxys() {
+		if pg.PeerID == current || pg.Disabled {
+			continue
+		}
+		rtt, err := ag.pingGateway(pg.peer.ID)
+		if err != nil {
+			ag.setTunGatewayDown(pg.PeerID, true)
+			continue
+		}
+		ag.setTunGatewayDown(pg.PeerID, false)
+		ag.monMtx.Lock()
+		stopped := ag.monitor != pm
+		ag.monMtx.Unlock()
+		if stopped {
+			// TUN代理已经停止
+			return
+		}
+		logging.Info("proxy gateway %s down, failover to %s", current, pg.PeerID)
+		if err := ag.useTunGateway(&pg); err != nil {
+			continue
+		}
+		ag.reportProxyState(pm, ProxyState{
+			ID:     pg.ID,
+			PeerID: pg.PeerID,
+			Name:   pg.Name,
+			State:  ProxyStateUp,
+			RttMs:  rtt.Milliseconds(),
+		})
+		return
+	}
+}
+
+// recheckTunGateways 重新探测不可用的网关，恢复后重新加入TUN路由
+func (ag *agent) recheckTunGateways() {
+	for _, peerID := range ag.tunDownGateways() {
+		pg := ag.proxyMgr.getProxyByPeerID(peerID)
+		if pg == nil {
+			ag.setTunGatewayDown(peerID, false)
+			continue
+		}
+		if _, err := ag.pingGateway(pg.peer.ID); err == nil {
+			logging.Info("proxy gateway %s recovered", peerID)
+			ag.setTunGatewayDown(peerID, false)
+		}
+	}
+}
+
+// pingGateway 未连接时先通过DHT重新查找网关地址，网关地址变化后可以重新连上
+func (ag *agent) pingGateway(pid peer.ID) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyPingTimeout)
+	defer cancel()
+	h := ag.p2p.Libp2pHost()
+	if h.Network().Connectedness(pid) != network.Connected {
+		ai, err := ag.p2p.DHT().FindPeer(ctx, pid)
+		if err == nil {
+			h.Peerstore().AddAddrs(ai.ID, ai.Addrs, peerstore.TempAddrTTL)
+		}
+	}
+	res, ok := <-ping.Ping(ctx, h, pid)
+	if !ok {
+		return 0, ctx.Err()
+	}
+	return res.RTT, res.Error
+}
+
+// reportProxyState 保存状态，状态或网关变化时发送事件
+func (ag *agent) reportProxyState(pm *proxyMonitor, st ProxyState) {
+	pm.mtx.Lock()
+	changed := st.State != pm.state.State || st.PeerID != pm.state.PeerID
+	if changed {
+		st.ChangedAt = time.Now().Unix()
+	} else {
+		st.ChangedAt = pm.state.ChangedAt
+	}
+	pm.state = st
+	pm.mtx.Unlock()
+	if !changed {
+		return
+	}
+	ag.emit(EventProxyState, st)
+}
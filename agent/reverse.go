@@ -0,0 +1,305 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/isletnet/uptp/gateway"
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/store"
+	"github.com/isletnet/uptp/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// ReverseService agent本地的服务，通过网关暴露给网关所在的网络
+type ReverseService struct {
+	ID         types.ID `json:"id"`
+	Name       string   `json:"name"`
+	PeerID     string   `json:"peer_id"`
+	PeerName   string   `json:"peer_name"`
+	Token      types.ID `json:"token"` // 网关的反向映射Token
+	Network    string   `json:"network"`
+	LocalAddr  string   `json:"local_addr"`
+	LocalPort  int      `json:"local_port"`
+	RemoteIP   string   `json:"remote_ip"`
+	RemotePort int      `json:"remote_port"`
+	Running    bool     `json:"running"`
+	Err        string   `json:"err,omitempty"`
+}
+
+const (
+	reverseKeepaliveInterval = 30 * time.Second
+	reverseProtectTag        = "reverse"
+)
+
+type reverseMgr struct {
+	db       *leveldb.DB
+	mtx      sync.Mutex
+	services map[types.ID]*ReverseService
+	exitCh   chan struct{}
+}
+
+func (rm *reverseMgr) load() error {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.services = make(map[types.ID]*ReverseService)
+	return store.LoadRecords(rm.db, prefixReverse, func(id types.ID, rs *ReverseService) {
+		rm.services[id] = rs
+	})
+}
+
+func (rm *reverseMgr) get(id types.ID) *ReverseService {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rs, ok := rm.services[id]
+	if !ok {
+		return nil
+	}
+	ret := *rs
+	return &ret
+}
+
+func (rm *reverseMgr) list() []ReverseService {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	var ret []ReverseService
+	for _, rs := range rm.services {
+		ret = append(ret, *rs)
+	}
+	return ret
+}
+
+func (rm *reverseMgr) update(rs *ReverseService) error {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	s := *rs
+	rm.services[rs.ID] = &s
+	return store.Update(rm.db, func(b *leveldb.Batch) error {
+		return store.PutRecord(b, prefixReverse, s.ID, &s)
+	})
+}
+
+func (rm *reverseMgr) del(id types.ID) error {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	delete(rm.services, id)
+	return store.Update(rm.db, func(b *leveldb.Batch) error {
+		store.DeleteRecord(b, prefixReverse, id)
+		return nil
+	})
+}
+
+func (ag *agent) startReverse() error {
+	rm := &reverseMgr{
+		db:     ag.db,
+		exitCh: make(chan struct{}),
+	}
+	err := rm.load()
+	if err != nil {
+		return err
+	}
+	ag.rm.Store(rm)
+	for _, rs := range rm.list() {
+		if !rs.Running {
+			continue
+		}
+		err = ag.registerReverse(&rs)
+		if err != nil {
+			// 网关暂时不可达时保持运行状态，由保活重试
+			logging.Error("register reverse service %s error: %s", rs.Name, err)
+		}
+	}
+	go ag.reverseKeepalive(rm)
+	return nil
+}
+
+func (ag *agent) stopReverse() {
+	rm := ag.rm.Swap(nil)
+	if rm == nil {
+		return
+	}
+	close(rm.exitCh)
+}
+
+// reverseKeepalive 定期重新注册，保持到网关的连接，并在网关重启后恢复监听
+func (ag *agent) reverseKeepalive(rm *reverseMgr) {
+	tk := time.NewTicker(reverseKeepaliveInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-rm.exitCh:
+			return
+		case <-tk.C:
+		}
+		for _, rs := range rm.list() {
+			if !rs.Running {
+				continue
+			}
+			err := ag.registerReverse(&rs)
+			if err != nil {
+				logging.Warn("keepalive reverse service %s error: %s", rs.Name, err)
+			}
+		}
+	}
+}
+
+func (ag *agent) registerReverse(rs *ReverseService) error {
+	pid, err := peer.Decode(rs.PeerID)
+	if err != nil {
+		return err
+	}
+	rsp, err := gateway.ReverseRegister(ag.p2p.Libp2pHost(), rs.PeerID, gateway.ReverseReq{
+		Action:     gateway.ReverseActionRegister,
+		Token:      rs.Token,
+		ResID:      rs.ID,
+		Name:       rs.Name,
+		Network:    rs.Network,
+		ListenIP:   rs.RemoteIP,
+		ListenPort: rs.RemotePort,
+	})
+	if err != nil {
+		return err
+	}
+	if rsp.Err != "" {
+		return errors.New(rsp.Err)
+	}
+	rs.PeerName = rsp.NodeName
+	// 网关只能通过agent主动建立的连接回连
+	ag.p2p.Libp2pHost().ConnManager().Protect(pid, reverseProtectTag)
+	return nil
+}
+
+func (ag *agent) unregisterReverse(rs *ReverseService) error {
+	rsp, err := gateway.ReverseRegister(ag.p2p.Libp2pHost(), rs.PeerID, gateway.ReverseReq{
+		Action: gateway.ReverseActionUnregister,
+		Token:  rs.Token,
+		ResID:  rs.ID,
+	})
+	if pid, e := peer.Decode(rs.PeerID); e == nil {
+		ag.p2p.Libp2pHost().ConnManager().Unprotect(pid, reverseProtectTag)
+	}
+	if err != nil {
+		return err
+	}
+	if rsp.Err != "" {
+		return errors.New(rsp.Err)
+	}
+	return nil
+}
+
+func validateReverseService(rs *ReverseService) error {
+	if rs.Network != "tcp" && rs.Network != "udp" {
+		return errors.New("invalid network type, must be tcp or udp")
+	}
+	if rs.LocalAddr == "" {
+		rs.LocalAddr = "127.0.0.1"
+	}
+	if rs.LocalPort <= 0 || rs.LocalPort > 65535 {
+		return errors.New("invalid local port")
+	}
+	if rs.RemotePort <= 0 || rs.RemotePort > 65535 {
+		return errors.New("invalid remote port")
+	}
+	_, err := peer.Decode(rs.PeerID)
+	return err
+}
+
+func (ag *agent) addReverseService(rs *ReverseService) error {
+	rm := ag.rm.Load()
+	if !ag.running || rm == nil {
+		return errors.New("agent not running")
+	}
+	if err := validateReverseService(rs); err != nil {
+		return err
+	}
+	rs.ID = types.ID(rand.Uint64())
+	rs.Err = ""
+	if rs.Running {
+		err := ag.registerReverse(rs)
+		if err != nil {
+			rs.Running = false
+			rs.Err = err.Error()
+		}
+	}
+	return rm.update(rs)
+}
+
+func (ag *agent) updateReverseService(rs *ReverseService) error {
+	rm := ag.rm.Load()
+	if !ag.running || rm == nil {
+		return errors.New("agent not running")
+	}
+	exist := rm.get(rs.ID)
+	if exist == nil {
+		return errors.New("reverse service not exists")
+	}
+	if err := validateReverseService(rs); err != nil {
+		return err
+	}
+	if exist.Running && (!rs.Running || exist.PeerID != rs.PeerID) {
+		if err := ag.unregisterReverse(exist); err != nil {
+			logging.Warn("unregister reverse service %s error: %s", exist.Name, err)
+		}
+	}
+	rs.Err = ""
+	if rs.Running {
+		err := ag.registerReverse(rs)
+		if err != nil {
+			rs.Running = false
+			rs.Err = err.Error()
+		}
+	}
+	return rm.update(rs)
+}
+
+func (ag *agent) delReverseService(id types.ID) error {
+	rm := ag.rm.Load()
+	if !ag.running || rm == nil {
+		return errors.New("agent not running")
+	}
+	exist := rm.get(id)
+	if exist == nil {
+		return nil
+	}
+	if exist.Running {
+		if err := ag.unregisterReverse(exist); err != nil {
+			logging.Warn("unregister reverse service %s error: %s", exist.Name, err)
+		}
+	}
+	return rm.del(id)
+}
+
+func (ag *agent) getReverseServices() []ReverseService {
+	rm := ag.rm.Load()
+	if !ag.running || rm == nil {
+		return nil
+	}
+	return rm.list()
+}
+
+// handleReverseHandshake 处理网关转发回来的连接，只允许注册时的网关访问
+func (ag *agent) handleReverseHandshake(peerID string, handshake []byte) (network string, addr string, port int, err error) {
+	hs := gateway.PortmapAppHandshake{}
+	err = json.Unmarshal(handshake, &hs)
+	if err != nil {
+		return
+	}
+	rm := ag.rm.Load()
+	if rm == nil {
+		err = errors.New("reverse service not found")
+		return
+	}
+	rs := rm.get(hs.ResID)
+	if rs == nil || !rs.Running || rs.PeerID != peerID {
+		err = errors.New("reverse service not found")
+		return
+	}
+	network = rs.Network
+	addr = rs.LocalAddr
+	port = rs.LocalPort
+	return
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/isletnet/uptp/dnsfwd"
+	"github.com/isletnet/uptp/socks5"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// tunDNSAddr agent在TUN网段内提供DNS的地址，Android的VPN地址为10.8.0.2/24
+var tunDNSAddr = netip.MustParseAddr("10.8.0.1")
+
+const tunDNSTimeout = 5 * time.Second
+
+var (
+	keyTunDNS = []byte("tun_dns")
+)
+
+// TunDNSConf TUN内DNS的配置，查询经代理网关转发，Overrides的解析服务器由网关一侧访问
+type TunDNSConf struct {
+	Overrides []dnsfwd.Override `json:"overrides"`
+}
+
+func (ag *agent) loadTunDNSConf() (conf TunDNSConf, err error) {
+	v, err := ag.db.Get(keyTunDNS, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(v, &conf)
+	return
+}
+
+// setTunDNS 保存配置，下次启动TUN代理时生效
+func (ag *agent) setTunDNS(conf *TunDNSConf) error {
+	if !ag.running {
+		return errors.New("agent not running")
+	}
+	for i := range conf.Overrides {
+		if err := conf.Overrides[i].Validate(); err != nil {
+			return err
+		}
+	}
+	buf, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	return ag.db.Put(keyTunDNS, buf, nil)
+}
+
+func (ag *agent) getTunDNS() *TunDNSConf {
+	if !ag.running {
+		return nil
+	}
+	conf, err := ag.loadTunDNSConf()
+	if err != nil {
+		return nil
+	}
+	return &conf
+}
+
+func (ag *agent) newTunDNS(pg *proxyGateway) (*dnsfwd.Forwarder, error) {
+	conf, err := ag.loadTunDNSConf()
+	if err != nil {
+		return nil, err
+	}
+	h := ag.p2p.Libp2pHost()
+	return dnsfwd.NewForwarder(func(resolver string) dnsfwd.ExchangeFunc {
+		return dnsfwd.StreamExchange(h, pg.peer.ID, pg.Token, resolver)
+	}, conf.Overrides)
+}
+
+// newTunUDPDNS 网关不支持DNS-over-stream时，经网关的socks5 UDP转发到网关配置的DNS
+func (ag *agent) newTunUDPDNS(pg *proxyGateway, d *socks5.Dialer) (*dnsfwd.Forwarder, error) {
+	if pg.Dns == "" {
+		return nil, errors.New("proxy gateway has no dns")
+	}
+	conf, err := ag.loadTunDNSConf()
+	if err != nil {
+		return nil, err
+	}
+	return dnsfwd.NewForwarder(func(resolver string) dnsfwd.ExchangeFunc {
+		if resolver == "" {
+			resolver = pg.Dns
+		}
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		return socks5UDPExchange(d, resolver)
+	}, conf.Overrides)
+}
+
+func socks5UDPExchange(d *socks5.Dialer, resolver string) dnsfwd.ExchangeFunc {
+	return func(query []byte) ([]byte, error) {
+		c, err := d.DialUDPConn("udp", resolver)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(tunDNSTimeout))
+		if _, err := c.WriteTo(query, nil); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// tunDNSExchange 开启域名分流时命中规则的查询返回假IP
+func (pd *proxyDialer) tunDNSExchange(dr *domainRoute) dnsfwd.ExchangeFunc {
+	return func(query []byte) ([]byte, error) {
+		if dr != nil {
+			if rsp, ok := dr.sr.Answer(query); ok {
+				return rsp, nil
+			}
+		}
+		return pd.dns.Exchange(query)
+	}
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/proxyroute"
+	"github.com/isletnet/uptp/socks5"
+	"github.com/isletnet/uptp/types"
+)
+
+// routes 网关下发的路由，多个网段以逗号分隔
+func (pg *proxyGateway) routes() []netip.Prefix {
+	var nets []netip.Prefix
+	for _, r := range strings.Split(pg.Route, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		n, err := netip.ParsePrefix(r)
+		if err != nil {
+			logging.Warn("proxy gateway %s wrong route %q", pg.PeerID, r)
+			continue
+		}
+		n = n.Masked()
+		if !slices.Contains(nets, n) {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// rebuildTunRouter 按启用且可用的网关重建TUN路由表，相同网段由主网关处理，没有匹配的地址也走主网关
+func (ag *agent) rebuildTunRouter() {
+	ag.tunMtx.Lock()
+	defer ag.tunMtx.Unlock()
+	if ag.tunPrimary == "" {
+		return
+	}
+	h := ag.p2p.Libp2pHost()
+	r := proxyroute.NewRouter[string]()
+	var primary *proxyGateway
+	for _, pg := range ag.proxyMgr.getProxys() {
+		if pg.PeerID == ag.tunPrimary {
+			primary = &pg
+			continue
+		}
+		if pg.Disabled || ag.tunDown[pg.PeerID] {
+			continue
+		}
+		d := socks5.NewDialer(h, pg.peer.ID, pg.peer.UserName, pg.peer.Password)
+		for _, n := range pg.routes() {
+			r.AddRoute(n, pg.PeerID, d)
+		}
+	}
+	if primary != nil {
+		d := socks5.NewDialer(h, primary.peer.ID, primary.peer.UserName, primary.peer.Password)
+		for _, n := range primary.routes() {
+			r.AddRoute(n, primary.PeerID, d)
+		}
+		r.SetDefault(primary.PeerID, d)
+	}
+	ag.tunRouter.Store(r)
+}
+
+func (ag *agent) resetTunRouter(primary string) {
+	ag.tunMtx.Lock()
+	ag.tunPrimary = primary
+	if primary == "" {
+		ag.tunDown = nil
+		ag.tunDNSOn = false
+	}
+	ag.tunMtx.Unlock()
+	if primary == "" {
+		ag.tunRouter.Store(nil)
+		return
+	}
+	ag.rebuildTunRouter()
+}
+
+// setTunGatewayDown 标记网关是否可用，状态变化时重建TUN路由表
+func (ag *agent) setTunGatewayDown(peerID string, down bool) {
+	ag.tunMtx.Lock()
+	if ag.tunDown[peerID] == down {
+		ag.tunMtx.Unlock()
+		return
+	}
+	if down {
+		if ag.tunDown == nil {
+			ag.tunDown = make(map[string]bool)
+		}
+		ag.tunDown[peerID] = true
+	} else {
+		delete(ag.tunDown, peerID)
+	}
+	ag.tunMtx.Unlock()
+	ag.rebuildTunRouter()
+}
+
+// tunDownGateways 返回被标记为不可用的网关
+func (ag *agent) tunDownGateways() []string {
+	ag.tunMtx.Lock()
+	defer ag.tunMtx.Unlock()
+	ret := make([]string, 0, len(ag.tunDown))
+	for id := range ag.tunDown {
+		ret = append(ret, id)
+	}
+	return ret
+}
+
+// tunRoute 按目标地址查找网关
+func (ag *agent) tunRoute(ip netip.Addr) *proxyroute.Entry[string] {
+	r := ag.tunRouter.Load()
+	if r == nil {
+		return nil
+	}
+	return r.Lookup(ip)
+}
+
+// dialByRoute TUN内目标为IP时按最长前缀选择网关。
+// 目标为域名时(域名分流的假IP还原成域名后转发)本地无法判断解析结果属于哪个网段，
+// 始终由主网关解析和连接，不按其他网关下发的路由分流
+func (pd *proxyDialer) dialByRoute(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return pd.dialer.DialContext(ctx, network, address)
+	}
+	r := pd.ag.tunRoute(ip.Unmap())
+	if r == nil {
+		return nil, errors.New("no route found")
+	}
+	c, err := r.Dialer.DialContext(ctx, network, address)
+	r.Record(err)
+	return c, err
+}
+
+func (ag *agent) setProxyGatewayEnabled(id types.ID, enable bool) error {
+	err := ag.proxyMgr.updateProxy(id, func(p *proxyGateway) {
+		p.Disabled = !enable
+	})
+	if err != nil {
+		return err
+	}
+	ag.rebuildTunRouter()
+	return nil
+}
+
+// tunRoutes 启用的网关和主网关的路由合集，供VPN设置路由
+func (ag *agent) tunRoutes(primary types.ID) []string {
+	var routes []string
+	for _, pg := range ag.proxyMgr.getProxys() {
+		if pg.Disabled && pg.ID != primary {
+			continue
+		}
+		for _, n := range pg.routes() {
+			if !slices.Contains(routes, n.String()) {
+				routes = append(routes, n.String())
+			}
+		}
+	}
+	// 域名分流返回的假IP也需要进入TUN，Android的VpnService按这里的路由建立
+	if dr := ag.domain.Load(); dr != nil {
+		if fake := dr.sr.FakeRange().String(); !slices.Contains(routes, fake) {
+			routes = append(routes, fake)
+		}
+	}
+	return routes
+}
+
+func (ag *agent) listTunRoutes() []proxyroute.RouteInfo[string] {
+	r := ag.tunRouter.Load()
+	if r == nil {
+		return nil
+	}
+	return r.List()
+}
@@ -1,11 +1,13 @@
 package com.isletnet.uptpproxy
 
 import agent.Agent
+import agent.EventListener
 import android.Manifest
 import android.content.pm.ApplicationInfo
 import android.widget.EditText
 import androidx.appcompat.app.AlertDialog
 import org.json.JSONArray
+import org.json.JSONObject
 import androidx.recyclerview.widget.RecyclerView
 import androidx.recyclerview.widget.LinearLayoutManager
 import android.text.Editable
@@ -35,7 +37,7 @@ import android.widget.AdapterView
 import androidx.core.content.edit
 
 class MainActivity : AppCompatActivity() {
-    data class GatewayInfo(val name: String, val route: String, val dns: String)
+    data class GatewayInfo(val id: String, val name: String, val route: String, val dns: String)
     private lateinit var selectedGateway: GatewayInfo
     private lateinit var gatewayList: MutableList<GatewayInfo>
     private lateinit var deleteButton: Button
@@ -91,7 +93,7 @@ class MainActivity : AppCompatActivity() {
             .setPositiveButton("删除") { _, _ ->
                 try {
                     // 调用Agent接口删除网关
-                    Agent.delProxyGateway(position.toLong())
+                    Agent.delProxyGateway(gatewayList[position].id)
 
                     // 从列表中移除
                     gatewayList.removeAt(position)
@@ -232,6 +234,22 @@ class MainActivity : AppCompatActivity() {
             }
         }
     }
+    // 网关状态和授权失败显示在状态栏，其他事件只记录日志
+    private val agentListener = object : EventListener {
+        override fun onEvent(kind: String, data: String) {
+            Log.d("MainActivity", "agent event $kind: $data")
+            when (kind) {
+                Agent.EventProxyState -> {
+                    val st = JSONObject(data)
+                    runOnUiThread {
+                        statusText.text = "${st.optString("name")}: ${st.optString("state")}"
+                    }
+                }
+                Agent.EventAuthFailed -> showError("网关授权失败: ${JSONObject(data).optString("err")}")
+            }
+        }
+    }
+
     override fun onCreate(savedInstanceState: Bundle?) {
         super.onCreate(savedInstanceState)
         lastSelectedGatewayPosition = getSharedPreferences("vpn_prefs", Context.MODE_PRIVATE)
@@ -306,6 +324,7 @@ class MainActivity : AppCompatActivity() {
                 showError("网络不可用，请检查网络连接")
                 return
             }
+            Agent.setEventListener(agentListener)
             Agent.start(filesDir.absolutePath,false)
             Log.d("MainActivity", "Agent started successfully")
         } catch (e: Exception) {
@@ -320,6 +339,7 @@ class MainActivity : AppCompatActivity() {
             for (i in 0 until jsonArray.length()) {
                 val item = jsonArray.getJSONObject(i)
                 gatewayList.add(GatewayInfo(
+                    item.getString("id"),
                     item.getString("name"),
                     item.getString("route"),
                     item.getString("dns")
@@ -385,14 +405,14 @@ class MainActivity : AppCompatActivity() {
         }
         try {
             startAgent()
-            Agent.pingProxyGateway(gatewaySpinner.selectedItemPosition.toLong())
+            Agent.pingProxyGateway(selectedGateway.id)
             val intent = VpnService.prepare(this)
             if (intent != null) {
                 startActivityForResult(intent, 100)
             } else {
                 startService(Intent(this, MyVpnService::class.java).apply {
-                    putExtra("selected_gateway_index", gatewaySpinner.selectedItemPosition)
-                    putExtra("route", selectedGateway.route)
+                    putExtra("selected_gateway_id", selectedGateway.id)
+                    putExtra("route", tunRoutes(selectedGateway.route))
                     putExtra("dns", selectedGateway.dns)
                 })
             }
@@ -401,12 +421,22 @@ class MainActivity : AppCompatActivity() {
         }
     }
     
+    // 启用的网关的网段合集，取不到时使用所选网关的路由
+    private fun tunRoutes(fallback: String): String {
+        val json = Agent.getTunRoutesJson(selectedGateway.id)
+        if (json.isEmpty()) {
+            return fallback
+        }
+        val arr = JSONArray(json)
+        return (0 until arr.length()).joinToString(",") { arr.getString(it) }
+    }
+
     override fun onActivityResult(request: Int, result: Int, data: Intent?) {
         super.onActivityResult(request, result, data)
         if (request == 100 && result == RESULT_OK) {
             startService(Intent(this, MyVpnService::class.java).apply {
-                putExtra("selected_gateway_index", gatewaySpinner.selectedItemPosition)
-                putExtra("route", selectedGateway.route)
+                putExtra("selected_gateway_id", selectedGateway.id)
+                putExtra("route", tunRoutes(selectedGateway.route))
                 putExtra("dns", selectedGateway.dns)
             })
         }
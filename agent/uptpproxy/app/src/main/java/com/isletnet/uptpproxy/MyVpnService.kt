@@ -36,7 +36,7 @@ class MyVpnService : VpnService() {
             return START_NOT_STICKY;
             }
         startTProxy(
-            intent?.getIntExtra("selected_gateway_index", 0) ?: 0,
+            intent?.getStringExtra("selected_gateway_id") ?: "",
             intent?.getStringExtra("route") ?: "0.0.0.0/0",
             intent?.getStringExtra("dns") ?: "223.5.5.5,223.6.6.6"
         ); // 启动 VPN 连接
@@ -49,16 +49,18 @@ class MyVpnService : VpnService() {
         stopTProxy()
     }
 
-    private fun startTProxy(idx: Int, route: String, dns: String) {
+    private fun startTProxy(gatewayId: String, route: String, dns: String) {
         val builder = Builder().apply {
             setSession("UptpProxy VPN")
             addAddress("10.8.0.2", 24)
             
-            // 解析并添加路由
-            val routeParts = route.split("/")
-            val routeIp = routeParts[0]
-            val routePrefix = routeParts.getOrElse(1) { "0" }.toInt()
-            addRoute(routeIp, routePrefix)
+            // 解析并添加路由，多个网关的网段以逗号分隔
+            route.split(",").map { it.trim() }.filter { it.isNotEmpty() }.forEach { r ->
+                val routeParts = r.split("/")
+                val routeIp = routeParts[0]
+                val routePrefix = routeParts.getOrElse(1) { "0" }.toInt()
+                addRoute(routeIp, routePrefix)
+            }
             
             // 解析并添加DNS服务器
             dns.split(",").forEach { dnsServer ->
@@ -92,7 +94,7 @@ class MyVpnService : VpnService() {
             vpnInterface = builder.establish()
             Log.d("VpnService", "VPN interface established, fd=${vpnInterface?.fd}")
 
-            Agent.startTunProxy("fd://"+vpnInterface?.fd, idx.toLong())
+            Agent.startTunProxy("fd://"+vpnInterface?.fd, gatewayId)
             Log.d("VpnService", "Tun proxy started")
             
             isRunning = true
@@ -0,0 +1,195 @@
+// Package daemon 以系统服务方式运行，守护进程启动并监控工作进程，工作进程退出后重新启动
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isletnet/service"
+	"github.com/isletnet/uptp/logging"
+)
+
+const crashLogKeep = 3
+
+// Options Name为服务名，Signals为需要转发给工作进程的信号，
+// OnWorkerError在工作进程无法启动时调用，之后不再重启工作进程
+type Options struct {
+	Name          string
+	Signals       []os.Signal
+	OnWorkerError func()
+}
+
+// Control 执行服务的install、uninstall、start、stop、restart
+func Control(name, ctrlComm, exeAbsPath string, args []string) error {
+	svcConfig := &service.Config{
+		Name:        name,
+		DisplayName: name,
+		Description: name,
+		Executable:  exeAbsPath,
+		Arguments:   args,
+	}
+	s, err := service.New(nil, svcConfig)
+	if err != nil {
+		return err
+	}
+	return service.Control(s, ctrlComm)
+}
+
+// Run 运行守护进程，工作进程使用去掉-d的命令行参数
+func Run(opt Options) error {
+	binPath, _ := os.Executable()
+	svcConfig := &service.Config{
+		Name:        opt.Name,
+		DisplayName: opt.Name,
+		Description: opt.Name,
+		Executable:  binPath,
+	}
+	d := &daemon{
+		opt:     opt,
+		binPath: binPath,
+		args:    workerArgs(os.Args),
+	}
+	logging.Debug("worker start params %v", d.args)
+	s, err := service.New(d, svcConfig)
+	if err != nil {
+		return err
+	}
+	return s.Run()
+}
+
+// workerArgs 返回去掉第一个-d的参数副本，不修改原参数
+func workerArgs(args []string) []string {
+	ret := make([]string, 0, len(args))
+	removed := false
+	for _, arg := range args {
+		if arg == "-d" && !removed {
+			removed = true
+			continue
+		}
+		ret = append(ret, arg)
+	}
+	return ret
+}
+
+type daemon struct {
+	opt     Options
+	binPath string
+	args    []string
+	stopped atomic.Bool
+
+	mtx  sync.Mutex
+	proc *os.Process
+}
+
+func (d *daemon) Start(s service.Service) error {
+	logging.Info("service start")
+	go d.run()
+	if len(d.opt.Signals) > 0 {
+		go d.forwardSignals()
+	}
+	return nil
+}
+
+func (d *daemon) Stop(s service.Service) error {
+	logging.Info("service stop")
+	d.stopped.Store(true)
+
+	d.mtx.Lock()
+	if d.proc != nil {
+		logging.Info("kill worker")
+		d.proc.Kill()
+	}
+	d.mtx.Unlock()
+	logging.Info("worker stopped")
+
+	if service.Interactive() {
+		logging.Info("stop daemon")
+		os.Exit(0)
+	}
+	return nil
+}
+
+// forwardSignals 把Signals转发给工作进程
+func (d *daemon) forwardSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, d.opt.Signals...)
+	for sig := range ch {
+		d.mtx.Lock()
+		if d.proc != nil {
+			logging.Info("forward %s to worker", sig)
+			d.proc.Signal(sig)
+		}
+		d.mtx.Unlock()
+	}
+}
+
+func (d *daemon) run() {
+	for !d.stopped.Load() {
+		logging.Info("start worker")
+		err := d.startWorker()
+		if err != nil {
+			logging.Error("start worker error: %s", err)
+			if d.opt.OnWorkerError != nil {
+				d.opt.OnWorkerError()
+			}
+			return
+		}
+		logging.Info("worker stopped")
+		time.Sleep(time.Second)
+	}
+}
+
+// rotateCrashLog 保留最近几次工作进程的输出，stderr.log.0为上一次
+func rotateCrashLog(crashLog string) {
+	s, _ := os.Stat(crashLog)
+	if s == nil || s.Size() == 0 {
+		return
+	}
+	for i := crashLogKeep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", crashLog, i-1), fmt.Sprintf("%s.%d", crashLog, i))
+	}
+	os.Rename(crashLog, crashLog+".0")
+}
+
+// startWorker 工作进程的stderr写入log/stderr.log，崩溃时的堆栈在这里
+func (d *daemon) startWorker() error {
+	if err := os.MkdirAll("log", 0775); err != nil {
+		return err
+	}
+	crashLog := filepath.Join("log", "stderr.log")
+	rotateCrashLog(crashLog)
+	f, err := os.Create(crashLog)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	execSpec := &os.ProcAttr{
+		Env:   append(os.Environ(), "GOTRACEBACK=crash"),
+		Files: []*os.File{os.Stdin, os.Stdout, f},
+	}
+
+	d.mtx.Lock()
+	// Stop之后不再启动新的工作进程
+	if d.stopped.Load() {
+		d.mtx.Unlock()
+		return nil
+	}
+	p, err := os.StartProcess(d.binPath, d.args, execSpec)
+	if err != nil {
+		d.mtx.Unlock()
+		return err
+	}
+	d.proc = p
+	d.mtx.Unlock()
+	p.Wait()
+
+	d.mtx.Lock()
+	d.proc = nil
+	d.mtx.Unlock()
+	return nil
+}
@@ -0,0 +1,361 @@
+package dnsfwd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isletnet/uptp/logging"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	cacheSize      = 4096
+	maxCacheTTL    = time.Hour
+	negativeTTL    = 30 * time.Second
+	udpPacketLimit = 4096
+)
+
+var errForwarderClosed = errors.New("dns forwarder closed")
+
+// Override 按域名后缀指定解析服务器，Resolver由网关一侧访问，可以是网关内网的DNS
+type Override struct {
+	Suffix   string `json:"suffix"`
+	Resolver string `json:"resolver"`
+}
+
+func (o *Override) Validate() error {
+	if normalize(o.Suffix) == "" {
+		return errors.New("override suffix is empty")
+	}
+	if o.Resolver == "" {
+		return errors.New("override resolver is empty")
+	}
+	return nil
+}
+
+func (o *Override) match(name string) bool {
+	s := strings.TrimPrefix(normalize(o.Suffix), ".")
+	return name == s || strings.HasSuffix(name, "."+s)
+}
+
+type cacheEntry struct {
+	rsp    []byte
+	stored time.Time
+	expire time.Time
+}
+
+// Forwarder 带缓存的DNS转发，upstream按解析服务器地址返回查询方法，空地址表示默认解析服务器
+type Forwarder struct {
+	upstream  func(resolver string) ExchangeFunc
+	overrides []Override
+
+	mtx    sync.Mutex
+	cache  map[string]cacheEntry
+	closed bool
+}
+
+func NewForwarder(upstream func(resolver string) ExchangeFunc, overrides []Override) (*Forwarder, error) {
+	for i := range overrides {
+		if err := overrides[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &Forwarder{
+		upstream:  upstream,
+		overrides: overrides,
+		cache:     make(map[string]cacheEntry),
+	}, nil
+}
+
+// Close 清空缓存，关闭后的查询返回错误
+func (f *Forwarder) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.closed = true
+	f.cache = make(map[string]cacheEntry)
+	return nil
+}
+
+// Exchange 优先使用缓存，缓存的应答会替换为本次查询的ID，TTL减去已缓存的时间
+func (f *Forwarder) Exchange(query []byte) ([]byte, error) {
+	f.mtx.Lock()
+	closed := f.closed
+	f.mtx.Unlock()
+	if closed {
+		return nil, errForwarderClosed
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := normalize(q.Name.String())
+	key := cacheKey(name, q.Type, q.Class)
+	if rsp := f.getCache(key, h.ID); rsp != nil {
+		return rsp, nil
+	}
+	resolver := ""
+	for i := range f.overrides {
+		if f.overrides[i].match(name) {
+			resolver = f.overrides[i].Resolver
+			break
+		}
+	}
+	rsp, err := f.upstream(resolver)(query)
+	if err != nil {
+		return nil, err
+	}
+	f.putCache(key, rsp)
+	return rsp, nil
+}
+
+func cacheKey(name string, t dnsmessage.Type, c dnsmessage.Class) string {
+	return name + "/" + t.String() + "/" + c.String()
+}
+
+func (f *Forwarder) getCache(key string, id uint16) []byte {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	e, ok := f.cache[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(e.expire) {
+		delete(f.cache, key)
+		return nil
+	}
+	rsp, err := agedResponse(e.rsp, id, uint32(now.Sub(e.stored)/time.Second))
+	if err != nil {
+		delete(f.cache, key)
+		return nil
+	}
+	return rsp
+}
+
+// agedResponse 替换应答的ID，所有记录的TTL减去elapsed秒，OPT记录的TTL字段不是时间，保持不变
+func agedResponse(rsp []byte, id uint16, elapsed uint32) ([]byte, error) {
+	if elapsed == 0 {
+		ret := append([]byte(nil), rsp...)
+		ret[0] = byte(id >> 8)
+		ret[1] = byte(id)
+		return ret, nil
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(rsp); err != nil {
+		return nil, err
+	}
+	m.Header.ID = id
+	for _, section := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			h := &section[i].Header
+			if h.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if h.TTL > elapsed {
+				h.TTL -= elapsed
+			} else {
+				h.TTL = 0
+			}
+		}
+	}
+	return m.Pack()
+}
+
+func (f *Forwarder) putCache(key string, rsp []byte) {
+	ttl := responseTTL(rsp)
+	if ttl <= 0 {
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.closed {
+		return
+	}
+	if len(f.cache) >= cacheSize {
+		f.evict()
+	}
+	now := time.Now()
+	f.cache[key] = cacheEntry{
+		rsp:    append([]byte(nil), rsp...),
+		stored: now,
+		expire: now.Add(ttl),
+	}
+}
+
+// evict 先清理过期的缓存，仍然太多时全部清空
+func (f *Forwarder) evict() {
+	now := time.Now()
+	for k, e := range f.cache {
+		if now.After(e.expire) {
+			delete(f.cache, k)
+		}
+	}
+	if len(f.cache) >= cacheSize {
+		f.cache = make(map[string]cacheEntry)
+	}
+}
+
+// responseTTL 取应答记录中最小的TTL，NXDOMAIN和空应答缓存较短时间，其他错误不缓存
+func responseTTL(rsp []byte) time.Duration {
+	var p dnsmessage.Parser
+	h, err := p.Start(rsp)
+	if err != nil || h.Truncated {
+		return 0
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return negativeTTL
+	default:
+		return 0
+	}
+	ttl := maxCacheTTL
+	n := 0
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return 0
+		}
+		n++
+		if d := time.Duration(rh.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return 0
+		}
+	}
+	if n == 0 {
+		return negativeTTL
+	}
+	return ttl
+}
+
+// Serve 在pc上提供DNS服务，pc关闭后返回
+func (f *Forwarder) Serve(pc net.PacketConn, exchange ExchangeFunc) error {
+	for {
+		buf := make([]byte, udpPacketLimit)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			rsp, err := exchange(buf[:n])
+			if err != nil {
+				logging.Debug("[dnsfwd] query from %s error: %s", addr, err)
+				return
+			}
+			pc.WriteTo(rsp, addr)
+		}()
+	}
+}
+
+func normalize(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
+
+// packetConn TUN内到DNS地址的UDP流，每个查询单独处理，应答以raddr为来源
+type packetConn struct {
+	exchange ExchangeFunc
+	laddr    net.Addr
+	raddr    net.Addr
+
+	mtx      sync.Mutex
+	deadline time.Time
+
+	rspCh   chan []byte
+	closeCh chan struct{}
+	once    sync.Once
+}
+
+func NewPacketConn(exchange ExchangeFunc, laddr, raddr net.Addr) net.PacketConn {
+	return &packetConn{
+		exchange: exchange,
+		laddr:    laddr,
+		raddr:    raddr,
+		rspCh:    make(chan []byte, 16),
+		closeCh:  make(chan struct{}),
+	}
+}
+
+func (c *packetConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	select {
+	case <-c.closeCh:
+		return 0, net.ErrClosed
+	default:
+	}
+	query := append([]byte(nil), p...)
+	go func() {
+		rsp, err := c.exchange(query)
+		if err != nil {
+			logging.Debug("[dnsfwd] tun query error: %s", err)
+			return
+		}
+		select {
+		case c.rspCh <- rsp:
+		case <-c.closeCh:
+		default:
+		}
+	}()
+	return len(p), nil
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mtx.Lock()
+	deadline := c.deadline
+	c.mtx.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case rsp := <-c.rspCh:
+		return copy(p, rsp), c.raddr, nil
+	case <-c.closeCh:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *packetConn) Close() error {
+	c.once.Do(func() {
+		close(c.closeCh)
+	})
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.mtx.Lock()
+	c.deadline = t
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
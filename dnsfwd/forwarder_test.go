@@ -0,0 +1,243 @@
+package dnsfwd
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// buildAnswer 按查询构造应答，ttl为0时返回NXDOMAIN
+func buildAnswer(t *testing.T, query []byte, ttl uint32) []byte {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err != nil {
+		t.Fatal(err)
+	}
+	m.Header.Response = true
+	if ttl == 0 {
+		m.Header.RCode = dnsmessage.RCodeNameError
+	} else {
+		m.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  m.Questions[0].Name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   ttl,
+			},
+			Body: &dnsmessage.AResource{A: netip.MustParseAddr("1.2.3.4").As4()},
+		}}
+	}
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func unpack(t *testing.T, rsp []byte) dnsmessage.Message {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(rsp); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestForwarderCacheAndOverride(t *testing.T) {
+	calls := map[string]int{}
+	upstream := func(resolver string) ExchangeFunc {
+		return func(query []byte) ([]byte, error) {
+			calls[resolver]++
+			return buildAnswer(t, query, 300), nil
+		}
+	}
+	f, err := NewForwarder(upstream, []Override{{Suffix: "corp.example", Resolver: "10.0.0.53"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Exchange(buildQuery(t, 1, "www.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := f.Exchange(buildQuery(t, 2, "WWW.example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := unpack(t, rsp); m.Header.ID != 2 {
+		t.Errorf("cached response id = %d, want 2", m.Header.ID)
+	}
+	if calls[""] != 1 {
+		t.Errorf("default resolver calls = %d, want 1", calls[""])
+	}
+
+	if _, err := f.Exchange(buildQuery(t, 3, "git.corp.example.")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Exchange(buildQuery(t, 4, "notcorp.example.")); err != nil {
+		t.Fatal(err)
+	}
+	if calls["10.0.0.53"] != 1 || calls[""] != 2 {
+		t.Errorf("resolver calls = %v", calls)
+	}
+
+	if _, err := NewForwarder(upstream, []Override{{Suffix: ".", Resolver: "10.0.0.53"}}); err == nil {
+		t.Error("empty override suffix accepted")
+	}
+}
+
+func TestAgedResponse(t *testing.T) {
+	rsp := buildAnswer(t, buildQuery(t, 1, "a.example."), 300)
+
+	aged, err := agedResponse(rsp, 7, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(aged[2:], rsp[2:]) {
+		t.Error("zero elapsed changed response body")
+	}
+
+	aged, err = agedResponse(rsp, 7, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := unpack(t, aged)
+	if m.Header.ID != 7 || m.Answers[0].Header.TTL != 200 {
+		t.Errorf("id = %d ttl = %d, want 7 200", m.Header.ID, m.Answers[0].Header.TTL)
+	}
+
+	aged, err = agedResponse(rsp, 7, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := unpack(t, aged); m.Answers[0].Header.TTL != 0 {
+		t.Errorf("ttl = %d, want 0", m.Answers[0].Header.TTL)
+	}
+}
+
+func TestForwarderCacheAging(t *testing.T) {
+	upstream := func(string) ExchangeFunc {
+		return func(query []byte) ([]byte, error) {
+			return buildAnswer(t, query, 300), nil
+		}
+	}
+	f, err := NewForwarder(upstream, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Exchange(buildQuery(t, 1, "a.example.")); err != nil {
+		t.Fatal(err)
+	}
+	key := cacheKey("a.example", dnsmessage.TypeA, dnsmessage.ClassINET)
+	e := f.cache[key]
+	e.stored = e.stored.Add(-120 * time.Second)
+	f.cache[key] = e
+
+	rsp, err := f.Exchange(buildQuery(t, 2, "a.example."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := unpack(t, rsp).Answers[0].Header.TTL; ttl < 179 || ttl > 180 {
+		t.Errorf("aged ttl = %d, want 180", ttl)
+	}
+}
+
+func TestResponseTTL(t *testing.T) {
+	q := buildQuery(t, 1, "a.example.")
+	if ttl := responseTTL(buildAnswer(t, q, 60)); ttl != time.Minute {
+		t.Errorf("answer ttl = %s", ttl)
+	}
+	if ttl := responseTTL(buildAnswer(t, q, 0)); ttl != negativeTTL {
+		t.Errorf("nxdomain ttl = %s", ttl)
+	}
+	if ttl := responseTTL(buildAnswer(t, q, 2*60*60)); ttl != maxCacheTTL {
+		t.Errorf("long ttl = %s", ttl)
+	}
+	m := unpack(t, buildAnswer(t, q, 60))
+	m.Header.RCode = dnsmessage.RCodeServerFailure
+	m.Answers = nil
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := responseTTL(buf); ttl != 0 {
+		t.Errorf("servfail ttl = %s", ttl)
+	}
+}
+
+func TestResolverAllowed(t *testing.T) {
+	allow := []string{"8.8.8.8", "10.0.0.53:5353"}
+	tests := []struct {
+		resolver string
+		want     bool
+	}{
+		{"8.8.8.8", true},
+		{"8.8.8.8:53", true},
+		{"10.0.0.53:5353", true},
+		{"10.0.0.53", false},
+		{"1.1.1.1", false},
+	}
+	for _, tt := range tests {
+		if got := resolverAllowed(tt.resolver, allow); got != tt.want {
+			t.Errorf("resolverAllowed(%q) = %v, want %v", tt.resolver, got, tt.want)
+		}
+	}
+}
+
+func TestMsgRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	q := buildQuery(t, 1, "a.example.")
+	if err := writeMsg(&buf, q); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readMsg(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, q) {
+		t.Error("round trip mismatch")
+	}
+	if err := writeMsg(&buf, make([]byte, maxDNSPacketLen+1)); err == nil {
+		t.Error("oversized message accepted")
+	}
+}
+
+func TestForwarderClose(t *testing.T) {
+	f, err := NewForwarder(func(string) ExchangeFunc {
+		return func(query []byte) ([]byte, error) {
+			return buildAnswer(t, query, 300), nil
+		}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Exchange(buildQuery(t, 1, "a.example.")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := f.Exchange(buildQuery(t, 2, "a.example.")); err != errForwarderClosed {
+		t.Errorf("exchange after close error = %v", err)
+	}
+	if len(f.cache) != 0 {
+		t.Errorf("cache not cleared: %d", len(f.cache))
+	}
+}
@@ -0,0 +1,160 @@
+package dnsfwd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ProtocolID DNS-over-stream，客户端先发送8字节token(小端)和1字节长度的解析服务器地址，
+// 之后按DNS over TCP的格式发送一个查询，网关返回同样格式的应答
+const ProtocolID = "/uptp/dns/1.0.0"
+
+const (
+	streamTimeout   = 10 * time.Second
+	maxDNSPacketLen = 65535
+)
+
+var errAuthFailed = errors.New("dns stream auth failed")
+
+// ExchangeFunc 发送DNS查询并返回应答
+type ExchangeFunc func(query []byte) ([]byte, error)
+
+// UDPExchange 通过UDP向resolver(ip:port)查询
+func UDPExchange(resolver string) ExchangeFunc {
+	return func(query []byte) ([]byte, error) {
+		c, err := net.DialTimeout("udp", resolver, streamTimeout)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(streamTimeout / 2))
+		if _, err := c.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, maxDNSPacketLen)
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// StreamExchange 通过网关查询，resolver为空时使用网关配置的解析服务器
+func StreamExchange(h host.Host, pid peer.ID, token uint64, resolver string) ExchangeFunc {
+	return func(query []byte) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), streamTimeout)
+		defer cancel()
+		s, err := h.NewStream(ctx, pid, ProtocolID)
+		if err != nil {
+			return nil, err
+		}
+		defer s.Close()
+		s.SetDeadline(time.Now().Add(streamTimeout))
+		if len(resolver) > 255 {
+			s.Reset()
+			return nil, errors.New("resolver address too long")
+		}
+		hdr := make([]byte, 9, 9+len(resolver))
+		binary.LittleEndian.PutUint64(hdr, token)
+		hdr[8] = byte(len(resolver))
+		hdr = append(hdr, resolver...)
+		if _, err := s.Write(hdr); err != nil {
+			s.Reset()
+			return nil, err
+		}
+		if err := writeMsg(s, query); err != nil {
+			s.Reset()
+			return nil, err
+		}
+		return readMsg(s)
+	}
+}
+
+// ServeStream 处理DNS-over-stream请求，auth校验token，
+// defResolver返回客户端未指定解析服务器时使用的地址，客户端指定的解析服务器需要在allow中
+func ServeStream(s network.Stream, auth func(token uint64) bool, defResolver func() string, allow func() []string) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(streamTimeout))
+	hdr := make([]byte, 9)
+	if _, err := io.ReadFull(s, hdr); err != nil {
+		return
+	}
+	if !auth(binary.LittleEndian.Uint64(hdr)) {
+		logging.Warn("[dnsfwd] %s: %s", s.Conn().RemotePeer(), errAuthFailed)
+		s.Reset()
+		return
+	}
+	resolver := make([]byte, hdr[8])
+	if _, err := io.ReadFull(s, resolver); err != nil {
+		return
+	}
+	query, err := readMsg(s)
+	if err != nil {
+		return
+	}
+	r := string(resolver)
+	if r == "" {
+		r = defResolver()
+	} else if !resolverAllowed(r, allow()) {
+		logging.Warn("[dnsfwd] %s: resolver %s not allowed", s.Conn().RemotePeer(), r)
+		s.Reset()
+		return
+	}
+	rsp, err := UDPExchange(withPort(r))(query)
+	if err != nil {
+		logging.Debug("[dnsfwd] exchange with %s error: %s", r, err)
+		s.Reset()
+		return
+	}
+	writeMsg(s, rsp)
+}
+
+func resolverAllowed(resolver string, allow []string) bool {
+	resolver = withPort(resolver)
+	for _, a := range allow {
+		if withPort(a) == resolver {
+			return true
+		}
+	}
+	return false
+}
+
+func withPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, "53")
+}
+
+func writeMsg(w io.Writer, msg []byte) error {
+	if len(msg) > maxDNSPacketLen {
+		return errors.New("dns message too long")
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
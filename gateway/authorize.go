@@ -3,8 +3,11 @@ package gateway
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/isletnet/uptp/logging"
 	"github.com/isletnet/uptp/types"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -43,12 +46,17 @@ type AuthorizeResp struct {
 	Proxy    *AuthorizeProxyResp   `json:"proxy,omitempty"`
 }
 type AuthorizePortmapResp struct {
-	IsTrial bool `json:"is_trial"`
+	IsTrial       bool   `json:"is_trial"`
+	Ports         string `json:"ports,omitempty"`
+	TargetStatus  string `json:"target_status,omitempty"` // 资源目标的健康状态
+	TargetLatency int64  `json:"target_latency,omitempty"`
 }
 
 type AuthorizeProxyResp struct {
 	Route string `json:"route"`
 	Dns   string `json:"dns"`
+	// DnsStream 网关支持DNS-over-stream，agent可以在TUN地址上提供DNS
+	DnsStream bool `json:"dns_stream,omitempty"`
 }
 
 func (g *Gateway) authorize() {
@@ -80,14 +88,19 @@ func (g *Gateway) authorizeHandler(s network.Stream) {
 
 func (g *Gateway) handlePortmapAuth(s network.Stream, info *AuthorizePortmapInfo) {
 	var authRes bool
+	resp := AuthorizeResp{
+		Portmap: &AuthorizePortmapResp{},
+	}
 
 	if info.ResourceID == types.ID(666666) && g.trial {
 		authRes = true
 	} else if res := g.prm.GetAppByID(info.ResourceID); res.ID == info.ResourceID {
 		authRes = true
-	}
-	resp := AuthorizeResp{
-		Portmap: &AuthorizePortmapResp{},
+		resp.Portmap.Ports = res.TargetPorts
+		if th := g.hc.get(res.ID); th != nil {
+			resp.Portmap.TargetStatus = th.Status
+			resp.Portmap.TargetLatency = th.LatencyMs
+		}
 	}
 	if authRes {
 		gwName, err := g.getGatewayName()
@@ -125,13 +138,11 @@ func (g *Gateway) handleProxyAuth(s network.Stream, info *AuthorizeProxyInfo) {
 	resp.NodeName = gwName
 	pc := g.proxySvc.getConfig()
 	resp.Proxy.Route = pc.Route
-	resp.Proxy.Dns = pc.DNS
+	resp.Proxy.Dns = g.proxyResolver()
+	resp.Proxy.DnsStream = true
 	if resp.Proxy.Route == "" {
 		resp.Proxy.Route = "0.0.0.0/0"
 	}
-	if resp.Proxy.Dns == "" {
-		resp.Proxy.Dns = "8.8.8.8"
-	}
 	data, err := json.Marshal(resp)
 	if err != nil {
 		return
@@ -163,3 +174,27 @@ func ResourceAuthorize(h host.Host, peerID string, req AuthorizeReq) (resp Autho
 	err = json.Unmarshal(buf[:n], &resp)
 	return
 }
+
+// AuthorizeBackupPeers 用各备用网关上的资源ID授权并记录目标状态，任一网关授权失败时返回错误
+func AuthorizeBackupPeers(h host.Host, app *PortmapApp) error {
+	for i, p := range app.BackupPeers {
+		rsp, err := ResourceAuthorize(h, p.PeerID, AuthorizeReq{
+			Type: AuthorizeTypePortmap,
+			Portmap: &AuthorizePortmapInfo{
+				ResourceID: p.ResID,
+			},
+		})
+		if err == nil && rsp.Err != "" {
+			err = errors.New(rsp.Err)
+		}
+		if err != nil {
+			logging.Warn("authorize backup peer %s for %s error: %s", p.PeerID, app.Name, err)
+			return fmt.Errorf("authorize backup peer %s error: %w", p.PeerID, err)
+		}
+		app.BackupPeers[i].TargetStatus = ""
+		if rsp.Portmap != nil {
+			app.BackupPeers[i].TargetStatus = rsp.Portmap.TargetStatus
+		}
+	}
+	return nil
+}
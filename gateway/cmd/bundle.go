@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/isletnet/uptp/gateway"
+)
+
+// 导入导出直接读写数据库，网关运行时数据库被占用，需要先停止网关或者使用web接口
+
+func defaultWorkDir() string {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "."
+	}
+	return filepath.Dir(exePath)
+}
+
+// exportConfig uptpgw export [-dir d] [-o file] [-redact] [-passphrase p]
+func exportConfig(args []string) {
+	flagSet := flag.NewFlagSet("export", flag.ExitOnError)
+	workDir := flagSet.String("dir", defaultWorkDir(), "work dir")
+	out := flagSet.String("o", "", "output file, default stdout")
+	redact := flagSet.Bool("redact", false, "remove tokens and passwords")
+	passphrase := flagSet.String("passphrase", "", "encrypt the bundle with passphrase")
+	flagSet.Parse(args)
+
+	b, err := gateway.ExportConfig(*workDir, gateway.ExportOptions{
+		Redact:     *redact,
+		Passphrase: *passphrase,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export error:", err)
+		os.Exit(1)
+	}
+	buf, _ := json.MarshalIndent(b, "", "  ")
+	if *out == "" {
+		fmt.Println(string(buf))
+		return
+	}
+	if err := os.WriteFile(*out, buf, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, "write error:", err)
+		os.Exit(1)
+	}
+}
+
+// importConfig uptpgw import [-dir d] [-passphrase p] <file>
+func importConfig(args []string) {
+	flagSet := flag.NewFlagSet("import", flag.ExitOnError)
+	workDir := flagSet.String("dir", defaultWorkDir(), "work dir")
+	passphrase := flagSet.String("passphrase", "", "passphrase of encrypted bundle")
+	flagSet.Parse(args)
+	if flagSet.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: import [-dir d] [-passphrase p] <file>")
+		os.Exit(1)
+	}
+
+	buf, err := os.ReadFile(flagSet.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "read error:", err)
+		os.Exit(1)
+	}
+	var b gateway.ConfigBundle
+	if err := json.Unmarshal(buf, &b); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid bundle:", err)
+		os.Exit(1)
+	}
+	missing, err := gateway.ImportConfig(*workDir, &b, *passphrase)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import error:", err)
+		os.Exit(1)
+	}
+	// 去密钥的配置包在本机没有原值时，这些字段需要重新设置
+	for _, m := range missing {
+		fmt.Fprintln(os.Stderr, "warning: secret not restored,", m)
+	}
+	fmt.Println("ok")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"path/filepath"
 
 	"github.com/isletnet/uptp/logging"
 )
@@ -11,6 +12,7 @@ type runConfig struct {
 	verbose    bool
 	logLevel   int
 	trial      bool
+	configFile string
 }
 
 func parseRunParams(cmd string, args []string) runConfig {
@@ -23,10 +25,15 @@ func parseRunParams(cmd string, args []string) runConfig {
 	verbose := flagSet.Bool("v", false, "log console")
 	trial := flagSet.Bool("trial", false, "trial mod")
 	logLevel := flagSet.Int("log-level", logging.LevelWarn, "log level")
+	configFile := flagSet.String("config", "", "declarative config file, reconciled on start and SIGHUP")
 	flagSet.Parse(args)
 	ret.daemonMode = *daemonMode
 	ret.verbose = *verbose
 	ret.logLevel = *logLevel
 	ret.trial = *trial
+	if *configFile != "" {
+		// 网关运行时会切换工作目录
+		ret.configFile, _ = filepath.Abs(*configFile)
+	}
 	return ret
 }
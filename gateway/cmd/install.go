@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"io"
 	"os"
 	"path/filepath"
@@ -10,8 +11,21 @@ import (
 	"github.com/isletnet/uptp/logging"
 )
 
-func install() {
+// install 安装为系统服务，-config指定声明式配置文件
+func install(args []string) {
 	gLog := logger.NewLogger("", "", logging.LevelDebug, 0, logger.LogConsole)
+	flagSet := flag.NewFlagSet("install", flag.ExitOnError)
+	configFile := flagSet.String("config", "", "declarative config file")
+	flagSet.Parse(args)
+	svcArgs := []string{"-d"}
+	if *configFile != "" {
+		p, err := filepath.Abs(*configFile)
+		if err != nil {
+			gLog.Error("config file %s error: %s", *configFile, err)
+			os.Exit(1)
+		}
+		svcArgs = append(svcArgs, "-config", p)
+	}
 	err := os.MkdirAll(defaultInstallPath, 0775)
 
 	if err != nil {
@@ -51,14 +65,14 @@ func install() {
 
 	// install system service
 	gLog.Info("targetPath: %s", targetPath)
-	err = serviceControl("install", targetPath, []string{"-d"})
+	err = serviceControl("install", targetPath, svcArgs)
 	if err != nil {
 		gLog.Error("install system service error: ", err)
 		os.Exit(1)
 	}
 	gLog.Info("install system service ok.")
 	time.Sleep(time.Second * 2)
-	err = serviceControl("start", targetPath, []string{"-d"})
+	err = serviceControl("start", targetPath, svcArgs)
 	if err != nil {
 		gLog.Error("start %s service error:", ProductName, err)
 		os.Exit(1)
@@ -17,7 +17,7 @@ func main() {
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
 		case "install":
-			install()
+			install(os.Args[2:])
 			return
 		case "uninstall":
 			uninstall()
@@ -31,6 +31,15 @@ func main() {
 		case "stop":
 			serviceControl("stop", "", nil)
 			return
+		case "export":
+			exportConfig(os.Args[2:])
+			return
+		case "import":
+			importConfig(os.Args[2:])
+			return
+		case "diff":
+			diffConfig(os.Args[2:])
+			return
 		case "isletid":
 			// gLog := NewLogger("", "", logging.LevelDebug, 0, LogConsole)
 			// isletid, err := machineid.ProtectedID("isletnet")
@@ -65,18 +74,32 @@ func main() {
 	go func() {
 		defer wg.Done()
 		if err := gateway.Instance().Run(gateway.Config{
-			LogMod:   lm,
-			LogLevel: rc.logLevel,
+			LogMod:     lm,
+			LogLevel:   rc.logLevel,
+			ConfigFile: rc.configFile,
 		}); err != nil {
 			logging.Error("gateway run error: %s", err)
 		}
 		logging.Info("uptp gateway run end")
 	}()
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	select {
-	case <-sigChan:
-	case <-gateway.Instance().ExitSignalChan():
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for exit := false; !exit; {
+		select {
+		case sig := <-sigChan:
+			if sig != syscall.SIGHUP {
+				exit = true
+				break
+			}
+			if rc.configFile == "" {
+				continue
+			}
+			if _, err := gateway.Instance().Reconcile(false); err != nil {
+				logging.Error("reconcile config error: %s", err)
+			}
+		case <-gateway.Instance().ExitSignalChan():
+			exit = true
+		}
 	}
 	gateway.Instance().Stop()
 	wg.Wait()
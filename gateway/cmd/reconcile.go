@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/isletnet/uptp/gateway"
+)
+
+// diffConfig uptpgw diff [-dir d] -config <file>，打印配置文件与当前配置的差异，不做修改
+func diffConfig(args []string) {
+	flagSet := flag.NewFlagSet("diff", flag.ExitOnError)
+	workDir := flagSet.String("dir", defaultWorkDir(), "work dir")
+	configFile := flagSet.String("config", "", "declarative config file")
+	flagSet.Parse(args)
+	if *configFile == "" {
+		fmt.Fprintln(os.Stderr, "usage: diff [-dir d] -config <file>")
+		os.Exit(1)
+	}
+
+	changes, err := gateway.DiffConfigFile(*workDir, *configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "diff error:", err)
+		os.Exit(1)
+	}
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+}
@@ -0,0 +1,445 @@
+package gateway
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	apiutil "github.com/isletnet/uptp/apiutil.go"
+	"github.com/isletnet/uptp/common"
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/store"
+	"github.com/isletnet/uptp/types"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ConfigBundleVersion 配置包格式版本，格式不兼容时递增
+const ConfigBundleVersion = 1
+
+const (
+	bundleKDFScrypt = "scrypt"
+	scryptN         = 1 << 15
+	scryptR         = 8
+	scryptP         = 1
+)
+
+// ConfigBundle 网关配置的导出包，Data的key为leveldb的key，集合为记录前缀，值为ID到记录的map
+type ConfigBundle struct {
+	Version        int                        `json:"version"`
+	GatewayVersion string                     `json:"gateway_version"`
+	CreatedAt      int64                      `json:"created_at"`
+	Redacted       bool                       `json:"redacted,omitempty"`
+	Data           map[string]json.RawMessage `json:"data,omitempty"`
+	Encrypted      *bundleCipher              `json:"encrypted,omitempty"`
+}
+
+// bundleCipher 加密后的Data，密钥由口令经scrypt派生，使用AES-GCM加密
+type bundleCipher struct {
+	KDF   string `json:"kdf"`
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// ExportOptions Redact去掉令牌和密码，Passphrase不为空时加密
+type ExportOptions struct {
+	Redact     bool   `json:"redact"`
+	Passphrase string `json:"passphrase"`
+}
+
+// bundleKey raw为直接保存的字符串，secret整个值都是密钥，secretFields为JSON对象中的密钥字段，isMap表示按记录保存的集合
+type bundleKey struct {
+	name         string
+	raw          bool
+	secret       bool
+	secretFields []string
+	isMap        bool
+}
+
+// 身份信息在uuid文件中，不导出
+var bundleKeys = []bundleKey{
+	{name: dbKeyGatewayName, raw: true},
+	{name: dbKeyListenPort, raw: true},
+	{name: dbKeyToken, raw: true, secret: true},
+	{name: dbKeyReverseToken, raw: true, secret: true},
+	{name: "admin_password", raw: true, secret: true},
+	{name: dbKeyBootstraps},
+	{name: prefixResource, isMap: true},
+	{name: prefixApp, isMap: true},
+	{name: prefixOutbound, secretFields: []string{"token"}, isMap: true},
+	{name: prefixManageCred, secretFields: []string{"token"}, isMap: true},
+	{name: prefixRemoteGateway, secretFields: []string{"token"}, isMap: true},
+	{name: string(keyProxyServiceConfig), secretFields: []string{"proxy_pass"}},
+	{name: string(keyProxyClientHTTP)},
+	{name: string(keyProxyClientDomain)},
+	{name: string(keyProxyClientDNS)},
+}
+
+func findBundleKey(name string) *bundleKey {
+	for i := range bundleKeys {
+		if bundleKeys[i].name == name {
+			return &bundleKeys[i]
+		}
+	}
+	return nil
+}
+
+// load 读取数据库中的值，集合组装成ID到记录的map，不存在时返回nil
+func (k *bundleKey) load(db *leveldb.DB) ([]byte, error) {
+	if !k.isMap {
+		v, err := db.Get([]byte(k.name), nil)
+		if err == leveldb.ErrNotFound {
+			return nil, nil
+		}
+		return v, err
+	}
+	m := make(map[string]json.RawMessage)
+	err := store.LoadRawRecords(db, k.name, func(id types.ID, raw []byte) error {
+		m[id.String()] = append(json.RawMessage(nil), raw...)
+		return nil
+	})
+	if err != nil || len(m) == 0 {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// save 写入batch，集合先删除原有的所有记录
+func (k *bundleKey) save(db *leveldb.DB, b *leveldb.Batch, v []byte) error {
+	if !k.isMap {
+		b.Put([]byte(k.name), v)
+		return nil
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(v, &m); err != nil {
+		return err
+	}
+	if err := store.DeleteRecords(db, b, k.name); err != nil {
+		return err
+	}
+	for sid, raw := range m {
+		if string(raw) == "null" {
+			continue
+		}
+		id, err := strconv.ParseUint(sid, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid id %q", sid)
+		}
+		b.Put(store.RecordKey(k.name, types.ID(id)), raw)
+	}
+	return nil
+}
+
+func (k *bundleKey) objects(v []byte) (map[string]map[string]json.RawMessage, error) {
+	ret := map[string]map[string]json.RawMessage{}
+	if k.isMap {
+		err := json.Unmarshal(v, &ret)
+		return ret, err
+	}
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(v, &obj); err != nil {
+		return nil, err
+	}
+	ret[""] = obj
+	return ret, nil
+}
+
+func (k *bundleKey) marshal(objs map[string]map[string]json.RawMessage) ([]byte, error) {
+	if k.isMap {
+		return json.Marshal(objs)
+	}
+	return json.Marshal(objs[""])
+}
+
+// redact 删除对象中的密钥字段
+func (k *bundleKey) redact(v []byte) ([]byte, error) {
+	objs, err := k.objects(v)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objs {
+		for _, f := range k.secretFields {
+			delete(obj, f)
+		}
+	}
+	return k.marshal(objs)
+}
+
+// restore 导入去密钥的配置时，缺少的密钥字段使用本机同一对象的原值，返回无法恢复的字段
+func (k *bundleKey) restore(v, old []byte) ([]byte, []string, error) {
+	objs, err := k.objects(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	oldObjs := map[string]map[string]json.RawMessage{}
+	if old != nil {
+		if o, err := k.objects(old); err == nil {
+			oldObjs = o
+		}
+	}
+	var missing []string
+	for id, obj := range objs {
+		if obj == nil {
+			continue
+		}
+		oldObj := oldObjs[id]
+		for _, f := range k.secretFields {
+			if _, ok := obj[f]; ok {
+				continue
+			}
+			if ov, ok := oldObj[f]; ok {
+				obj[f] = ov
+				continue
+			}
+			name := k.name
+			if id != "" {
+				name += " " + id
+			}
+			missing = append(missing, name+": "+f)
+		}
+	}
+	sort.Strings(missing)
+	v, err = k.marshal(objs)
+	return v, missing, err
+}
+
+func exportConfig(db *leveldb.DB, opt ExportOptions) (*ConfigBundle, error) {
+	data := make(map[string]json.RawMessage)
+	for i := range bundleKeys {
+		k := &bundleKeys[i]
+		if opt.Redact && k.secret {
+			continue
+		}
+		v, err := k.load(db)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		if k.raw {
+			v, err = json.Marshal(string(v))
+		} else if opt.Redact && len(k.secretFields) > 0 {
+			v, err = k.redact(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("export %s error: %w", k.name, err)
+		}
+		data[k.name] = v
+	}
+	b := &ConfigBundle{
+		Version:        ConfigBundleVersion,
+		GatewayVersion: common.GatewayVersion,
+		CreatedAt:      time.Now().Unix(),
+		Redacted:       opt.Redact,
+		Data:           data,
+	}
+	if opt.Passphrase != "" {
+		if err := b.encrypt(opt.Passphrase); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// importConfig 覆盖包中包含的key，包中没有的key保持不变，
+// 去密钥的配置包在本机没有对应原值时返回缺少密钥的字段，需要导入后重新设置
+func importConfig(db *leveldb.DB, b *ConfigBundle, passphrase string) (missing []string, err error) {
+	if b.Version == 0 || b.Version > ConfigBundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.Version)
+	}
+	data := b.Data
+	if b.Encrypted != nil {
+		data, err = b.decrypt(passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	batch := new(leveldb.Batch)
+	for name, v := range data {
+		k := findBundleKey(name)
+		if k == nil {
+			return nil, fmt.Errorf("unknown config key %q", name)
+		}
+		if k.raw {
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				return nil, fmt.Errorf("import %s error: %w", name, err)
+			}
+			batch.Put([]byte(name), []byte(s))
+			continue
+		}
+		if !json.Valid(v) {
+			return nil, fmt.Errorf("import %s error: invalid json", name)
+		}
+		if b.Redacted && len(k.secretFields) > 0 {
+			old, err := k.load(db)
+			if err != nil {
+				return nil, fmt.Errorf("import %s error: %w", name, err)
+			}
+			var m []string
+			v, m, err = k.restore(v, old)
+			if err != nil {
+				return nil, fmt.Errorf("import %s error: %w", name, err)
+			}
+			missing = append(missing, m...)
+		}
+		if err := k.save(db, batch, v); err != nil {
+			return nil, fmt.Errorf("import %s error: %w", name, err)
+		}
+	}
+	sort.Strings(missing)
+	return missing, db.Write(batch, nil)
+}
+
+func (b *ConfigBundle) encrypt(passphrase string) error {
+	plain, err := json.Marshal(b.Data)
+	if err != nil {
+		return err
+	}
+	c := &bundleCipher{
+		KDF:  bundleKDFScrypt,
+		Salt: make([]byte, 16),
+	}
+	if _, err := rand.Read(c.Salt); err != nil {
+		return err
+	}
+	aead, err := newBundleAEAD(passphrase, c.Salt)
+	if err != nil {
+		return err
+	}
+	c.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(c.Nonce); err != nil {
+		return err
+	}
+	c.Data = aead.Seal(nil, c.Nonce, plain, nil)
+	b.Data = nil
+	b.Encrypted = c
+	return nil
+}
+
+func (b *ConfigBundle) decrypt(passphrase string) (map[string]json.RawMessage, error) {
+	c := b.Encrypted
+	if passphrase == "" {
+		return nil, errors.New("bundle is encrypted, passphrase is required")
+	}
+	if c.KDF != bundleKDFScrypt {
+		return nil, fmt.Errorf("unsupported kdf %q", c.KDF)
+	}
+	aead, err := newBundleAEAD(passphrase, c.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	plain, err := aead.Open(nil, c.Nonce, c.Data, nil)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted bundle")
+	}
+	var data map[string]json.RawMessage
+	err = json.Unmarshal(plain, &data)
+	return data, err
+}
+
+func newBundleAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ExportConfig 从工作目录的数据库导出配置，网关运行时数据库被占用，需要使用/gateway/export接口
+func ExportConfig(workDir string, options ExportOptions) (*ConfigBundle, error) {
+	db, err := openDB(filepath.Join(workDir, dbData), &opt.Options{ErrorIfMissing: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return exportConfig(db, options)
+}
+
+// ImportConfig 导入配置到工作目录的数据库，网关需要先停止，返回值同importConfig
+func ImportConfig(workDir string, b *ConfigBundle, passphrase string) ([]string, error) {
+	db, err := openDB(filepath.Join(workDir, dbData), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return importConfig(db, b, passphrase)
+}
+
+func (g *Gateway) exportConfig(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+
+	var opt ExportOptions
+	if err := json.NewDecoder(r.Body).Decode(&opt); err != nil && err != io.EOF {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	b, err := exportConfig(g.db, opt)
+	if err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	rsp.Message = "ok"
+	rsp.Data = b
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+// importConfig 各模块的配置都缓存在内存中，导入后重启网关使配置生效
+func (g *Gateway) importConfig(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+
+	var req struct {
+		Bundle     *ConfigBundle `json:"bundle"`
+		Passphrase string        `json:"passphrase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	if req.Bundle == nil {
+		rsp.Code = 400
+		rsp.Message = "bundle is required"
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	missing, err := importConfig(g.db, req.Bundle, req.Passphrase)
+	if err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	if len(missing) > 0 {
+		logging.Warn("gateway config imported without secrets: %v", missing)
+	}
+	logging.Info("gateway config imported, restart")
+	rsp.Message = "ok"
+	rsp.Data = map[string][]string{"missing_secrets": missing}
+	apiutil.SendAPIRespWithOk(w, rsp)
+	g.sendExitSignal()
+}
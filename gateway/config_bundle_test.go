@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/isletnet/uptp/store"
+	"github.com/isletnet/uptp/types"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func memDB(t *testing.T) *leveldb.DB {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func getKey(t *testing.T, db *leveldb.DB, k string) string {
+	v, err := db.Get([]byte(k), nil)
+	if err != nil {
+		t.Fatalf("get %s: %s", k, err)
+	}
+	return string(v)
+}
+
+func TestConfigBundleRoundTrip(t *testing.T) {
+	src := memDB(t)
+	src.Put([]byte(dbKeyGatewayName), []byte("gw1"), nil)
+	src.Put([]byte(dbKeyToken), []byte("123"), nil)
+	src.Put(store.RecordKey(prefixOutbound, 1), []byte(`{"id":"1","peer":"p1","token":"42"}`), nil)
+	src.Put(keyProxyServiceConfig, []byte(`{"proxy_addr":"1.1.1.1:1080","proxy_pass":"secret"}`), nil)
+
+	b, err := exportConfig(src, ExportOptions{Passphrase: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Data != nil || b.Encrypted == nil {
+		t.Fatal("bundle not encrypted")
+	}
+	buf, _ := json.Marshal(b)
+	var nb ConfigBundle
+	json.Unmarshal(buf, &nb)
+
+	dst := memDB(t)
+	if _, err := importConfig(dst, &nb, "wrong"); err == nil {
+		t.Error("wrong passphrase accepted")
+	}
+	if _, err := importConfig(dst, &nb, "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if v := getKey(t, dst, dbKeyGatewayName); v != "gw1" {
+		t.Errorf("name = %q", v)
+	}
+	if v := getKey(t, dst, dbKeyToken); v != "123" {
+		t.Errorf("token = %q", v)
+	}
+}
+
+func TestConfigBundleRedact(t *testing.T) {
+	src := memDB(t)
+	src.Put([]byte(dbKeyToken), []byte("123"), nil)
+	src.Put(store.RecordKey(prefixOutbound, 1), []byte(`{"id":"1","token":"42"}`), nil)
+	src.Put(store.RecordKey(prefixOutbound, 2), []byte(`{"id":"2","token":"43"}`), nil)
+
+	b, err := exportConfig(src, ExportOptions{Redact: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.Data[dbKeyToken]; ok {
+		t.Error("token exported")
+	}
+	var obs map[string]map[string]any
+	json.Unmarshal(b.Data[prefixOutbound], &obs)
+	if _, ok := obs["1"]["token"]; ok {
+		t.Error("outbound token exported")
+	}
+
+	// 本机已有的出站保留原来的token
+	dst := memDB(t)
+	dst.Put([]byte(dbKeyToken), []byte("999"), nil)
+	dst.Put(store.RecordKey(prefixOutbound, 1), []byte(`{"id":"1","token":"77"}`), nil)
+	dst.Put(store.RecordKey(prefixOutbound, 3), []byte(`{"id":"3","token":"78"}`), nil)
+	missing, err := importConfig(dst, b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 本机没有的出站无法恢复token
+	if len(missing) != 1 || missing[0] != prefixOutbound+" 2: token" {
+		t.Errorf("missing = %v", missing)
+	}
+	if v := getKey(t, dst, dbKeyToken); v != "999" {
+		t.Errorf("token = %q", v)
+	}
+	ob := func(id types.ID) map[string]any {
+		v, err := dst.Get(store.RecordKey(prefixOutbound, id), nil)
+		if err != nil {
+			return nil
+		}
+		var m map[string]any
+		json.Unmarshal(v, &m)
+		return m
+	}
+	if v := ob(1)["token"]; v != "77" {
+		t.Errorf("outbound 1 token = %v", v)
+	}
+	if o := ob(2); o == nil || o["token"] != nil {
+		t.Errorf("outbound 2 = %v", o)
+	}
+	if ob(3) != nil {
+		t.Error("outbound 3 not replaced")
+	}
+}
+
+func TestConfigBundleRedactFresh(t *testing.T) {
+	src := memDB(t)
+	src.Put(store.RecordKey(prefixOutbound, 1), []byte(`{"id":"1","token":"42"}`), nil)
+	src.Put(keyProxyServiceConfig, []byte(`{"proxy_addr":"1.1.1.1:1080","proxy_pass":"secret"}`), nil)
+	b, err := exportConfig(src, ExportOptions{Redact: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := importConfig(memDB(t), b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{prefixOutbound + " 1: token", string(keyProxyServiceConfig) + ": proxy_pass"}
+	sort.Strings(want)
+	if !slices.Equal(missing, want) {
+		t.Errorf("missing = %v, want %v", missing, want)
+	}
+}
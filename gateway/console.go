@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/types"
+	gostream "github.com/libp2p/go-libp2p-gostream"
+)
+
+// ConsoleProtocolID 在libp2p上提供和3000端口相同的web控制台，对端需要持有有write权限的管理凭证，
+// 之后仍需要登录，agent可以在本地端口代理到指定网关的控制台
+const ConsoleProtocolID = "/uptp/console/1.0.0"
+
+// ConsoleTokenHeader 控制台请求携带管理凭证的token，Authorization头留给登录会话使用
+const ConsoleTokenHeader = "X-Uptp-Manage-Token"
+
+const defaultAdminPassword = "admin123"
+
+func (g *Gateway) isDefaultPassword() bool {
+	v, err := g.db.Get([]byte("admin_password"), nil)
+	return err != nil || string(v) == defaultAdminPassword
+}
+
+// startConsole 默认密码时不启动，修改密码后再启动
+func (g *Gateway) startConsole() error {
+	g.consoleMtx.Lock()
+	defer g.consoleMtx.Unlock()
+	if g.consoleListener != nil || g.consoleSer == nil {
+		return nil
+	}
+	if g.isDefaultPassword() {
+		logging.Warn("console over libp2p disabled until the default password is changed")
+		return nil
+	}
+	ln, err := gostream.Listen(g.pe.Libp2pHost(), ConsoleProtocolID)
+	if err != nil {
+		return err
+	}
+	g.consoleListener = ln
+	server := http.Server{Handler: g.consoleAuth(g.consoleSer)}
+	go func() {
+		err := server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			logging.Error("console server error: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (g *Gateway) stopConsole() {
+	g.consoleMtx.Lock()
+	defer g.consoleMtx.Unlock()
+	if g.consoleListener != nil {
+		g.consoleListener.Close()
+		g.consoleListener = nil
+	}
+}
+
+// consoleAuth 校验对端的管理凭证，升级和重启还需要upgrade权限，不允许通过控制台签发凭证和管理其他网关
+func (g *Gateway) consoleAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cred *ManageCredential
+		if token, err := strconv.ParseUint(r.Header.Get(ConsoleTokenHeader), 10, 64); err == nil {
+			cred = g.mm.check(r.RemoteAddr, types.ID(token))
+		}
+		if cred == nil {
+			logging.Warn("console request from %s unauthorized", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		scope := ManageScopeWrite
+		if strings.HasPrefix(r.URL.Path, "/upgrade/") || r.URL.Path == "/gateway/restart" {
+			scope = ManageScopeUpgrade
+		}
+		if !cred.allow(scope) || strings.HasPrefix(r.URL.Path, "/manage/") || strings.HasPrefix(r.URL.Path, "/remote/") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
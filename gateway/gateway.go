@@ -26,7 +26,6 @@ import (
 	"github.com/isletnet/uptp/types"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
-	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 const (
@@ -34,12 +33,16 @@ const (
 )
 
 const (
-	dbKeyToken       = "token"
-	dbKeyBootstraps  = "bootstraps"
-	dbKeyGatewayName = "gateway_name"
-	dbKeyListenPort  = "listen_port"
+	dbKeyToken        = "token"
+	dbKeyReverseToken = "reverse_token"
+	dbKeyBootstraps   = "bootstraps"
+	dbKeyGatewayName  = "gateway_name"
+	dbKeyListenPort   = "listen_port"
 )
 
+// apiPort 本地web控制台和API的端口
+const apiPort = 3000
+
 type Gateway struct {
 	pe       *p2pengine.P2PEngine
 	pm       *portmap.Portmap
@@ -48,12 +51,25 @@ type Gateway struct {
 	pam      *PortmapAppMgr
 	proxySvc *proxyService
 	proxyCli *proxyClient
-
-	apiListener net.Listener
-	exitCh      chan bool
+	hp       *httpProxy
+	hc       *healthChecker
+	mm       *manageMgr
+
+	apiListener     net.Listener
+	manageListener  net.Listener
+	manageCli       *http.Client // 访问远程网关的管理接口，复用libp2p连接
+	consoleMtx      sync.Mutex
+	consoleListener net.Listener
+	consoleSer      *apiutil.ApiServer
+	startTime       time.Time
+	exitCh          chan bool
 
 	trial bool
 
+	configFile   string
+	reconcileMtx sync.Mutex
+	reverseMtx   sync.Mutex // 反向映射的端口检查和添加需要串行
+
 	// 会话管理
 	sessions   map[string]bool
 	sessionMux sync.RWMutex
@@ -64,6 +80,8 @@ type Config struct {
 	LogDir   string
 	LogMod   int
 	LogLevel int
+	// ConfigFile 声明式配置文件，启动和收到SIGHUP时按文件调整资源、应用和出站
+	ConfigFile string
 }
 
 type PortmapAppHandshake struct {
@@ -102,13 +120,9 @@ func (g *Gateway) Run(conf Config) error {
 	logging.SetLogger(gLog)
 
 	logging.Info("uptp gateway run begin")
+	g.startTime = time.Now()
 
-	var nopts opt.Options
-
-	db, err := leveldb.OpenFile(dbData, &nopts)
-	if errors.IsCorrupted(err) && !nopts.GetReadOnly() {
-		db, err = leveldb.RecoverFile(dbData, &nopts)
-	}
+	db, err := openDB(dbData, nil)
 	if err != nil {
 		return err
 	}
@@ -116,7 +130,7 @@ func (g *Gateway) Run(conf Config) error {
 
 	// 初始化默认密码
 	if _, err := g.db.Get([]byte("admin_password"), nil); err != nil {
-		err = g.db.Put([]byte("admin_password"), []byte("admin123"), nil)
+		err = g.db.Put([]byte("admin_password"), []byte(defaultAdminPassword), nil)
 		if err != nil {
 			return err
 		}
@@ -168,6 +182,12 @@ func (g *Gateway) Run(conf Config) error {
 	}
 	g.pam = pam
 
+	mm, err := newManageMgr(db)
+	if err != nil {
+		return err
+	}
+	g.mm = mm
+
 	pCli, err := newProxyClient(pe.Libp2pHost(), db)
 	if err != nil {
 		return err
@@ -188,23 +208,20 @@ func (g *Gateway) Run(conf Config) error {
 
 	g.pm = portmap.NewPortMap(pe.Libp2pHost())
 	g.pm.SetHandleHandshakeFunc(g.handlePortmapHandshake)
-	g.pm.SetGetHandshakeFunc(func(network, ip string, port int) (peerID string, handshake []byte) {
+	g.hp = newHTTPProxy(g.prm.GetAppByID)
+	g.hp.start()
+	g.pm.SetConnHandler(portmapNetworkHTTP, g.hp.handleConn)
+	g.hc, err = newHealthChecker(db, g.prm.GetResources)
+	if err != nil {
+		return err
+	}
+	g.hc.start()
+	g.pm.SetGetHandshakeFunc(func(network, ip string, port int) (up portmap.Upstream, handshake []byte) {
 		app := g.pam.FindAppWithPort(network, port)
 		if app.ResID == 0 {
 			return
 		}
-		peerID = app.PeerID
-		hs := PortmapAppHandshake{
-			ResID:      types.ID(app.ResID),
-			Network:    app.Network,
-			TargetAddr: app.TargetAddr,
-			TargetPort: app.TargetPort,
-		}
-		handshake, err = json.Marshal(hs)
-		if err != nil {
-			return
-		}
-		return
+		return app.Handshake(port)
 	})
 	g.pm.Start(true)
 
@@ -221,7 +238,7 @@ func (g *Gateway) Run(conf Config) error {
 		if !a.Running {
 			continue
 		}
-		_, err = g.pm.AddListener(a.Network, a.LocalIP, a.LocalPort)
+		err = a.AddListeners(g.pm)
 		if err != nil {
 			a.Err = ""
 			a.Running = false
@@ -229,11 +246,29 @@ func (g *Gateway) Run(conf Config) error {
 			logging.Error("add portmap listener error: %s", err)
 		}
 	}
+	// 初始化完成后才允许SIGHUP触发调整
+	g.reconcileMtx.Lock()
+	g.configFile = conf.ConfigFile
+	g.reconcileMtx.Unlock()
+	if conf.ConfigFile != "" {
+		if _, err := g.Reconcile(false); err != nil {
+			logging.Error("reconcile config error: %s", err)
+		}
+	}
 	apiSer := apiutil.NewApiServer()
 	g.router(apiSer)
 	g.authorize()
+	g.dnsStream()
+	g.reverse()
+	if err := g.startManage(); err != nil {
+		return err
+	}
+	g.consoleSer = apiSer
+	if err := g.startConsole(); err != nil {
+		return err
+	}
 
-	ln, err := net.Listen("tcp", "0.0.0.0:3000")
+	ln, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(apiPort))
 	if err != nil {
 		return err
 	}
@@ -259,6 +294,10 @@ func (g *Gateway) sendExitSignal() {
 
 func (g *Gateway) Stop() {
 	g.apiListener.Close()
+	g.stopManage()
+	g.stopConsole()
+	g.hp.stop()
+	g.hc.stop()
 	g.proxyCli.Stop()
 	g.pe.Close()
 	g.db.Close()
@@ -289,6 +328,9 @@ func (g *Gateway) router(ser *apiutil.ApiServer) {
 	ser.AddRoute("/gateway", func(r chi.Router) {
 		r.Get("/info", g.getGatewayInfo)
 		r.Post("/name", g.updateGatewayName)
+		r.Post("/export", g.exportConfig)
+		r.Post("/import", g.importConfig)
+		r.Post("/reconcile", g.reconcile)
 		r.Get("/restart", func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("ok"))
 			g.sendExitSignal()
@@ -312,6 +354,24 @@ func (g *Gateway) router(ser *apiutil.ApiServer) {
 		r.Post("/add", g.addOutbound)
 		r.Post("/update", g.updateOutbound)
 		r.Post("/delete", g.deleteOutbound)
+		r.Get("/http_proxy", g.getProxyClientHTTP)
+		r.Post("/http_proxy", g.setProxyClientHTTP)
+		r.Get("/routes", g.listProxyClientRoutes)
+		r.Get("/domain_rules", g.getProxyClientDomain)
+		r.Post("/domain_rules", g.setProxyClientDomain)
+		r.Get("/dns", g.getProxyClientDNS)
+		r.Post("/dns", g.setProxyClientDNS)
+	})
+	ser.AddRoute("/manage", func(r chi.Router) {
+		r.Get("/credential/list", g.listManageCreds)
+		r.Post("/credential/add", g.addManageCred)
+		r.Post("/credential/delete", g.deleteManageCred)
+	})
+	ser.AddRoute("/remote", func(r chi.Router) {
+		r.Get("/list", g.listRemoteGateways)
+		r.Post("/add", g.addRemoteGateway)
+		r.Post("/delete", g.deleteRemoteGateway)
+		r.HandleFunc("/{id}/*", g.proxyRemoteGateway)
 	})
 	ser.AddRoute("/upgrade", func(r chi.Router) {
 		r.Get("/myself", g.upgradeMyself)
@@ -359,6 +419,12 @@ func (g *Gateway) handleChangePassword(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to update password", http.StatusInternalServerError)
 		return
 	}
+	// 改回默认密码时关闭libp2p控制台
+	if g.isDefaultPassword() {
+		g.stopConsole()
+	} else if err := g.startConsole(); err != nil {
+		logging.Error("start console error: %s", err)
+	}
 
 	w.Write([]byte(`{"success":true}`))
 }
@@ -782,40 +848,11 @@ func (g *Gateway) addApp(w http.ResponseWriter, r *http.Request) {
 		apiutil.SendAPIRespWithOk(w, rsp)
 		return
 	}
-	authRsp, err := ResourceAuthorize(g.pe.Libp2pHost(), app.PeerID, AuthorizeReq{
-		Type: AuthorizeTypePortmap,
-		Portmap: &AuthorizePortmapInfo{
-			ResourceID: types.ID(app.ResID),
-		},
-	})
-	if err != nil {
-		rsp.Code = 400
-		rsp.Message = err.Error()
-		apiutil.SendAPIRespWithOk(w, rsp)
-		return
-	}
-	if authRsp.Err != "" {
-		rsp.Code = 400
-		rsp.Message = authRsp.Err
-		apiutil.SendAPIRespWithOk(w, rsp)
-		return
-	}
-	app.PeerName = authRsp.NodeName
 
 	// 生成随机ID
 	app.ID = types.ID(rand.Uint64())
-
-	// 如果应用设置为运行状态，则添加listener
-	if app.Running {
-		_, err := g.pm.AddListener(app.Network, app.LocalIP, app.LocalPort)
-		if err != nil {
-			app.Running = false
-			app.Err = err.Error()
-		}
-	}
-
-	if err := g.pam.UpdatePortmapApp(&app); err != nil {
-		rsp.Code = 500
+	if err := g.savePortmapApp(&app, nil); err != nil {
+		rsp.Code = 400
 		rsp.Message = err.Error()
 		apiutil.SendAPIRespWithOk(w, rsp)
 		return
@@ -858,7 +895,29 @@ func (g *Gateway) updateApp(w http.ResponseWriter, r *http.Request) {
 		apiutil.SendAPIRespWithOk(w, rsp)
 		return
 	}
-	if app.PeerID != oldApp.PeerID || app.ResID != oldApp.ResID {
+	if oldApp.Reverse {
+		rsp.Code = 400
+		rsp.Message = "reverse app is managed by agent"
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	if err := g.savePortmapApp(&app, oldApp); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
+	rsp.Message = "ok"
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+// savePortmapApp 授权并保存应用，old为nil时新增，按Running启动监听
+func (g *Gateway) savePortmapApp(app, old *PortmapApp) error {
+	if err := app.ValidateUpstream(); err != nil {
+		return err
+	}
+	if old == nil || app.PeerID != old.PeerID || app.ResID != old.ResID {
 		authRsp, err := ResourceAuthorize(g.pe.Libp2pHost(), app.PeerID, AuthorizeReq{
 			Type: AuthorizeTypePortmap,
 			Portmap: &AuthorizePortmapInfo{
@@ -866,44 +925,46 @@ func (g *Gateway) updateApp(w http.ResponseWriter, r *http.Request) {
 			},
 		})
 		if err != nil {
-			rsp.Code = 400
-			rsp.Message = err.Error()
-			apiutil.SendAPIRespWithOk(w, rsp)
-			return
+			return err
 		}
 		if authRsp.Err != "" {
-			rsp.Code = 400
-			rsp.Message = authRsp.Err
-			apiutil.SendAPIRespWithOk(w, rsp)
-			return
+			return errors.New(authRsp.Err)
 		}
 		app.PeerName = authRsp.NodeName
+		if authRsp.Portmap != nil {
+			app.TargetStatus = authRsp.Portmap.TargetStatus
+			app.TargetLatency = authRsp.Portmap.TargetLatency
+		}
+		app.TargetPorts = authorizedPorts(authRsp)
 	} else {
-		app.PeerName = oldApp.PeerName
+		app.PeerName = old.PeerName
+		app.TargetPorts = old.TargetPorts
+		app.TargetStatus = old.TargetStatus
+		app.TargetLatency = old.TargetLatency
+	}
+	if old == nil || !SameBackupPeers(app.BackupPeers, old.BackupPeers) {
+		if err := AuthorizeBackupPeers(g.pe.Libp2pHost(), app); err != nil {
+			return err
+		}
+	} else {
+		app.BackupPeers = old.BackupPeers
+	}
+	if err := app.SetTargetPorts(app.TargetPorts); err != nil {
+		return err
 	}
 
 	// 如果运行状态有变化，则更新listener
-	if oldApp.Running {
-		g.pm.DeleteListener(oldApp.Network, oldApp.LocalIP, oldApp.LocalPort)
-
+	if old != nil && old.Running {
+		old.DelListeners(g.pm)
 	}
 	if app.Running {
-		_, err := g.pm.AddListener(app.Network, app.LocalIP, app.LocalPort)
+		err := app.AddListeners(g.pm)
 		if err != nil {
 			app.Running = false
 			app.Err = err.Error()
 		}
 	}
-
-	if err := g.pam.UpdatePortmapApp(&app); err != nil {
-		rsp.Code = 500
-		rsp.Message = err.Error()
-		apiutil.SendAPIRespWithOk(w, rsp)
-		return
-	}
-
-	rsp.Message = "ok"
-	apiutil.SendAPIRespWithOk(w, rsp)
+	return g.pam.UpdatePortmapApp(app)
 }
 
 func (g *Gateway) deleteApp(w http.ResponseWriter, r *http.Request) {
@@ -930,7 +991,7 @@ func (g *Gateway) deleteApp(w http.ResponseWriter, r *http.Request) {
 	app := g.pam.GetPortmapApp(req.ID.Uint64())
 	if app != nil && app.Running {
 		// 如果应用正在运行，则移除listener
-		g.pm.DeleteListener(app.Network, app.LocalIP, app.LocalPort)
+		app.DelListeners(g.pm)
 	}
 
 	if err := g.pam.DelPortmapApp(req.ID.Uint64()); err != nil {
@@ -993,7 +1054,7 @@ func (g *Gateway) getApp(w http.ResponseWriter, r *http.Request) {
 // 	sendAPIRespWithOk(w, rsp)
 // }
 
-func (g *Gateway) handlePortmapHandshake(handshake []byte) (network string, addr string, port int, err error) {
+func (g *Gateway) handlePortmapHandshake(peerID string, handshake []byte) (network string, addr string, port int, err error) {
 	pmhs := PortmapAppHandshake{}
 	err = json.Unmarshal(handshake, &pmhs)
 	if err != nil {
@@ -1010,20 +1071,54 @@ func (g *Gateway) handlePortmapHandshake(handshake []byte) (network string, addr
 		err = errors.New("portmap app not found")
 		return
 	}
+	if pa.Type == PortmapResTypeHTTP {
+		// HTTP资源由网关终结，按Host和路径路由
+		network = portmapNetworkHTTP
+		addr = pa.ID.String()
+		return
+	}
 	network = pa.Network
 	addr = pa.TargetAddr
 	port = pa.TargetPort
+	if pa.TargetPorts != "" {
+		// 多端口资源由握手指定具体端口
+		if !pa.HasTargetPort(pmhs.TargetPort) {
+			err = errors.New("target port not allowed")
+			return
+		}
+		port = pmhs.TargetPort
+	}
 	return
 }
 
+func authorizedPorts(rsp AuthorizeResp) string {
+	if rsp.Portmap == nil {
+		return ""
+	}
+	return rsp.Portmap.Ports
+}
+
 func (g *Gateway) listResources(w http.ResponseWriter, r *http.Request) {
 	rsp := apiutil.ApiResponse{}
 
-	rsp.Data = g.prm.GetResources()
+	ress := g.prm.GetResources()
+	data := make([]resourceWithHealth, 0, len(ress))
+	for _, res := range ress {
+		data = append(data, resourceWithHealth{
+			PortmapResource: res,
+			Health:          g.hc.get(res.ID),
+		})
+	}
+	rsp.Data = data
 	rsp.Message = "ok"
 	apiutil.SendAPIRespWithOk(w, rsp)
 }
 
+type resourceWithHealth struct {
+	PortmapResource
+	Health *TargetHealth `json:"health,omitempty"`
+}
+
 func (g *Gateway) getResource(w http.ResponseWriter, r *http.Request) {
 	rsp := apiutil.ApiResponse{}
 	idStr := chi.URLParam(r, "id")
@@ -1061,6 +1156,12 @@ func (g *Gateway) addResource(w http.ResponseWriter, r *http.Request) {
 		apiutil.SendAPIRespWithOk(w, rsp)
 		return
 	}
+	if err := validatePortmapResource(&pa); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
 	pa.ID = types.ID(rand.Uint64())
 	if err = g.prm.AddPortmapRes(&pa); err != nil {
 		rsp.Code = 500
@@ -1178,15 +1279,39 @@ func validatePortmapResource(res *PortmapResource) error {
 	if res.Network != "tcp" && res.Network != "udp" {
 		return errors.New("invalid network type, must be tcp or udp")
 	}
+	if res.HealthPath != "" && !strings.HasPrefix(res.HealthPath, "/") {
+		return errors.New("health path must start with /")
+	}
+	switch res.Type {
+	case PortmapResTypeRaw:
+	case PortmapResTypeHTTP:
+		if res.Network != "tcp" {
+			return errors.New("http resource must be tcp")
+		}
+		return validateHTTPRoutes(res.HTTPRoutes)
+	default:
+		return errors.New("invalid resource type")
+	}
 	if res.TargetAddr == "" {
 		return errors.New("target address is required")
 	}
-	if res.TargetPort <= 0 || res.TargetPort > 65535 {
+	if res.TargetPorts != "" {
+		if err := res.parsePorts(); err != nil {
+			return err
+		}
+		if res.TargetPort != 0 && !res.HasTargetPort(res.TargetPort) {
+			return errors.New("target port not in port list")
+		}
+	} else if res.TargetPort <= 0 || res.TargetPort > 65535 {
 		return errors.New("invalid target port")
 	}
 	if res.LocalPort > 0 && res.LocalPort > 65535 {
 		return errors.New("invalid local port")
 	}
+	// 本地地址可以是IPv4、IPv6(可带方括号)，为空时监听双栈
+	if res.LocalIP != "" && net.ParseIP(strings.Trim(res.LocalIP, "[]")) == nil {
+		return errors.New("invalid local ip")
+	}
 	return nil
 }
 
@@ -1231,17 +1356,35 @@ func (g *Gateway) setToken(t uint64) error {
 	return g.db.Put([]byte(dbKeyToken), []byte(ts), nil)
 }
 
+// getReverseToken 反向映射注册使用的token，和代理授权的token分开，持有代理token的agent不能在网关上监听端口
+func (g *Gateway) getReverseToken() (uint64, error) {
+	v, err := g.db.Get([]byte(dbKeyReverseToken), nil)
+	if err != nil {
+		if err != leveldb.ErrNotFound {
+			return 0, err
+		}
+		t := rand.Uint64()
+		err = g.db.Put([]byte(dbKeyReverseToken), []byte(strconv.FormatUint(t, 10)), nil)
+		if err != nil {
+			return 0, err
+		}
+		return t, nil
+	}
+	return strconv.ParseUint(string(v), 10, 64)
+}
+
 var (
 	gGW    *Gateway
 	gwOnce sync.Once
 )
 
 type GatewayInfo struct {
-	P2PID   string   `json:"p2p_id"`
-	Token   types.ID `json:"token"`
-	Name    string   `json:"name"`
-	Port    int      `json:"running_port"`
-	Version string   `json:"version"`
+	P2PID        string   `json:"p2p_id"`
+	Token        types.ID `json:"token"`
+	ReverseToken types.ID `json:"reverse_token"`
+	Name         string   `json:"name"`
+	Port         int      `json:"running_port"`
+	Version      string   `json:"version"`
 }
 
 func Instance() *Gateway {
@@ -1311,12 +1454,21 @@ func (g *Gateway) getGatewayInfo(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	reverseToken, err := g.getReverseToken()
+	if err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
 	info := GatewayInfo{
-		P2PID:   g.pe.Libp2pHost().ID().String(),
-		Token:   types.ID(token),
-		Name:    name,
-		Port:    g.pe.GetListenPort(),
-		Version: common.GatewayVersion,
+		P2PID:        g.pe.Libp2pHost().ID().String(),
+		Token:        types.ID(token),
+		ReverseToken: types.ID(reverseToken),
+		Name:         name,
+		Port:         g.pe.GetListenPort(),
+		Version:      common.GatewayVersion,
 	}
 
 	rsp.Data = info
@@ -1493,6 +1645,121 @@ func (g *Gateway) deleteOutbound(w http.ResponseWriter, r *http.Request) {
 	apiutil.SendAPIRespWithOk(w, rsp)
 }
 
+func (g *Gateway) listProxyClientRoutes(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	rsp.Data = g.proxyCli.ListRoutes()
+	rsp.Message = "ok"
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (g *Gateway) getProxyClientHTTP(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	rsp.Data = g.proxyCli.GetHTTPConfig()
+	rsp.Message = "ok"
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (g *Gateway) setProxyClientHTTP(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
+	var req proxyHTTPConfig
+	if err = json.Unmarshal(body, &req); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
+	if err = g.proxyCli.SetHTTPConfig(req); err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
+	rsp.Message = "ok"
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (g *Gateway) getProxyClientDomain(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	rsp.Data = g.proxyCli.GetDomainConfig()
+	rsp.Message = "ok"
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (g *Gateway) setProxyClientDomain(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
+	var req proxyDomainConfig
+	if err = json.Unmarshal(body, &req); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
+	if err = g.proxyCli.SetDomainConfig(req); err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
+	rsp.Message = "ok"
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (g *Gateway) getProxyClientDNS(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	rsp.Data = g.proxyCli.GetDNSConfig()
+	rsp.Message = "ok"
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (g *Gateway) setProxyClientDNS(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
+	var req proxyDNSConfig
+	if err = json.Unmarshal(body, &req); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
+	if err = g.proxyCli.SetDNSConfig(req); err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+
+	rsp.Message = "ok"
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
 func (g *Gateway) updateGatewayName(w http.ResponseWriter, r *http.Request) {
 	rsp := apiutil.ApiResponse{}
 
@@ -0,0 +1,244 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/store"
+	"github.com/isletnet/uptp/types"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	healthCheckInterval = 30 * time.Second
+	healthCheckTimeout  = 3 * time.Second
+	healthHistorySize   = 20
+	prefixHealth        = "health"
+)
+
+const (
+	HealthStatusUnknown = "unknown"
+	HealthStatusUp      = "up"
+	HealthStatusDown    = "down"
+)
+
+type HealthSample struct {
+	Time      int64 `json:"time"`
+	Up        bool  `json:"up"`
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// TargetHealth 资源目标的探测状态，History按时间顺序保存最近的探测结果，每轮探测后写入数据库，重启后保留
+type TargetHealth struct {
+	Status    string         `json:"status"`
+	LatencyMs int64          `json:"latency_ms"`
+	Err       string         `json:"err,omitempty"`
+	CheckedAt int64          `json:"checked_at"`
+	History   []HealthSample `json:"history,omitempty"`
+}
+
+type healthChecker struct {
+	db           *leveldb.DB
+	getResources func() []PortmapResource
+
+	mtx    sync.Mutex
+	status map[types.ID]*TargetHealth
+
+	exitCh chan struct{}
+	once   sync.Once
+	client *http.Client
+}
+
+func newHealthChecker(db *leveldb.DB, getResources func() []PortmapResource) (*healthChecker, error) {
+	hc := &healthChecker{
+		db:           db,
+		getResources: getResources,
+		status:       make(map[types.ID]*TargetHealth),
+		exitCh:       make(chan struct{}),
+		client: &http.Client{
+			Timeout: healthCheckTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	err := store.LoadRecords(db, prefixHealth, func(id types.ID, th *TargetHealth) {
+		hc.status[id] = th
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+func (hc *healthChecker) start() {
+	go func() {
+		tk := time.NewTicker(healthCheckInterval)
+		defer tk.Stop()
+		for {
+			hc.checkAll()
+			select {
+			case <-hc.exitCh:
+				return
+			case <-tk.C:
+			}
+		}
+	}()
+}
+
+func (hc *healthChecker) stop() {
+	hc.once.Do(func() {
+		close(hc.exitCh)
+	})
+}
+
+func (hc *healthChecker) get(id types.ID) *TargetHealth {
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	th, ok := hc.status[id]
+	if !ok {
+		return nil
+	}
+	ret := *th
+	ret.History = append([]HealthSample(nil), th.History...)
+	return &ret
+}
+
+func (hc *healthChecker) checkAll() {
+	ress := hc.getResources()
+	alive := make(map[types.ID]bool, len(ress))
+	var wg sync.WaitGroup
+	for _, res := range ress {
+		alive[res.ID] = true
+		wg.Add(1)
+		go func(res PortmapResource) {
+			defer wg.Done()
+			hc.check(&res)
+		}(res)
+	}
+	wg.Wait()
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	err := store.Update(hc.db, func(b *leveldb.Batch) error {
+		for id, th := range hc.status {
+			if !alive[id] {
+				delete(hc.status, id)
+				store.DeleteRecord(b, prefixHealth, id)
+				continue
+			}
+			if err := store.PutRecord(b, prefixHealth, id, th); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Error("save health check history error: %s", err)
+	}
+}
+
+func (hc *healthChecker) check(res *PortmapResource) {
+	begin := time.Now()
+	status, err := hc.probe(res)
+	latency := time.Since(begin).Milliseconds()
+
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	th, ok := hc.status[res.ID]
+	if !ok {
+		th = &TargetHealth{}
+		hc.status[res.ID] = th
+	}
+	th.Status = status
+	th.CheckedAt = begin.Unix()
+	th.Err = ""
+	th.LatencyMs = 0
+	if err != nil {
+		th.Err = err.Error()
+	}
+	if status == HealthStatusUnknown {
+		return
+	}
+	if status == HealthStatusUp {
+		th.LatencyMs = latency
+	}
+	th.History = append(th.History, HealthSample{
+		Time:      th.CheckedAt,
+		Up:        status == HealthStatusUp,
+		LatencyMs: th.LatencyMs,
+	})
+	if len(th.History) > healthHistorySize {
+		th.History = th.History[len(th.History)-healthHistorySize:]
+	}
+}
+
+// probe TCP资源探测连接，配置了HealthPath时额外发送HTTP GET，UDP无法探测
+func (hc *healthChecker) probe(res *PortmapResource) (string, error) {
+	if res.Type == PortmapResTypeHTTP {
+		return hc.probeRoutes(res.HTTPRoutes, res.HealthPath)
+	}
+	if res.Network != "tcp" {
+		return HealthStatusUnknown, nil
+	}
+	port := res.TargetPort
+	if port == 0 && len(res.targetPorts) > 0 {
+		port = res.targetPorts[0]
+	}
+	addr := net.JoinHostPort(strings.Trim(res.TargetAddr, "[]"), strconv.Itoa(port))
+	if res.HealthPath != "" {
+		return hc.probeHTTP("http://"+addr, res.HealthPath)
+	}
+	conn, err := net.DialTimeout("tcp", addr, healthCheckTimeout)
+	if err != nil {
+		return HealthStatusDown, err
+	}
+	conn.Close()
+	return HealthStatusUp, nil
+}
+
+// probeRoutes 探测HTTP资源的每个转发目标，任一目标不可用时资源为down
+func (hc *healthChecker) probeRoutes(routes []HTTPRoute, path string) (string, error) {
+	status := HealthStatusUnknown
+	seen := make(map[string]bool, len(routes))
+	for _, r := range routes {
+		if seen[r.Target] {
+			continue
+		}
+		seen[r.Target] = true
+		s, err := hc.probeHTTP(r.Target, path)
+		if s == HealthStatusDown {
+			return s, fmt.Errorf("%s: %w", r.Target, err)
+		}
+		if s == HealthStatusUp {
+			status = s
+		}
+	}
+	return status, nil
+}
+
+func (hc *healthChecker) probeHTTP(target, path string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return HealthStatusUnknown, err
+	}
+	if path != "" {
+		u.Path = path
+	}
+	rsp, err := hc.client.Get(u.String())
+	if err != nil {
+		return HealthStatusDown, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= http.StatusInternalServerError {
+		return HealthStatusDown, errors.New("http status " + rsp.Status)
+	}
+	return HealthStatusUp, nil
+}
@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthCheckRoutes(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	ress := []PortmapResource{{
+		ID:   1,
+		Type: PortmapResTypeHTTP,
+		HTTPRoutes: []HTTPRoute{
+			{PathPrefix: "/a", Target: up.URL},
+			{PathPrefix: "/b", Target: down.URL},
+		},
+	}}
+	db := memDB(t)
+	hc, err := newHealthChecker(db, func() []PortmapResource { return ress })
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.checkAll()
+	// 第一个路由可用时仍然要探测后面的路由
+	th := hc.get(1)
+	if th == nil || th.Status != HealthStatusDown || !strings.Contains(th.Err, down.URL) {
+		t.Fatalf("health = %+v", th)
+	}
+
+	ress[0].HTTPRoutes = ress[0].HTTPRoutes[:1]
+	hc.checkAll()
+	if th := hc.get(1); th.Status != HealthStatusUp || len(th.History) != 2 {
+		t.Errorf("health = %+v", th)
+	}
+
+	// 探测历史在重启后保留
+	hc2, err := newHealthChecker(db, func() []PortmapResource { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th := hc2.get(1); th == nil || th.Status != HealthStatusUp || len(th.History) != 2 {
+		t.Fatalf("reloaded health = %+v", th)
+	}
+	hc2.checkAll()
+	if hc2.get(1) != nil {
+		t.Error("deleted resource health not removed")
+	}
+	if hc3, _ := newHealthChecker(db, func() []PortmapResource { return nil }); hc3.get(1) != nil {
+		t.Error("deleted resource health still stored")
+	}
+}
@@ -0,0 +1,258 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/types"
+)
+
+const (
+	PortmapResTypeRaw  = 0
+	PortmapResTypeHTTP = 1
+)
+
+const (
+	portmapNetworkHTTP = "http"
+)
+
+// HTTPRoute HTTP资源的路由规则，按Host和路径前缀匹配内部站点，
+// 网关只知道请求来自哪个agent，看不到客户端的地址，转发时不设置X-Forwarded-For
+type HTTPRoute struct {
+	Host       string            `json:"host"` // 为空匹配所有Host，支持"*.example.com"
+	PathPrefix string            `json:"path_prefix"`
+	Target     string            `json:"target"` // 如"http://10.0.0.2:8080"
+	KeepHost   bool              `json:"keep_host"`
+	SetHeaders map[string]string `json:"set_headers,omitempty"`
+	DelHeaders []string          `json:"del_headers,omitempty"`
+}
+
+func validateHTTPRoutes(routes []HTTPRoute) error {
+	if len(routes) == 0 {
+		return errors.New("http routes is required")
+	}
+	for _, r := range routes {
+		u, err := url.Parse(r.Target)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("invalid route target: " + r.Target)
+		}
+		if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+			return errors.New("path prefix must start with /")
+		}
+	}
+	return nil
+}
+
+// matchHTTPRoute 精确Host优先于通配Host，通配Host优先于空Host，同级取最长路径前缀
+func matchHTTPRoute(routes []HTTPRoute, host, path string) *HTTPRoute {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	var ret *HTTPRoute
+	bestHost, bestPath := -1, -1
+	for i := range routes {
+		r := &routes[i]
+		hostScore := -1
+		rh := strings.ToLower(r.Host)
+		switch {
+		case rh == "":
+			hostScore = 0
+		case strings.HasPrefix(rh, "*."):
+			if strings.HasSuffix(host, rh[1:]) {
+				hostScore = 1
+			}
+		case rh == host:
+			hostScore = 2
+		}
+		if hostScore < 0 || !strings.HasPrefix(path, r.PathPrefix) {
+			continue
+		}
+		if hostScore > bestHost || (hostScore == bestHost && len(r.PathPrefix) > bestPath) {
+			ret = r
+			bestHost = hostScore
+			bestPath = len(r.PathPrefix)
+		}
+	}
+	return ret
+}
+
+type ctxKeyResID struct{}
+
+type resConn struct {
+	net.Conn
+	resID types.ID
+}
+
+// streamListener 把portmap转交的stream作为连接提供给http.Server
+type streamListener struct {
+	connCh chan net.Conn
+	once   sync.Once
+	exitCh chan struct{}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connCh:
+		return c, nil
+	case <-l.exitCh:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.once.Do(func() {
+		close(l.exitCh)
+	})
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+type httpProxy struct {
+	ln        *streamListener
+	server    *http.Server
+	transport *http.Transport
+	getRes    func(types.ID) PortmapResource
+}
+
+func newHTTPProxy(getRes func(types.ID) PortmapResource) *httpProxy {
+	hp := &httpProxy{
+		ln: &streamListener{
+			connCh: make(chan net.Conn),
+			exitCh: make(chan struct{}),
+		},
+		transport: http.DefaultTransport.(*http.Transport).Clone(),
+		getRes:    getRes,
+	}
+	hp.server = &http.Server{
+		Handler:           hp,
+		ReadHeaderTimeout: time.Minute,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if rc, ok := c.(*resConn); ok {
+				return context.WithValue(ctx, ctxKeyResID{}, rc.resID)
+			}
+			return ctx
+		},
+	}
+	return hp
+}
+
+func (hp *httpProxy) start() {
+	go func() {
+		err := hp.server.Serve(hp.ln)
+		if err != nil && err != http.ErrServerClosed {
+			logging.Error("http proxy serve error: %s", err)
+		}
+	}()
+}
+
+func (hp *httpProxy) stop() {
+	hp.server.Close()
+	hp.transport.CloseIdleConnections()
+}
+
+// handleConn portmap的ConnHandler，addr为资源ID
+func (hp *httpProxy) handleConn(conn net.Conn, addr string, port int) {
+	resID, err := strconv.ParseUint(addr, 10, 64)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case hp.ln.connCh <- &resConn{Conn: conn, resID: types.ID(resID)}:
+	case <-hp.ln.exitCh:
+		conn.Close()
+	}
+}
+
+func (hp *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	resID, _ := r.Context().Value(ctxKeyResID{}).(types.ID)
+	res := hp.getRes(resID)
+	var route *HTTPRoute
+	if res.ID != 0 && res.Type == PortmapResTypeHTTP {
+		route = matchHTTPRoute(res.HTTPRoutes, r.Host, r.URL.Path)
+	}
+	target := "-"
+	if route == nil {
+		http.Error(rec, "no route", http.StatusNotFound)
+	} else if u, err := url.Parse(route.Target); err != nil {
+		http.Error(rec, "bad route target", http.StatusBadGateway)
+	} else {
+		target = route.Target
+		rp := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(u)
+				// RemoteAddr是agent的peer ID，SetXForwarded只设置X-Forwarded-Host和X-Forwarded-Proto
+				pr.SetXForwarded()
+				if route.KeepHost {
+					pr.Out.Host = pr.In.Host
+				}
+				for _, h := range route.DelHeaders {
+					pr.Out.Header.Del(h)
+				}
+				for k, v := range route.SetHeaders {
+					pr.Out.Header.Set(k, v)
+				}
+			},
+			Transport: hp.transport,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				logging.Error("http proxy %s to %s error: %s", r.Host, route.Target, err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}
+		rp.ServeHTTP(rec, r)
+	}
+	// 访问日志，记录的是agent的peer ID
+	logging.Info("[http] %s peer %s %s %s %d %d %s -> %s", res.Name, r.RemoteAddr, r.Method, r.Host+r.URL.RequestURI(), rec.status, rec.size, time.Since(start), target)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(b)
+	sr.size += n
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack WebSocket升级需要接管连接
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
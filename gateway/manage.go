@@ -0,0 +1,475 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	apiutil "github.com/isletnet/uptp/apiutil.go"
+	"github.com/isletnet/uptp/common"
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/store"
+	"github.com/isletnet/uptp/types"
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	p2phttp "github.com/libp2p/go-libp2p-http"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// 远程管理：网关给管理网关的peer ID签发凭证，管理网关通过libp2p上的HTTP调用管理接口，
+// 不需要在被管理网关的网络上暴露3000端口
+const (
+	ManageProtocolID = "/uptp/manage/1.0.0"
+)
+
+const (
+	ManageScopeRead    = "read"    // 查看状态和资源
+	ManageScopeWrite   = "write"   // 增删改资源
+	ManageScopeUpgrade = "upgrade" // 升级和重启
+)
+
+const (
+	prefixManageCred    = "manage_cred"
+	prefixRemoteGateway = "remote_gateway"
+)
+
+// ManageCredential 签发给管理网关的凭证，只有PeerID对应的节点可以使用
+type ManageCredential struct {
+	ID        types.ID `json:"id"`
+	Name      string   `json:"name"`
+	PeerID    string   `json:"peer_id"`
+	Token     types.ID `json:"token"`
+	Scopes    []string `json:"scopes"`
+	ExpireAt  int64    `json:"expire_at,omitempty"` // 为0时不过期
+	CreatedAt int64    `json:"created_at"`
+}
+
+func (c *ManageCredential) allow(scope string) bool {
+	return slices.Contains(c.Scopes, scope)
+}
+
+// RemoteGateway 本网关可以管理的远程网关
+type RemoteGateway struct {
+	ID     types.ID `json:"id"`
+	Name   string   `json:"name"`
+	PeerID string   `json:"peer_id"`
+	Token  types.ID `json:"token"`
+}
+
+// ManageStatus 远程管理查看的网关状态
+type ManageStatus struct {
+	P2PID     string `json:"p2p_id"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Uptime    int64  `json:"uptime"`
+	Resources int    `json:"resources"`
+	Apps      int    `json:"apps"`
+	Outbounds int    `json:"outbounds"`
+	Peers     int    `json:"peers"`
+}
+
+type manageMgr struct {
+	db *leveldb.DB
+
+	mtx     sync.Mutex
+	creds   map[types.ID]ManageCredential
+	remotes map[types.ID]RemoteGateway
+}
+
+func newManageMgr(db *leveldb.DB) (*manageMgr, error) {
+	m := &manageMgr{
+		db:      db,
+		creds:   make(map[types.ID]ManageCredential),
+		remotes: make(map[types.ID]RemoteGateway),
+	}
+	err := store.LoadRecords(db, prefixManageCred, func(id types.ID, c *ManageCredential) {
+		m.creds[id] = *c
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = store.LoadRecords(db, prefixRemoteGateway, func(id types.ID, rg *RemoteGateway) {
+		m.remotes[id] = *rg
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// check 校验凭证，token要和请求方的peer ID匹配
+func (m *manageMgr) check(peerID string, token types.ID) *ManageCredential {
+	// 去密钥导入的凭证没有token
+	if token == 0 {
+		return nil
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := time.Now().Unix()
+	for _, c := range m.creds {
+		if c.PeerID == peerID && c.Token == token && (c.ExpireAt == 0 || c.ExpireAt > now) {
+			return &c
+		}
+	}
+	return nil
+}
+
+func (m *manageMgr) addCred(c *ManageCredential) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.creds[c.ID] = *c
+	return store.Update(m.db, func(b *leveldb.Batch) error {
+		return store.PutRecord(b, prefixManageCred, c.ID, c)
+	})
+}
+
+func (m *manageMgr) delCred(id types.ID) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.creds, id)
+	return store.Update(m.db, func(b *leveldb.Batch) error {
+		store.DeleteRecord(b, prefixManageCred, id)
+		return nil
+	})
+}
+
+func (m *manageMgr) listCreds() []ManageCredential {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ret := make([]ManageCredential, 0, len(m.creds))
+	for _, c := range m.creds {
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+func (m *manageMgr) addRemote(rg *RemoteGateway) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.remotes[rg.ID] = *rg
+	return store.Update(m.db, func(b *leveldb.Batch) error {
+		return store.PutRecord(b, prefixRemoteGateway, rg.ID, rg)
+	})
+}
+
+func (m *manageMgr) delRemote(id types.ID) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.remotes, id)
+	return store.Update(m.db, func(b *leveldb.Batch) error {
+		store.DeleteRecord(b, prefixRemoteGateway, id)
+		return nil
+	})
+}
+
+func (m *manageMgr) getRemote(id types.ID) *RemoteGateway {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	rg, ok := m.remotes[id]
+	if !ok {
+		return nil
+	}
+	return &rg
+}
+
+func (m *manageMgr) listRemotes() []RemoteGateway {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ret := make([]RemoteGateway, 0, len(m.remotes))
+	for _, rg := range m.remotes {
+		ret = append(ret, rg)
+	}
+	return ret
+}
+
+// randomID 凭证的token用于鉴权，需要使用crypto/rand
+func randomID() (types.ID, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return types.ID(binary.BigEndian.Uint64(b[:])), nil
+}
+
+// startManage 在libp2p上提供远程管理接口
+func (g *Gateway) startManage() error {
+	ln, err := gostream.Listen(g.pe.Libp2pHost(), ManageProtocolID)
+	if err != nil {
+		return err
+	}
+	g.manageListener = ln
+	tr := &http.Transport{}
+	tr.RegisterProtocol("libp2p", p2phttp.NewTransport(g.pe.Libp2pHost(), p2phttp.ProtocolOption(ManageProtocolID)))
+	// 升级需要下载新版本，超时时间要足够长
+	g.manageCli = &http.Client{Transport: tr, Timeout: 2 * time.Minute}
+	ser := apiutil.NewApiServer()
+	ser.Use(g.manageAuth)
+	ser.AddRoute("/", func(r chi.Router) {
+		r.Get("/status", g.manageStatus)
+		r.Post("/upgrade", g.upgradeMyself)
+		r.Post("/restart", func(w http.ResponseWriter, r *http.Request) {
+			apiutil.SendAPIRespWithOk(w, apiutil.ApiResponse{})
+			g.sendExitSignal()
+		})
+	})
+	ser.AddRoute("/resource", func(r chi.Router) {
+		r.Get("/list", g.listResources)
+		r.Get("/get/{id}", g.getResource)
+		r.Post("/add", g.addResource)
+		r.Post("/update", g.updateResource)
+		r.Post("/delete", g.deleteResource)
+	})
+	go func() {
+		err := ser.Serve(ln)
+		if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			logging.Error("manage server error: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (g *Gateway) stopManage() {
+	if g.manageListener != nil {
+		g.manageListener.Close()
+	}
+	if g.manageCli != nil {
+		g.manageCli.CloseIdleConnections()
+	}
+}
+
+// manageAuth 请求的RemoteAddr是对端的peer ID，GET需要read权限，其他需要write权限，升级和重启需要upgrade权限
+func (g *Gateway) manageAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := strconv.ParseUint(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), 10, 64)
+		var cred *ManageCredential
+		if err == nil {
+			cred = g.mm.check(r.RemoteAddr, types.ID(token))
+		}
+		if cred == nil {
+			logging.Warn("manage request from %s unauthorized", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		scope := ManageScopeRead
+		if r.URL.Path == "/upgrade" || r.URL.Path == "/restart" {
+			scope = ManageScopeUpgrade
+		} else if r.Method != http.MethodGet {
+			scope = ManageScopeWrite
+		}
+		if !cred.allow(scope) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		logging.Info("manage %s %s by %s(%s)", r.Method, r.URL.Path, cred.Name, r.RemoteAddr)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (g *Gateway) manageStatus(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	name, _ := g.getGatewayName()
+	rsp.Data = ManageStatus{
+		P2PID:     g.pe.Libp2pHost().ID().String(),
+		Name:      name,
+		Version:   common.GatewayVersion,
+		Uptime:    int64(time.Since(g.startTime).Seconds()),
+		Resources: len(g.prm.GetResources()),
+		Apps:      len(g.pam.GetPortmapApps()),
+		Outbounds: len(g.proxyCli.ListOutbounds()),
+		Peers:     len(g.pe.Libp2pHost().Network().Peers()),
+	}
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (g *Gateway) listManageCreds(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	rsp.Data = g.mm.listCreds()
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+// addManageCred 签发凭证，返回的token需要填到管理网关上
+func (g *Gateway) addManageCred(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	var c ManageCredential
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	if _, err := peer.Decode(c.PeerID); err != nil {
+		rsp.Code = 400
+		rsp.Message = "invalid peer id"
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	for _, s := range c.Scopes {
+		if s != ManageScopeRead && s != ManageScopeWrite && s != ManageScopeUpgrade {
+			rsp.Code = 400
+			rsp.Message = fmt.Sprintf("invalid scope %q", s)
+			apiutil.SendAPIRespWithOk(w, rsp)
+			return
+		}
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{ManageScopeRead}
+	}
+	var err error
+	c.ID, err = randomID()
+	if err == nil {
+		c.Token, err = randomID()
+	}
+	if err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	c.CreatedAt = time.Now().Unix()
+	if err := g.mm.addCred(&c); err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	rsp.Data = c
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (g *Gateway) deleteManageCred(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	var req struct {
+		ID types.ID `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	if err := g.mm.delCred(req.ID); err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+	}
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (g *Gateway) listRemoteGateways(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	rsp.Data = g.mm.listRemotes()
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+// addRemoteGateway 添加前先用凭证查询一次远程网关的状态
+func (g *Gateway) addRemoteGateway(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	var rg RemoteGateway
+	if err := json.NewDecoder(r.Body).Decode(&rg); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	if _, err := peer.Decode(rg.PeerID); err != nil {
+		rsp.Code = 400
+		rsp.Message = "invalid peer id"
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	resp, err := g.remoteRequest(&rg, http.MethodGet, "/status", nil)
+	if err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	var st ManageStatus
+	if err := apiutil.ParseHttpResponse(resp, &st); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	if rg.Name == "" {
+		rg.Name = st.Name
+	}
+	rg.ID, err = randomID()
+	if err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	if err := g.mm.addRemote(&rg); err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	rsp.Data = rg
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+func (g *Gateway) deleteRemoteGateway(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+	var req struct {
+		ID types.ID `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rsp.Code = 400
+		rsp.Message = err.Error()
+		apiutil.SendAPIRespWithOk(w, rsp)
+		return
+	}
+	if err := g.mm.delRemote(req.ID); err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+	}
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
+
+// proxyRemoteGateway 把/remote/{id}/后面的路径转发到远程网关的管理接口
+func (g *Gateway) proxyRemoteGateway(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	var rg *RemoteGateway
+	if err == nil {
+		rg = g.mm.getRemote(types.ID(id))
+	}
+	if rg == nil {
+		apiutil.SendAPIRespWithOk(w, apiutil.ApiResponse{Code: 404, Message: "remote gateway not found"})
+		return
+	}
+	path := "/" + chi.URLParam(r, "*")
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	resp, err := g.remoteRequest(rg, r.Method, path, r.Body)
+	if err != nil {
+		logging.Error("request remote gateway %s error: %s", rg.PeerID, err)
+		apiutil.SendAPIRespWithOk(w, apiutil.ApiResponse{Code: 502, Message: err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+	transferHTTP(w, resp)
+}
+
+func (g *Gateway) remoteRequest(rg *RemoteGateway, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, "libp2p://"+rg.PeerID+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+rg.Token.String())
+	req.Header.Set("Content-Type", "application/json")
+	return g.manageCli.Do(req)
+}
@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestManageAuth(t *testing.T) {
+	mm, err := newManageMgr(memDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm.addCred(&ManageCredential{ID: 1, PeerID: "peerA", Token: 42, Scopes: []string{ManageScopeRead}})
+	mm.addCred(&ManageCredential{ID: 2, PeerID: "peerB", Token: 43, Scopes: []string{ManageScopeRead, ManageScopeWrite}, ExpireAt: time.Now().Add(-time.Hour).Unix()})
+	g := &Gateway{mm: mm}
+	h := g.manageAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, c := range []struct {
+		method, path, peer, token string
+		code                      int
+	}{
+		{http.MethodGet, "/status", "peerA", "42", http.StatusOK},
+		{http.MethodGet, "/status", "peerC", "42", http.StatusUnauthorized},
+		{http.MethodGet, "/status", "peerA", "41", http.StatusUnauthorized},
+		{http.MethodPost, "/resource/add", "peerA", "42", http.StatusForbidden},
+		{http.MethodPost, "/upgrade", "peerA", "42", http.StatusForbidden},
+		{http.MethodGet, "/status", "peerB", "43", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		r.RemoteAddr = c.peer
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s %s by %s: code %d, want %d", c.method, c.path, c.peer, w.Code, c.code)
+		}
+	}
+}
+
+func TestConsoleAuth(t *testing.T) {
+	mm, err := newManageMgr(memDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm.addCred(&ManageCredential{ID: 1, PeerID: "peerA", Token: 42, Scopes: []string{ManageScopeRead}})
+	mm.addCred(&ManageCredential{ID: 2, PeerID: "peerB", Token: 43, Scopes: []string{ManageScopeRead, ManageScopeWrite}})
+	g := &Gateway{mm: mm}
+	h := g.consoleAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, c := range []struct {
+		path, peer, token string
+		code              int
+	}{
+		{"/resource/list", "peerB", "43", http.StatusOK},
+		{"/resource/list", "peerB", "", http.StatusUnauthorized},
+		{"/resource/list", "peerA", "43", http.StatusUnauthorized},
+		{"/resource/list", "peerA", "42", http.StatusForbidden},
+		{"/gateway/restart", "peerB", "43", http.StatusForbidden},
+		{"/manage/credential/add", "peerB", "43", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		r.RemoteAddr = c.peer
+		r.Header.Set(ConsoleTokenHeader, c.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s by %s: code %d, want %d", c.path, c.peer, w.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"github.com/isletnet/uptp/store"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// 集合类数据每条记录一个key，格式为<prefix>/<id>
+const (
+	prefixResource = "resource"
+	prefixApp      = "app"
+	prefixOutbound = "outbound"
+)
+
+// gatewayMigrations 只能在末尾追加，已发布的升级不能修改
+var gatewayMigrations = []store.Migration{
+	{Version: 1, Name: "split collections into records", Run: func(db *leveldb.DB, b *leveldb.Batch) error {
+		if err := store.SplitMapBlob(db, b, "portmap_resources", prefixResource); err != nil {
+			return err
+		}
+		if err := MigratePortmapApps(db, b); err != nil {
+			return err
+		}
+		return store.SplitMapBlob(db, b, "socks_outbound", prefixOutbound)
+	}},
+}
+
+// MigratePortmapApps 把旧版本整体保存的portmap_apps拆成单条记录，agent也使用PortmapAppMgr
+func MigratePortmapApps(db *leveldb.DB, b *leveldb.Batch) error {
+	return store.SplitMapBlob(db, b, "portmap_apps", prefixApp)
+}
+
+// openDB 打开数据库并升级到当前版本
+func openDB(path string, o *opt.Options) (*leveldb.DB, error) {
+	if o == nil {
+		o = &opt.Options{}
+	}
+	db, err := leveldb.OpenFile(path, o)
+	if errors.IsCorrupted(err) && !o.GetReadOnly() {
+		db, err = leveldb.RecoverFile(path, o)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Migrate(db, gatewayMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -2,30 +2,222 @@ package gateway
 
 import (
 	"encoding/json"
+	"errors"
+	"slices"
 	"sync"
 
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/portmap"
+	"github.com/isletnet/uptp/store"
 	"github.com/isletnet/uptp/types"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
-var (
-	keyPortmapApps = []byte("portmap_apps")
-)
-
 type PortmapApp struct {
-	ID         types.ID `json:"id"`
-	Name       string   `json:"name"`
-	PeerID     string   `json:"peer_id"`
-	ResID      types.ID `json:"res_id"`
-	Network    string   `json:"network"`
-	LocalIP    string   `json:"local_ip"`
-	LocalPort  int      `json:"local_port"`
-	TargetAddr string   `json:"target_addr"`
-	TargetPort int      `json:"target_port"`
-	Running    bool     `json:"running"`
+	ID          types.ID     `json:"id"`
+	Name        string       `json:"name"`
+	PeerID      string       `json:"peer_id"`
+	BackupPeers []BackupPeer `json:"backup_peers,omitempty"` // 提供相同资源的其他网关
+	Policy      string       `json:"policy,omitempty"`       // 多网关时的均衡策略，默认主备
+	ResID       types.ID     `json:"res_id"`
+	Network     string       `json:"network"`
+	LocalIP     string       `json:"local_ip"`
+	LocalPort   int          `json:"local_port"`
+	LocalPorts  string       `json:"local_ports,omitempty"` // 与TargetPorts按位置一一对应的本地端口
+	TargetAddr  string       `json:"target_addr"`
+	TargetPort  int          `json:"target_port"`
+	TargetPorts string       `json:"target_ports,omitempty"` // 资源授权时返回的端口列表
+	Running     bool         `json:"running"`
+	Reverse     bool         `json:"reverse,omitempty"` // 由agent注册的反向映射，PeerID为agent
+
+	PeerName      string `json:"peer_name"`
+	TargetStatus  string `json:"target_status,omitempty"` // 授权时网关探测到的目标状态
+	TargetLatency int64  `json:"target_latency,omitempty"`
+	Err           string `json:"-"`
+
+	// LocalPorts和TargetPorts解析后的端口，保存和加载时生成，避免每个连接重新解析
+	localPorts  []int
+	targetPorts []int
+}
+
+// BackupPeer 备用网关，资源ID由各网关分别生成，需要使用备用网关上的资源ID
+type BackupPeer struct {
+	PeerID       string   `json:"peer_id"`
+	ResID        types.ID `json:"res_id"`
+	TargetStatus string   `json:"target_status,omitempty"` // 授权时备用网关探测到的目标状态
+}
+
+// SameBackupPeers 只比较网关和资源ID，目标状态不同不需要重新授权
+func SameBackupPeers(a, b []BackupPeer) bool {
+	return slices.EqualFunc(a, b, func(x, y BackupPeer) bool {
+		return x.PeerID == y.PeerID && x.ResID == y.ResID
+	})
+}
+
+// SetTargetPorts 设置资源的端口列表，未指定本地端口时监听相同的端口
+func (a *PortmapApp) SetTargetPorts(ports string) error {
+	a.TargetPorts = ports
+	if ports == "" {
+		a.LocalPorts = ""
+		return nil
+	}
+	if a.LocalPorts == "" {
+		a.LocalPorts = ports
+	}
+	return a.parsePorts()
+}
+
+// parsePorts 解析并缓存多端口应用的端口列表
+func (a *PortmapApp) parsePorts() error {
+	a.localPorts, a.targetPorts = nil, nil
+	if a.TargetPorts == "" {
+		return nil
+	}
+	targets, err := ParsePortList(a.TargetPorts)
+	if err != nil {
+		return err
+	}
+	locals, err := ParsePortList(a.LocalPorts)
+	if err != nil {
+		return err
+	}
+	if len(locals) != len(targets) {
+		return errors.New("local ports count not match resource ports")
+	}
+	a.localPorts, a.targetPorts = locals, targets
+	return nil
+}
+
+// Upstream 返回应用可用的所有网关，PeerID排在最前，没有资源ID的备用网关被跳过
+func (a *PortmapApp) Upstream() portmap.Upstream {
+	up := portmap.Upstream{
+		Peers:  []string{a.PeerID},
+		Policy: a.Policy,
+	}
+	targetDown := func(peerID, status string) {
+		if status != HealthStatusDown {
+			return
+		}
+		if up.TargetDown == nil {
+			up.TargetDown = make(map[string]bool)
+		}
+		up.TargetDown[peerID] = true
+	}
+	targetDown(a.PeerID, a.TargetStatus)
+	for _, p := range a.BackupPeers {
+		if p.PeerID != "" && p.ResID != 0 && !slices.Contains(up.Peers, p.PeerID) {
+			up.Peers = append(up.Peers, p.PeerID)
+			targetDown(p.PeerID, p.TargetStatus)
+		}
+	}
+	return up
+}
+
+// Handshake 返回本地端口的网关和握手数据，备用网关的握手使用各自的资源ID
+func (a *PortmapApp) Handshake(localPort int) (up portmap.Upstream, handshake []byte) {
+	hs := PortmapAppHandshake{
+		ResID:      a.ResID,
+		Network:    a.Network,
+		TargetAddr: a.TargetAddr,
+		TargetPort: a.TargetPortFor(localPort),
+	}
+	handshake, err := json.Marshal(hs)
+	if err != nil {
+		return
+	}
+	up = a.Upstream()
+	for _, p := range a.BackupPeers {
+		if p.ResID == 0 || !slices.Contains(up.Peers, p.PeerID) {
+			continue
+		}
+		hs.ResID = p.ResID
+		buf, err := json.Marshal(hs)
+		if err != nil {
+			continue
+		}
+		if up.Handshakes == nil {
+			up.Handshakes = make(map[string][]byte)
+		}
+		up.Handshakes[p.PeerID] = buf
+	}
+	return
+}
+
+// ValidateUpstream 检查备用网关和均衡策略
+func (a *PortmapApp) ValidateUpstream() error {
+	if !portmap.ValidBalancePolicy(a.Policy) {
+		return errors.New("invalid balance policy")
+	}
+	for _, p := range a.BackupPeers {
+		if _, err := peer.Decode(p.PeerID); err != nil {
+			return errors.New("invalid backup peer: " + p.PeerID)
+		}
+		if p.ResID == 0 {
+			return errors.New("backup peer " + p.PeerID + " resource id is required")
+		}
+	}
+	return nil
+}
+
+// LocalPortList 返回应用需要监听的所有本地端口
+func (a *PortmapApp) LocalPortList() []int {
+	if a.LocalPorts == "" {
+		return []int{a.LocalPort}
+	}
+	return a.localPorts
+}
 
-	PeerName string `json:"peer_name"`
-	Err      string `json:"-"`
+// TargetPortFor 返回本地端口对应的目标端口
+func (a *PortmapApp) TargetPortFor(localPort int) int {
+	if a.TargetPorts == "" {
+		return a.TargetPort
+	}
+	if i := slices.Index(a.localPorts, localPort); i >= 0 && i < len(a.targetPorts) {
+		return a.targetPorts[i]
+	}
+	return 0
+}
+
+func (a *PortmapApp) hasLocalPort(port int) bool {
+	for _, p := range a.LocalPortList() {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// AddListeners 监听应用的所有本地端口，失败时关闭已添加的监听
+func (a *PortmapApp) AddListeners(pm *portmap.Portmap) error {
+	ports := a.LocalPortList()
+	if len(ports) == 0 {
+		return errors.New("no local port")
+	}
+	for i, p := range ports {
+		_, err := pm.AddListener(a.Network, a.LocalIP, p)
+		if err != nil {
+			for _, added := range ports[:i] {
+				pm.DeleteListener(a.Network, a.LocalIP, added)
+			}
+			return err
+		}
+	}
+	// 反向映射的对端是agent，只能通过agent建立的连接访问，不需要预连接
+	if !a.Reverse {
+		pm.WarmUp(a.Upstream().Peers)
+	}
+	return nil
+}
+
+// DelListeners 关闭应用的所有本地端口监听
+func (a *PortmapApp) DelListeners(pm *portmap.Portmap) {
+	for _, p := range a.LocalPortList() {
+		pm.DeleteListener(a.Network, a.LocalIP, p)
+	}
+	if !a.Reverse {
+		pm.CoolDown(a.Upstream().Peers)
+	}
 }
 
 type PortmapAppMgr struct {
@@ -45,21 +237,27 @@ func NewPortmapAppMgr(db *leveldb.DB) *PortmapAppMgr {
 func (m *PortmapAppMgr) LoadPortmapApps() ([]PortmapApp, error) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
-	v, err := m.db.Get(keyPortmapApps, nil)
-	if err != nil {
-		if err != leveldb.ErrNotFound {
-			return nil, err
+	m.apps = make(map[uint64]PortmapApp)
+	err := store.LoadRecords(m.db, prefixApp, func(id types.ID, a *PortmapApp) {
+		if err := a.parsePorts(); err != nil {
+			logging.Warn("portmap app %s ports error: %s", a.Name, err)
 		}
-		return nil, nil
-	}
-	err = json.Unmarshal(v, &m.apps)
+		m.apps[id.Uint64()] = *a
+	})
 	if err != nil {
 		return nil, err
 	}
-	return m.GetPortmapApps(), nil
+	return m.portmapApps(), nil
 }
 
 func (m *PortmapAppMgr) GetPortmapApps() []PortmapApp {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.portmapApps()
+}
+
+// portmapApps 调用方需要持有mtx
+func (m *PortmapAppMgr) portmapApps() []PortmapApp {
 	ret := make([]PortmapApp, 0, len(m.apps))
 	for _, v := range m.apps {
 		ret = append(ret, v)
@@ -78,37 +276,43 @@ func (m *PortmapAppMgr) GetPortmapApp(id uint64) *PortmapApp {
 }
 
 func (m *PortmapAppMgr) UpdatePortmapApp(a *PortmapApp) error {
+	if err := a.parsePorts(); err != nil {
+		return err
+	}
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 	m.apps[a.ID.Uint64()] = *a
-	return m.savePortmap()
+	return store.Update(m.db, func(b *leveldb.Batch) error {
+		return store.PutRecord(b, prefixApp, a.ID, a)
+	})
 }
 
 func (m *PortmapAppMgr) DelPortmapApp(id uint64) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 	delete(m.apps, id)
-	return m.savePortmap()
+	return store.Update(m.db, func(b *leveldb.Batch) error {
+		store.DeleteRecord(b, prefixApp, types.ID(id))
+		return nil
+	})
 }
 
-func (m *PortmapAppMgr) savePortmap() error {
-	if m.apps == nil {
-		return m.db.Delete(keyPortmapApps, nil)
-	}
-	buf, err := json.Marshal(m.apps)
-	if err != nil {
-		return err
-	}
-	err = m.db.Put(keyPortmapApps, buf, nil)
-	if err != nil {
-		return err
+func (m *PortmapAppMgr) FindReverseApp(peerID string, resID types.ID) *PortmapApp {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, a := range m.apps {
+		if a.Reverse && a.PeerID == peerID && a.ResID == resID {
+			return &a
+		}
 	}
 	return nil
 }
 
 func (m *PortmapAppMgr) FindAppWithPort(network string, port int) PortmapApp {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
 	for _, r := range m.apps {
-		if r.LocalPort == port && r.Network == network {
+		if r.Network == network && r.hasLocalPort(port) {
 			return r
 		}
 	}
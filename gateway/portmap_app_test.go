@@ -0,0 +1,39 @@
+package gateway
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/isletnet/uptp/types"
+)
+
+func TestBackupPeerHandshake(t *testing.T) {
+	var app PortmapApp
+	err := json.Unmarshal([]byte(`{"peer_id":"p1","res_id":"1","backup_peers":[{"peer_id":"p2"},{"peer_id":"p3","res_id":"3","target_status":"down"}],"target_port":80}`), &app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, hs := app.Handshake(8080)
+	// 没有资源ID的备用网关被跳过
+	if len(up.Peers) != 2 || up.Peers[0] != "p1" || up.Peers[1] != "p3" {
+		t.Fatalf("peers = %v", up.Peers)
+	}
+	if !up.TargetDown["p3"] || up.TargetDown["p1"] {
+		t.Errorf("target down = %v", up.TargetDown)
+	}
+	for _, c := range []struct {
+		buf []byte
+		res types.ID
+	}{
+		{hs, 1},
+		{up.Handshakes["p3"], 3},
+	} {
+		var h PortmapAppHandshake
+		if err := json.Unmarshal(c.buf, &h); err != nil {
+			t.Fatal(err)
+		}
+		if h.ResID != c.res || h.TargetPort != 80 {
+			t.Errorf("handshake = %+v, want res %s", h, c.res)
+		}
+	}
+}
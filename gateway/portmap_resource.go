@@ -1,28 +1,102 @@
 package gateway
 
 import (
-	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/store"
 	"github.com/isletnet/uptp/types"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type PortmapResource struct {
-	ID         types.ID `json:"id"`
-	Name       string   `json:"name"`
-	Type       int      `json:"type"`
-	Network    string   `json:"network"`
-	TargetAddr string   `json:"target_addr"`
-	TargetPort int      `json:"target_port"`
-	LocalIP    string   `json:"local_ip"`
-	LocalPort  int      `json:"local_port"`
+	ID          types.ID `json:"id"`
+	Name        string   `json:"name"`
+	Type        int      `json:"type"`
+	Network     string   `json:"network"`
+	TargetAddr  string   `json:"target_addr"`
+	TargetPort  int      `json:"target_port"`
+	TargetPorts string   `json:"target_ports,omitempty"` // 端口范围或列表，如"20000-20100,21000"
+	LocalIP     string   `json:"local_ip"`
+	LocalPort   int      `json:"local_port"`
+
+	HTTPRoutes []HTTPRoute `json:"http_routes,omitempty"` // Type为PortmapResTypeHTTP时的路由
+	HealthPath string      `json:"health_path,omitempty"` // 健康检查的HTTP路径，为空时只探测TCP连接
+
+	targetPorts []int // TargetPorts解析后的端口，保存和加载时生成
 }
 
-var (
-	keyPortmapRes = []byte("portmap_resources")
+const (
+	maxPortmapPorts = 1024
 )
 
+// ParsePortList 解析端口范围或列表，格式为逗号分隔的端口或"起始-结束"范围，端口不能重复
+func ParsePortList(spec string) ([]int, error) {
+	var ret []int
+	seen := make(map[int]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		begin, end := item, item
+		if i := strings.Index(item, "-"); i > 0 {
+			begin, end = item[:i], item[i+1:]
+		}
+		b, err := strconv.Atoi(strings.TrimSpace(begin))
+		if err != nil {
+			return nil, errors.New("invalid port: " + item)
+		}
+		e, err := strconv.Atoi(strings.TrimSpace(end))
+		if err != nil {
+			return nil, errors.New("invalid port: " + item)
+		}
+		if b <= 0 || e > 65535 || b > e {
+			return nil, errors.New("invalid port range: " + item)
+		}
+		if len(ret)+e-b+1 > maxPortmapPorts {
+			return nil, errors.New("too many ports")
+		}
+		for p := b; p <= e; p++ {
+			if seen[p] {
+				return nil, errors.New("duplicate port: " + strconv.Itoa(p))
+			}
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("empty port list")
+	}
+	return ret, nil
+}
+
+// HasTargetPort 判断端口是否属于资源
+func (res *PortmapResource) HasTargetPort(port int) bool {
+	if res.TargetPorts == "" {
+		return port == res.TargetPort
+	}
+	return slices.Contains(res.targetPorts, port)
+}
+
+// parsePorts 解析并缓存资源的端口列表
+func (res *PortmapResource) parsePorts() error {
+	res.targetPorts = nil
+	if res.TargetPorts == "" {
+		return nil
+	}
+	ports, err := ParsePortList(res.TargetPorts)
+	if err != nil {
+		return err
+	}
+	res.targetPorts = ports
+	return nil
+}
+
 type PortmapResMgr struct {
 	db *leveldb.DB
 
@@ -42,17 +116,16 @@ func NewPortmapResMgr(db *leveldb.DB) (*PortmapResMgr, error) {
 }
 
 func (pam *PortmapResMgr) AddPortmapRes(res *PortmapResource) error {
+	if err := res.parsePorts(); err != nil {
+		return err
+	}
 	pam.resMtx.Lock()
 	defer pam.resMtx.Unlock()
 	if pam.resources == nil {
 		pam.resources = make(map[types.ID]PortmapResource)
 	}
 	pam.resources[res.ID] = *res
-	err := pam.savePortmap()
-	if err != nil {
-		return err
-	}
-	return nil
+	return pam.saveRes(res)
 }
 
 func (pam *PortmapResMgr) DelPortmapApp(resID types.ID) error {
@@ -62,25 +135,23 @@ func (pam *PortmapResMgr) DelPortmapApp(resID types.ID) error {
 		return nil
 	}
 	delete(pam.resources, resID)
-	err := pam.savePortmap()
-	if err != nil {
-		return err
-	}
-	return nil
+	return store.Update(pam.db, func(b *leveldb.Batch) error {
+		store.DeleteRecord(b, prefixResource, resID)
+		return nil
+	})
 }
 
 func (pam *PortmapResMgr) UpdatePortmapRes(res *PortmapResource) error {
+	if err := res.parsePorts(); err != nil {
+		return err
+	}
 	pam.resMtx.Lock()
 	defer pam.resMtx.Unlock()
 	if pam.resources == nil {
 		pam.resources = make(map[types.ID]PortmapResource)
 	}
 	pam.resources[res.ID] = *res
-	err := pam.savePortmap()
-	if err != nil {
-		return err
-	}
-	return nil
+	return pam.saveRes(res)
 }
 
 func (pam *PortmapResMgr) GetAppByID(resID types.ID) PortmapResource {
@@ -104,31 +175,17 @@ func (pam *PortmapResMgr) GetResources() (ress []PortmapResource) {
 func (pam *PortmapResMgr) loadRes() error {
 	pam.resMtx.Lock()
 	defer pam.resMtx.Unlock()
-	v, err := pam.db.Get(keyPortmapRes, nil)
-	if err != nil {
-		if err != leveldb.ErrNotFound {
-			return err
+	pam.resources = make(map[types.ID]PortmapResource)
+	return store.LoadRecords(pam.db, prefixResource, func(id types.ID, res *PortmapResource) {
+		if err := res.parsePorts(); err != nil {
+			logging.Warn("portmap resource %s ports error: %s", res.Name, err)
 		}
-		return nil
-	}
-	err = json.Unmarshal(v, &pam.resources)
-	if err != nil {
-		return err
-	}
-	return nil
+		pam.resources[id] = *res
+	})
 }
 
-func (pam *PortmapResMgr) savePortmap() error {
-	if pam.resources == nil {
-		return nil
-	}
-	buf, err := json.Marshal(pam.resources)
-	if err != nil {
-		return err
-	}
-	err = pam.db.Put(keyPortmapRes, buf, nil)
-	if err != nil {
-		return err
-	}
-	return nil
+func (pam *PortmapResMgr) saveRes(res *PortmapResource) error {
+	return store.Update(pam.db, func(b *leveldb.Batch) error {
+		return store.PutRecord(b, prefixResource, res.ID, res)
+	})
 }
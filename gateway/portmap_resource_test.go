@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParsePortList(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []int
+		wantErr bool
+	}{
+		{spec: "80", want: []int{80}},
+		{spec: "20000-20002, 21000", want: []int{20000, 20001, 20002, 21000}},
+		{spec: " 22 ,,443", want: []int{22, 443}},
+		{spec: "", wantErr: true},
+		{spec: "0", wantErr: true},
+		{spec: "65536", wantErr: true},
+		{spec: "100-90", wantErr: true},
+		{spec: "abc", wantErr: true},
+		{spec: "80,80", wantErr: true},
+		{spec: "8000-8010,8005", wantErr: true},
+		{spec: "1-1025", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortList(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePortList(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParsePortList(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestPortmapAppTargetPortFor(t *testing.T) {
+	app := PortmapApp{LocalPorts: "30000-30001"}
+	if err := app.SetTargetPorts("20000,20005"); err != nil {
+		t.Fatal(err)
+	}
+	if p := app.TargetPortFor(30001); p != 20005 {
+		t.Errorf("TargetPortFor(30001) = %d, want 20005", p)
+	}
+	if p := app.TargetPortFor(30002); p != 0 {
+		t.Errorf("TargetPortFor(30002) = %d, want 0", p)
+	}
+	if !app.hasLocalPort(30000) || app.hasLocalPort(20000) {
+		t.Errorf("local ports = %v", app.LocalPortList())
+	}
+
+	app.LocalPorts = "30000"
+	if err := app.SetTargetPorts("20000,20005"); err == nil {
+		t.Error("mismatched local ports accepted")
+	}
+
+	res := PortmapResource{TargetPorts: "20000-20010"}
+	if err := res.parsePorts(); err != nil {
+		t.Fatal(err)
+	}
+	if !res.HasTargetPort(20010) || res.HasTargetPort(20011) {
+		t.Errorf("target ports = %v", res.targetPorts)
+	}
+}
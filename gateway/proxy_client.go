@@ -3,14 +3,19 @@ package gateway
 import (
 	"context"
 	"encoding/binary"
-	"encoding/json"
 	"net"
+	"net/netip"
+	"slices"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/proxyroute"
 	"github.com/isletnet/uptp/socks5"
+	"github.com/isletnet/uptp/splitroute"
+	"github.com/isletnet/uptp/store"
 	tunstack "github.com/isletnet/uptp/tun_stack"
 	"github.com/isletnet/uptp/types"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -29,8 +34,12 @@ type socksOutbound struct {
 	PeerName string   `json:"peer_name"`
 	Token    types.ID `json:"token"`
 	Route    string   `json:"route"`
+	// Routes 除Route外的其他网段，与Route一起生效
+	Routes []string `json:"routes,omitempty"`
+	// Default 作为默认路由，目标地址不匹配任何网段时使用该出站
+	Default bool `json:"default,omitempty"`
 
-	routeNet   *net.IPNet          `json:"-"`
+	routeNets  []netip.Prefix      `json:"-"`
 	socks5Peer socks5.PeerWithAuth `json:"-"`
 }
 
@@ -38,6 +47,9 @@ const (
 	tunName   = "uptptun0"
 	tunLocal  = "10.8.0.3/32"
 	tunRemote = "10.8.0.254/32"
+
+	tunLocal6  = "fd00:8::3/128"
+	tunRemote6 = "fd00:8::fe/128"
 )
 
 func socks5OutboundFillRunningInfo(ob *socksOutbound) error {
@@ -46,13 +58,13 @@ func socks5OutboundFillRunningInfo(ob *socksOutbound) error {
 		return err
 	}
 
-	_, n, err := net.ParseCIDR(ob.Route)
+	nets, err := parseOutboundRoutes(ob)
 	if err != nil {
 		return err
 	}
 	tokenBytes := make([]byte, 8)
 	binary.LittleEndian.PutUint64(tokenBytes, ob.Token.Uint64())
-	ob.routeNet = n
+	ob.routeNets = nets
 	ob.socks5Peer = socks5.PeerWithAuth{
 		ID:       pid,
 		UserName: tokenBytes,
@@ -61,9 +73,27 @@ func socks5OutboundFillRunningInfo(ob *socksOutbound) error {
 	return nil
 }
 
-var (
-	keySocksOutbound = []byte("socks_outbound")
-)
+// parseOutboundRoutes 合并Route和Routes并去重，默认路由可以不配置网段
+func parseOutboundRoutes(ob *socksOutbound) ([]netip.Prefix, error) {
+	var nets []netip.Prefix
+	for _, r := range append([]string{ob.Route}, ob.Routes...) {
+		if r == "" {
+			continue
+		}
+		n, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, err
+		}
+		n = n.Masked()
+		if !slices.Contains(nets, n) {
+			nets = append(nets, n)
+		}
+	}
+	if len(nets) == 0 && !ob.Default {
+		return nil, errors.New("route is empty")
+	}
+	return nets, nil
+}
 
 type socks5ProxyManager struct {
 	db *leveldb.DB
@@ -97,7 +127,7 @@ func (mgr *socks5ProxyManager) AddOutbound(outbound *socksOutbound) error {
 		mgr.outbounds = make(map[types.ID]*socksOutbound)
 	}
 	mgr.outbounds[outbound.ID] = outbound
-	return mgr.saveOutbounds()
+	return mgr.saveOutbound(outbound)
 }
 
 func (mgr *socks5ProxyManager) UpdateOutbound(outbound *socksOutbound) error {
@@ -111,7 +141,7 @@ func (mgr *socks5ProxyManager) UpdateOutbound(outbound *socksOutbound) error {
 		mgr.outbounds = make(map[types.ID]*socksOutbound)
 	}
 	mgr.outbounds[outbound.ID] = outbound
-	return mgr.saveOutbounds()
+	return mgr.saveOutbound(outbound)
 }
 
 func (mgr *socks5ProxyManager) DeleteOutbound(id types.ID) (*socksOutbound, error) {
@@ -125,7 +155,10 @@ func (mgr *socks5ProxyManager) DeleteOutbound(id types.ID) (*socksOutbound, erro
 		return nil, nil
 	}
 	delete(mgr.outbounds, id)
-	return ob, mgr.saveOutbounds()
+	return ob, store.Update(mgr.db, func(b *leveldb.Batch) error {
+		store.DeleteRecord(b, prefixOutbound, id)
+		return nil
+	})
 }
 
 func (mgr *socks5ProxyManager) GetOutbound(id types.ID) *socksOutbound {
@@ -150,32 +183,17 @@ func (mgr *socks5ProxyManager) ListOutbounds() []socksOutbound {
 func (mgr *socks5ProxyManager) loadOutbounds() error {
 	mgr.mtx.Lock()
 	defer mgr.mtx.Unlock()
-	v, err := mgr.db.Get(keySocksOutbound, nil)
-	if err != nil {
-		if err != leveldb.ErrNotFound {
-			return err
-		}
-		return nil
-	}
-	err = json.Unmarshal(v, &mgr.outbounds)
-	if err != nil {
-		return err
-	}
-	for _, ob := range mgr.outbounds {
+	mgr.outbounds = make(map[types.ID]*socksOutbound)
+	return store.LoadRecords(mgr.db, prefixOutbound, func(id types.ID, ob *socksOutbound) {
 		socks5OutboundFillRunningInfo(ob)
-	}
-	return nil
+		mgr.outbounds[id] = ob
+	})
 }
 
-func (mgr *socks5ProxyManager) saveOutbounds() error {
-	if mgr.outbounds == nil {
-		return nil
-	}
-	buf, err := json.Marshal(mgr.outbounds)
-	if err != nil {
-		return err
-	}
-	return mgr.db.Put(keySocksOutbound, buf, nil)
+func (mgr *socks5ProxyManager) saveOutbound(ob *socksOutbound) error {
+	return store.Update(mgr.db, func(b *leveldb.Batch) error {
+		return store.PutRecord(b, prefixOutbound, ob.ID, ob)
+	})
 }
 
 type proxyClient struct {
@@ -186,7 +204,20 @@ type proxyClient struct {
 
 	h host.Host
 
-	router *proxyRouter
+	router *proxyroute.Router[types.ID]
+
+	httpMtx   sync.Mutex
+	httpConf  proxyHTTPConfig
+	httpProxy *socks5.LocalServer
+
+	domainMtx   sync.Mutex
+	domainConf  proxyDomainConfig
+	dnsConn     net.PacketConn
+	domainRoute atomic.Pointer[domainRoute]
+
+	dnsMtx     sync.Mutex
+	dnsConf    proxyDNSConfig
+	tunDNSConn net.PacketConn
 }
 
 func newProxyClient(h host.Host, db *leveldb.DB) (*proxyClient, error) {
@@ -197,11 +228,23 @@ func newProxyClient(h host.Host, db *leveldb.DB) (*proxyClient, error) {
 	return &proxyClient{
 		socks5ProxyManager: obMgr,
 		h:                  h,
-		router:             newProxyRouter(),
+		router:             proxyroute.NewRouter[types.ID](),
 	}, nil
 }
 
 func (pc *proxyClient) Start() {
+	err := pc.loadHTTPConfig()
+	if err != nil {
+		logging.Error("load proxy client http config error: %s", err)
+	}
+	err = pc.loadDomainConfig()
+	if err != nil {
+		logging.Error("load proxy client domain config error: %s", err)
+	}
+	err = pc.loadDNSConfig()
+	if err != nil {
+		logging.Error("load proxy client dns config error: %s", err)
+	}
 	obs := pc.ListOutbounds()
 	for _, ob := range obs {
 		if !ob.Open {
@@ -210,14 +253,17 @@ func (pc *proxyClient) Start() {
 		err := pc.startTunStack()
 		if err != nil {
 			logging.Error("tun stack is not running: %s", err)
-			ob.Open = false
-			pc.socks5ProxyManager.UpdateOutbound(&ob)
-			continue
+			// HTTP代理不依赖TUN，开启时保留路由
+			if !pc.httpProxyEnabled() {
+				ob.Open = false
+				pc.socks5ProxyManager.UpdateOutbound(&ob)
+				continue
+			}
 		}
 		d := socks5.NewDialer(pc.h, ob.socks5Peer.ID, ob.socks5Peer.UserName, ob.socks5Peer.Password)
 		err = pc.addOutboundRoute(&ob, d)
 		if err != nil {
-			logging.Error("add route %s errors", ob.Route)
+			logging.Error("add route %s errors: %s", ob.Route, err)
 		}
 	}
 }
@@ -233,6 +279,9 @@ func (pc *proxyClient) Stop() {
 			logging.Error("proxyClient:Stop delete outbound route error: %s", err)
 		}
 	}
+	pc.stopHTTPProxy()
+	pc.stopDomainRoute()
+	pc.stopDNS()
 	err := pc.stopTunStack()
 	if err != nil {
 		logging.Error("proxyClient:Stop stop tun stack error: %s", err)
@@ -254,14 +303,14 @@ func (pc *proxyClient) AddOutbound(outbound *socksOutbound) error {
 	}
 
 	err = pc.startTunStack()
-	if err != nil {
+	if err != nil && !pc.httpProxyEnabled() {
 		return err
 	}
 	if outbound.Open {
 		d := socks5.NewDialer(pc.h, outbound.socks5Peer.ID, outbound.socks5Peer.UserName, outbound.socks5Peer.Password)
 		err = pc.addOutboundRoute(outbound, d)
 		if err != nil {
-			logging.Error("add route %s errors", outbound.Route)
+			logging.Error("add route %s errors: %s", outbound.Route, err)
 		}
 	}
 	return nil
@@ -273,19 +322,34 @@ func (pc *proxyClient) UpdateOutbound(outbound *socksOutbound) error {
 		return err
 	}
 	outbound.PeerName = peerName
+	var oldOb *socksOutbound
+	if ob := pc.GetOutbound(outbound.ID); ob != nil && ob.Open {
+		cp := *ob
+		oldOb = &cp
+	}
 	err = pc.socks5ProxyManager.UpdateOutbound(outbound)
 	if err != nil {
 		return err
 	}
+	// 网段可能变化，先删除旧路由
+	if oldOb != nil {
+		err = pc.DeleteOutboundRoute(oldOb)
+		if err != nil {
+			logging.Warn("delete old route of outbound %d error: %s", oldOb.ID, err)
+		}
+	}
+	if !outbound.Open {
+		return nil
+	}
 	err = pc.startTunStack()
-	if err != nil {
+	if err != nil && !pc.httpProxyEnabled() {
 		return err
 	}
 	if outbound.Open {
 		d := socks5.NewDialer(pc.h, outbound.socks5Peer.ID, outbound.socks5Peer.UserName, outbound.socks5Peer.Password)
 		err = pc.addOutboundRoute(outbound, d)
 		if err != nil {
-			logging.Error("add route %s errors", outbound.Route)
+			logging.Error("add route %s errors: %s", outbound.Route, err)
 		}
 	}
 	return nil
@@ -299,7 +363,7 @@ func (pc *proxyClient) DeleteOutbound(id types.ID) error {
 	if ob == nil {
 		return nil
 	}
-	pc.router.delRoute(ob.routeNet)
+	pc.router.DelOutbound(ob.ID)
 	return nil
 }
 
@@ -319,14 +383,73 @@ func (pc *proxyClient) CheckPeer(peer string, token types.ID) (string, error) {
 	return rsp.NodeName, nil
 }
 
+// addOutboundRoute 默认路由和/0网段只在路由表中生效，不修改系统默认路由，
+// 避免网关自身到出口网关的连接也进入tun
 func (pc *proxyClient) addOutboundRoute(outbound *socksOutbound, d *socks5.Dialer) error {
-	pc.router.addRoute(outbound.routeNet, d)
-	return addRoute(outbound.Route, tunRemote)
+	// 更新出站时先清除旧的网段
+	pc.router.DelOutbound(outbound.ID)
+	for _, n := range outbound.routeNets {
+		pc.router.AddRoute(n, outbound.ID, d)
+	}
+	if outbound.Default {
+		pc.router.SetDefault(outbound.ID, d)
+	}
+	if !pc.isTunStackRunning() {
+		return nil
+	}
+	var retErr error
+	for _, n := range outbound.routeNets {
+		if n.Bits() == 0 {
+			continue
+		}
+		err := addRoute(n.String(), tunGateway(n))
+		if err != nil {
+			retErr = err
+		}
+	}
+	return retErr
 }
 
 func (pc *proxyClient) DeleteOutboundRoute(outbound *socksOutbound) error {
-	pc.router.delRoute(outbound.routeNet)
-	return delRoute(outbound.Route, tunRemote)
+	pc.router.DelOutbound(outbound.ID)
+	if !pc.isTunStackRunning() {
+		return nil
+	}
+	var retErr error
+	for _, n := range outbound.routeNets {
+		if n.Bits() == 0 {
+			continue
+		}
+		err := delRoute(n.String(), tunGateway(n))
+		if err != nil {
+			retErr = err
+		}
+	}
+	return retErr
+}
+
+// ListRoutes 路由表及每条路由的连接统计
+func (pc *proxyClient) ListRoutes() []proxyroute.RouteInfo[types.ID] {
+	return pc.router.List()
+}
+
+// tunGateway IPv6路由的下一跳使用tun的IPv6对端地址
+func tunGateway(prefix netip.Prefix) string {
+	if prefix.Addr().Is6() {
+		return tunRemote6
+	}
+	return tunRemote
+}
+
+func (pc *proxyClient) isTunStackRunning() bool {
+	pc.tunStackMtx.Lock()
+	defer pc.tunStackMtx.Unlock()
+	return pc.tunStackRunning
+}
+
+// routeDialer 按目标地址最长前缀匹配出站
+func (pc *proxyClient) routeDialer(ip netip.Addr) *proxyroute.Entry[types.ID] {
+	return pc.router.Lookup(ip)
 }
 
 func (pc *proxyClient) startTunStack() error {
@@ -339,7 +462,7 @@ func (pc *proxyClient) startTunStack() error {
 	k := &tunstack.Key{
 		Device:     tunName,
 		LogLevel:   "silent",
-		UDPTimeout: time.Minute,
+		UDPTimeout: udpDefaultTimeout,
 	}
 	tunstack.Insert(k)
 	tunstack.SetProxyDialer(pc)
@@ -352,6 +475,11 @@ func (pc *proxyClient) startTunStack() error {
 		tunstack.Stop()
 		return err
 	}
+	// 系统未启用IPv6时只影响IPv6出站
+	err = addTunAddr(tunName, tunLocal6, tunRemote6)
+	if err != nil {
+		logging.Warn("add tun ipv6 addr error: %s", err)
+	}
 	pc.tunStackRunning = true
 	return nil
 }
@@ -371,18 +499,87 @@ func (pc *proxyClient) stopTunStack() error {
 }
 
 func (pc *proxyClient) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
-	if metadata.DstIP.Is6() {
-		return nil, errors.New("not support v6")
+	port := strconv.Itoa(int(metadata.DstPort))
+	if domain, rule, ok, err := pc.matchDomain(metadata.DstIP.String()); ok {
+		if err != nil {
+			return nil, err
+		}
+		return pc.dialDomain(context.Background(), metadata.Addr().Network(), domain, port, rule)
 	}
-	dstIP := metadata.DstIP.As4()
-	uip := uint32(dstIP[3]) | uint32(dstIP[2])<<8 | uint32(dstIP[1])<<16 | uint32(dstIP[0])<<24
-	d := pc.router.get(uip)
-	if d == nil {
+	r := pc.routeDialer(metadata.DstIP)
+	if r == nil {
 		return nil, errors.New("no route found")
 	}
-	return d.DialContext(context.Background(), metadata.Addr().Network(), net.JoinHostPort(metadata.DstIP.String(), strconv.Itoa(int(metadata.DstPort))))
+	c, err := r.Dialer.DialContext(context.Background(), metadata.Addr().Network(), net.JoinHostPort(metadata.DstIP.String(), port))
+	r.Record(err)
+	return c, err
 }
 
 func (pc *proxyClient) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
-	return nil, errors.New("unsuport")
+	if domain, rule, ok, err := pc.matchDomain(metadata.DstIP.String()); ok {
+		if err != nil {
+			return nil, err
+		}
+		c, err := pc.dialDomain(context.Background(), "udp", domain, strconv.Itoa(int(metadata.DstPort)), rule)
+		if err != nil {
+			return nil, err
+		}
+		// 应答来源需要是假IP
+		return &natPacketConn{
+			PacketConn: splitroute.NewFixedAddrPacketConn(c, metadata.UDPAddr()),
+			timeout:    udpFlowTimeout(metadata.DstPort),
+		}, nil
+	}
+	r := pc.routeDialer(metadata.DstIP)
+	if r == nil {
+		return nil, errors.New("no route found")
+	}
+	conn, err := r.Dialer.DialUDPConn("udp", net.JoinHostPort(metadata.DstIP.String(), strconv.Itoa(int(metadata.DstPort))))
+	r.Record(err)
+	if err != nil {
+		return nil, err
+	}
+	return &natPacketConn{
+		PacketConn: conn,
+		timeout:    udpFlowTimeout(metadata.DstPort),
+	}, nil
+}
+
+const (
+	udpDefaultTimeout = time.Minute
+	udpShortTimeout   = 10 * time.Second
+	udpQUICTimeout    = 30 * time.Second
+)
+
+// udpFlowTimeout DNS、NTP这类一问一答的流很快释放，其他流使用tun的默认超时
+func udpFlowTimeout(port uint16) time.Duration {
+	switch port {
+	case 53, 123:
+		return udpShortTimeout
+	case 443:
+		return udpQUICTimeout
+	}
+	return udpDefaultTimeout
+}
+
+// natPacketConn 按流的超时设置读取期限，超时后立即关闭到出口网关的stream，
+// tun2socks要等另一个方向也超时才关闭，tun一侧的会话仍按udpDefaultTimeout回收
+type natPacketConn struct {
+	net.PacketConn
+	timeout time.Duration
+}
+
+func (c *natPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.PacketConn.Close()
+	}
+	return n, addr, err
+}
+
+func (c *natPacketConn) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		return c.PacketConn.SetReadDeadline(t)
+	}
+	return c.PacketConn.SetReadDeadline(time.Now().Add(c.timeout))
 }
@@ -0,0 +1,45 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseOutboundRoutes(t *testing.T) {
+	ob := &socksOutbound{Route: "10.0.0.1/8", Routes: []string{"10.0.0.0/8", "fd00::/8"}}
+	nets, err := parseOutboundRoutes(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 2 || nets[0].String() != "10.0.0.0/8" || nets[1].String() != "fd00::/8" {
+		t.Errorf("nets = %v", nets)
+	}
+	if _, err := parseOutboundRoutes(&socksOutbound{}); err == nil {
+		t.Error("empty routes accepted")
+	}
+	if _, err := parseOutboundRoutes(&socksOutbound{Default: true}); err != nil {
+		t.Errorf("default outbound without routes: %s", err)
+	}
+	if _, err := parseOutboundRoutes(&socksOutbound{Route: "bad"}); err == nil {
+		t.Error("invalid route accepted")
+	}
+}
+
+func TestNatPacketConnCloseOnTimeout(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &natPacketConn{PacketConn: pc, timeout: 10 * time.Millisecond}
+	c.SetReadDeadline(time.Now())
+	_, _, err = c.ReadFrom(make([]byte, 16))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read err = %v", err)
+	}
+	// 超时后连接已关闭，另一个方向的写入立即失败
+	if _, err := c.WriteTo([]byte("x"), pc.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after timeout err = %v", err)
+	}
+}
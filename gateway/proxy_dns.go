@@ -0,0 +1,223 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/isletnet/uptp/dnsfwd"
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/types"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	defaultProxyDNS    = "8.8.8.8"
+	defaultTunDNSPort  = "53"
+	defaultTunDNSLocal = "10.8.0.3"
+)
+
+var (
+	keyProxyClientDNS = []byte("proxy_client_dns")
+)
+
+// proxyDNSConfig 代理客户端在TUN地址上提供DNS，查询经出站网关转发到网关配置的解析服务器，
+// Outbound为出站ID，为空时使用默认路由的出站
+type proxyDNSConfig struct {
+	Enable    bool              `json:"enable"`
+	Listen    string            `json:"listen"`
+	Outbound  string            `json:"outbound"`
+	Overrides []dnsfwd.Override `json:"overrides"`
+	Err       string            `json:"err,omitempty"`
+}
+
+func (g *Gateway) dnsStream() {
+	auth := g.proxyAuth
+	if g.trial {
+		auth = func(uint64) bool {
+			return true
+		}
+	}
+	g.pe.Libp2pHost().SetStreamHandler(dnsfwd.ProtocolID, func(s network.Stream) {
+		dnsfwd.ServeStream(s, auth, g.proxyResolver, g.proxyResolverAllow)
+	})
+}
+
+// proxyResolverAllow agent可以指定的解析服务器，避免网关向任意地址发送UDP
+func (g *Gateway) proxyResolverAllow() []string {
+	allow := []string{g.proxyResolver()}
+	if g.proxySvc == nil {
+		return allow
+	}
+	for _, r := range strings.Split(g.proxySvc.getConfig().DNSAllow, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			allow = append(allow, r)
+		}
+	}
+	return allow
+}
+
+// proxyResolver 代理服务的DNS，同时下发给agent和用于DNS-over-stream
+func (g *Gateway) proxyResolver() string {
+	if g.proxySvc != nil {
+		if dns := g.proxySvc.getConfig().DNS; dns != "" {
+			return dns
+		}
+	}
+	return defaultProxyDNS
+}
+
+func (pc *proxyClient) loadDNSConfig() error {
+	v, err := pc.db.Get(keyProxyClientDNS, nil)
+	if err != nil {
+		if err != leveldb.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	var conf proxyDNSConfig
+	err = json.Unmarshal(v, &conf)
+	if err != nil {
+		return err
+	}
+	pc.dnsMtx.Lock()
+	defer pc.dnsMtx.Unlock()
+	pc.dnsConf = conf
+	if conf.Enable {
+		return pc.startDNS()
+	}
+	return nil
+}
+
+func (pc *proxyClient) GetDNSConfig() proxyDNSConfig {
+	pc.dnsMtx.Lock()
+	defer pc.dnsMtx.Unlock()
+	conf := pc.dnsConf
+	if conf.Listen == "" {
+		conf.Listen = net.JoinHostPort(defaultTunDNSLocal, defaultTunDNSPort)
+	}
+	if conf.Enable && pc.tunDNSConn == nil {
+		conf.Err = "not listening"
+	}
+	return conf
+}
+
+// SetDNSConfig 保存配置并重新监听
+func (pc *proxyClient) SetDNSConfig(conf proxyDNSConfig) error {
+	conf.Err = ""
+	if conf.Listen == "" {
+		conf.Listen = net.JoinHostPort(defaultTunDNSLocal, defaultTunDNSPort)
+	}
+	if _, _, err := net.SplitHostPort(conf.Listen); err != nil {
+		return err
+	}
+	if conf.Outbound != "" {
+		if _, err := strconv.ParseUint(conf.Outbound, 10, 64); err != nil {
+			return fmt.Errorf("invalid outbound id %q", conf.Outbound)
+		}
+	}
+	pc.dnsMtx.Lock()
+	defer pc.dnsMtx.Unlock()
+	pc.closeDNS()
+	pc.dnsConf = conf
+	if conf.Enable {
+		if err := pc.startDNS(); err != nil {
+			pc.dnsConf.Enable = false
+			return err
+		}
+	}
+	buf, err := json.Marshal(pc.dnsConf)
+	if err != nil {
+		return err
+	}
+	return pc.db.Put(keyProxyClientDNS, buf, nil)
+}
+
+func (pc *proxyClient) startDNS() error {
+	conf := pc.dnsConf
+	fwd, err := dnsfwd.NewForwarder(pc.dnsUpstream(conf.Outbound), conf.Overrides)
+	if err != nil {
+		return err
+	}
+	// 默认监听在TUN地址上，需要先启动TUN
+	if err := pc.startTunStack(); err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", conf.Listen)
+	if err != nil {
+		return err
+	}
+	pc.tunDNSConn = conn
+	logging.Info("proxy client dns forwarder listen on %s", conn.LocalAddr())
+	go func() {
+		err := fwd.Serve(conn, pc.dnsExchange(fwd))
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logging.Error("proxy client dns forwarder serve error: %s", err)
+		}
+	}()
+	return nil
+}
+
+// dnsExchange 开启域名分流时命中规则的查询返回假IP
+func (pc *proxyClient) dnsExchange(fwd *dnsfwd.Forwarder) dnsfwd.ExchangeFunc {
+	return func(query []byte) ([]byte, error) {
+		if dr := pc.domainRoute.Load(); dr != nil {
+			if rsp, ok := dr.sr.Answer(query); ok {
+				return rsp, nil
+			}
+		}
+		return fwd.Exchange(query)
+	}
+}
+
+func (pc *proxyClient) closeDNS() {
+	if pc.tunDNSConn != nil {
+		pc.tunDNSConn.Close()
+		pc.tunDNSConn = nil
+	}
+}
+
+func (pc *proxyClient) stopDNS() {
+	pc.dnsMtx.Lock()
+	defer pc.dnsMtx.Unlock()
+	pc.closeDNS()
+}
+
+// dnsUpstream 每次查询时查找出站，出站修改后立即生效
+func (pc *proxyClient) dnsUpstream(target string) func(resolver string) dnsfwd.ExchangeFunc {
+	return func(resolver string) dnsfwd.ExchangeFunc {
+		return func(query []byte) ([]byte, error) {
+			ob, err := pc.dnsOutbound(target)
+			if err != nil {
+				return nil, err
+			}
+			return dnsfwd.StreamExchange(pc.h, ob.socks5Peer.ID, ob.Token.Uint64(), resolver)(query)
+		}
+	}
+}
+
+func (pc *proxyClient) dnsOutbound(target string) (*socksOutbound, error) {
+	var id types.ID
+	if target == "" {
+		r := pc.router.DefaultRoute()
+		if r == nil {
+			return nil, errors.New("no default outbound")
+		}
+		id = r.Outbound
+	} else {
+		v, err := strconv.ParseUint(target, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		id = types.ID(v)
+	}
+	ob := pc.GetOutbound(id)
+	if ob == nil || !ob.Open {
+		return nil, fmt.Errorf("outbound %s not available", id)
+	}
+	return ob, nil
+}
@@ -0,0 +1,256 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/socks5"
+	"github.com/isletnet/uptp/splitroute"
+	"github.com/isletnet/uptp/types"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// 默认只在回环地址提供DNS，给局域网设备使用时需要指定局域网地址，避免成为公网上的开放DNS转发
+const (
+	defaultDomainDNSListen = "127.0.0.1:53"
+	defaultDomainUpstream  = "223.5.5.5:53"
+)
+
+var (
+	keyProxyClientDomain = []byte("proxy_client_domain")
+)
+
+// proxyDomainConfig 按域名分流，局域网设备使用DNSListen作为DNS服务器(需要手动设置为局域网地址)，
+// 命中规则的域名解析为FakeIPRange内的地址并路由到TUN，
+// 规则的Target为出站ID，为空时使用默认路由的出站
+type proxyDomainConfig struct {
+	Enable      bool             `json:"enable"`
+	DNSListen   string           `json:"dns_listen"`
+	Upstream    string           `json:"upstream"`
+	FakeIPRange string           `json:"fake_ip_range"`
+	Rules       splitroute.Rules `json:"rules"`
+	Err         string           `json:"err,omitempty"`
+}
+
+// domainRoute 运行中的域名分流，直连时通过上游DNS解析，
+// 避免网关自身使用本机DNS时解析到假IP
+type domainRoute struct {
+	sr       *splitroute.Router
+	resolver *net.Resolver
+}
+
+func newDomainRoute(sr *splitroute.Router, upstream string) *domainRoute {
+	return &domainRoute{
+		sr: sr,
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, upstream)
+			},
+		},
+	}
+}
+
+func (dr *domainRoute) dialDirect(ctx context.Context, network, address string) (net.Conn, error) {
+	d := net.Dialer{Resolver: dr.resolver}
+	return d.DialContext(ctx, network, address)
+}
+
+func (conf *proxyDomainConfig) fillDefault() {
+	if conf.DNSListen == "" {
+		conf.DNSListen = defaultDomainDNSListen
+	}
+	if conf.Upstream == "" {
+		conf.Upstream = defaultDomainUpstream
+	}
+	if conf.FakeIPRange == "" {
+		conf.FakeIPRange = splitroute.DefaultFakeIPRange
+	}
+}
+
+func (pc *proxyClient) loadDomainConfig() error {
+	v, err := pc.db.Get(keyProxyClientDomain, nil)
+	if err != nil {
+		if err != leveldb.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	var conf proxyDomainConfig
+	err = json.Unmarshal(v, &conf)
+	if err != nil {
+		return err
+	}
+	pc.domainMtx.Lock()
+	defer pc.domainMtx.Unlock()
+	pc.domainConf = conf
+	if conf.Enable {
+		return pc.startDomainRoute()
+	}
+	return nil
+}
+
+func (pc *proxyClient) GetDomainConfig() proxyDomainConfig {
+	pc.domainMtx.Lock()
+	defer pc.domainMtx.Unlock()
+	conf := pc.domainConf
+	conf.fillDefault()
+	if conf.Enable && pc.dnsConn == nil {
+		conf.Err = "not listening"
+	}
+	return conf
+}
+
+// SetDomainConfig 保存配置并按配置重新启动DNS和假IP路由
+func (pc *proxyClient) SetDomainConfig(conf proxyDomainConfig) error {
+	conf.Err = ""
+	conf.fillDefault()
+	if conf.Enable {
+		if err := conf.Rules.Validate(); err != nil {
+			return err
+		}
+		if _, _, err := net.SplitHostPort(conf.DNSListen); err != nil {
+			return err
+		}
+		if _, _, err := net.SplitHostPort(conf.Upstream); err != nil {
+			return err
+		}
+	}
+	pc.domainMtx.Lock()
+	defer pc.domainMtx.Unlock()
+	pc.closeDomainRoute()
+	pc.domainConf = conf
+	if conf.Enable {
+		if err := pc.startDomainRoute(); err != nil {
+			pc.domainConf.Enable = false
+			return err
+		}
+	}
+	buf, err := json.Marshal(pc.domainConf)
+	if err != nil {
+		return err
+	}
+	return pc.db.Put(keyProxyClientDomain, buf, nil)
+}
+
+func (pc *proxyClient) startDomainRoute() error {
+	conf := pc.domainConf
+	conf.fillDefault()
+	sr, err := splitroute.NewRouter(conf.FakeIPRange, conf.Rules)
+	if err != nil {
+		return err
+	}
+	dnsConn, err := net.ListenPacket("udp", conf.DNSListen)
+	if err != nil {
+		return err
+	}
+	// 假IP的连接需要进入TUN，HTTP代理不依赖TUN
+	err = pc.startTunStack()
+	if err != nil {
+		logging.Warn("proxy client domain route without tun: %s", err)
+	} else {
+		fake := sr.FakeRange().String()
+		err = addRoute(fake, tunRemote)
+		if err != nil {
+			logging.Warn("add fake ip route %s error: %s", fake, err)
+		}
+	}
+	pc.dnsConn = dnsConn
+	pc.domainRoute.Store(newDomainRoute(sr, conf.Upstream))
+	logging.Info("proxy client dns listen on %s, fake ip range %s", dnsConn.LocalAddr(), sr.FakeRange())
+	go func() {
+		err := sr.ServeDNS(dnsConn, splitroute.UDPForwarder(conf.Upstream))
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logging.Error("proxy client dns serve error: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (pc *proxyClient) closeDomainRoute() {
+	dr := pc.domainRoute.Swap(nil)
+	if pc.dnsConn != nil {
+		pc.dnsConn.Close()
+		pc.dnsConn = nil
+	}
+	if dr != nil && pc.isTunStackRunning() {
+		delRoute(dr.sr.FakeRange().String(), tunRemote)
+	}
+}
+
+func (pc *proxyClient) stopDomainRoute() {
+	pc.domainMtx.Lock()
+	defer pc.domainMtx.Unlock()
+	pc.closeDomainRoute()
+}
+
+// matchDomain host为域名或假IP时返回对应的域名和规则，ok为false时按IP路由
+func (pc *proxyClient) matchDomain(host string) (domain string, rule splitroute.Rule, ok bool, err error) {
+	dr := pc.domainRoute.Load()
+	if dr == nil {
+		return "", rule, false, nil
+	}
+	sr := dr.sr
+	if ip, perr := netip.ParseAddr(host); perr == nil {
+		if !sr.IsFakeIP(ip) {
+			return "", rule, false, nil
+		}
+		domain, rule, err = sr.LookupFakeIP(ip)
+		return domain, rule, true, err
+	}
+	rule, ok = sr.MatchDomain(host)
+	return host, rule, ok, nil
+}
+
+// dialDomain 按规则建立到域名的连接，规则已删除时使用默认路由，没有默认路由时直连
+func (pc *proxyClient) dialDomain(ctx context.Context, network, domain, port string, rule splitroute.Rule) (net.Conn, error) {
+	dr := pc.domainRoute.Load()
+	if dr == nil {
+		return nil, errors.New("domain route not running")
+	}
+	address := net.JoinHostPort(domain, port)
+	switch rule.Action {
+	case splitroute.ActionReject:
+		return nil, splitroute.ErrRejected
+	case splitroute.ActionDirect:
+		return dr.dialDirect(ctx, network, address)
+	}
+	d, err := pc.outboundDialer(rule.Target)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		if rule.Action == splitroute.ActionProxy {
+			return nil, errors.New("no default outbound")
+		}
+		return dr.dialDirect(ctx, network, address)
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// outboundDialer target为空时返回默认路由的出站，没有默认路由时返回nil
+func (pc *proxyClient) outboundDialer(target string) (*socks5.Dialer, error) {
+	if target == "" {
+		if r := pc.router.DefaultRoute(); r != nil {
+			return r.Dialer, nil
+		}
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(target), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound id %q", target)
+	}
+	ob := pc.GetOutbound(types.ID(id))
+	if ob == nil || !ob.Open {
+		return nil, fmt.Errorf("outbound %s not available", target)
+	}
+	return socks5.NewDialer(pc.h, ob.socks5Peer.ID, ob.socks5Peer.UserName, ob.socks5Peer.Password), nil
+}
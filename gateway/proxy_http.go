@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/socks5"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var (
+	keyProxyClientHTTP = []byte("proxy_client_http")
+)
+
+// proxyHTTPConfig 代理客户端的HTTP代理监听，供局域网内其他机器不配置路由直接使用
+type proxyHTTPConfig struct {
+	Enable bool   `json:"enable"`
+	Listen string `json:"listen"`
+	Err    string `json:"err,omitempty"`
+}
+
+func (pc *proxyClient) loadHTTPConfig() error {
+	v, err := pc.db.Get(keyProxyClientHTTP, nil)
+	if err != nil {
+		if err != leveldb.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	var conf proxyHTTPConfig
+	err = json.Unmarshal(v, &conf)
+	if err != nil {
+		return err
+	}
+	pc.httpMtx.Lock()
+	defer pc.httpMtx.Unlock()
+	pc.httpConf = conf
+	if conf.Enable {
+		return pc.startHTTPProxy()
+	}
+	return nil
+}
+
+func (pc *proxyClient) httpProxyEnabled() bool {
+	pc.httpMtx.Lock()
+	defer pc.httpMtx.Unlock()
+	return pc.httpConf.Enable
+}
+
+func (pc *proxyClient) GetHTTPConfig() proxyHTTPConfig {
+	pc.httpMtx.Lock()
+	defer pc.httpMtx.Unlock()
+	conf := pc.httpConf
+	if pc.httpProxy != nil {
+		conf.Listen = pc.httpProxy.Addr().String()
+	} else if conf.Enable {
+		conf.Err = "not listening"
+	}
+	return conf
+}
+
+// SetHTTPConfig 保存配置并按配置重新监听
+func (pc *proxyClient) SetHTTPConfig(conf proxyHTTPConfig) error {
+	conf.Err = ""
+	if conf.Enable {
+		if _, _, err := net.SplitHostPort(conf.Listen); err != nil {
+			return err
+		}
+	}
+	pc.httpMtx.Lock()
+	defer pc.httpMtx.Unlock()
+	pc.closeHTTPProxy()
+	pc.httpConf = conf
+	if conf.Enable {
+		if err := pc.startHTTPProxy(); err != nil {
+			pc.httpConf.Enable = false
+			return err
+		}
+	}
+	buf, err := json.Marshal(pc.httpConf)
+	if err != nil {
+		return err
+	}
+	return pc.db.Put(keyProxyClientHTTP, buf, nil)
+}
+
+func (pc *proxyClient) startHTTPProxy() error {
+	ls, err := socks5.NewLocalServer(pc.httpConf.Listen, pc.dialByRoute)
+	if err != nil {
+		return err
+	}
+	pc.httpProxy = ls
+	logging.Info("proxy client http proxy listen on %s", ls.Addr())
+	go func() {
+		err := ls.Serve()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logging.Error("proxy client http proxy serve error: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (pc *proxyClient) closeHTTPProxy() {
+	if pc.httpProxy != nil {
+		pc.httpProxy.Close()
+		pc.httpProxy = nil
+	}
+}
+
+func (pc *proxyClient) stopHTTPProxy() {
+	pc.httpMtx.Lock()
+	defer pc.httpMtx.Unlock()
+	pc.closeHTTPProxy()
+}
+
+// dialByRoute 优先按域名规则处理，否则在本地解析域名后按目标IP选择出站，没有匹配的路由且没有默认路由时拒绝连接
+func (pc *proxyClient) dialByRoute(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	host = strings.Trim(host, "[]")
+	if domain, rule, ok, err := pc.matchDomain(host); ok {
+		if err != nil {
+			return nil, err
+		}
+		return pc.dialDomain(ctx, network, domain, port, rule)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		// 优先选择匹配到具体网段的地址
+		ip = ips[0].Unmap()
+		for _, a := range ips {
+			if r := pc.routeDialer(a); r != nil && !r.Default {
+				ip = a.Unmap()
+				break
+			}
+		}
+	}
+	r := pc.routeDialer(ip)
+	if r == nil {
+		return nil, errors.New("no route found")
+	}
+	c, err := r.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+	r.Record(err)
+	return c, err
+}
@@ -12,8 +12,10 @@ var (
 )
 
 type proxyServiceConfig struct {
-	Route     string `json:"route"`
-	DNS       string `json:"dns"`
+	Route string `json:"route"`
+	DNS   string `json:"dns"`
+	// DNSAllow agent通过DNS-over-stream可以指定的解析服务器，逗号分隔，DNS总是允许
+	DNSAllow  string `json:"dns_allow,omitempty"`
 	ProxyAddr string `json:"proxy_addr"`
 	ProxyUser string `json:"proxy_user"`
 	ProxyPass string `json:"proxy_pass"`
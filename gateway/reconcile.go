@@ -0,0 +1,282 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	apiutil "github.com/isletnet/uptp/apiutil.go"
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/store"
+	"github.com/isletnet/uptp/types"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// DesiredConfig 声明式配置文件，按id匹配已有的记录，只比较和修改文件中写出的字段，
+// 只处理文件中写出的分类，Prune为true时删除该分类下文件中没有的记录
+type DesiredConfig struct {
+	Resources *[]json.RawMessage `json:"resources"`
+	Apps      *[]json.RawMessage `json:"apps"`
+	Outbounds *[]json.RawMessage `json:"outbounds"`
+	Prune     bool               `json:"prune"`
+}
+
+const (
+	ConfigKindResource = "resource"
+	ConfigKindApp      = "app"
+	ConfigKindOutbound = "outbound"
+
+	ConfigActionCreate = "create"
+	ConfigActionUpdate = "update"
+	ConfigActionDelete = "delete"
+)
+
+// ConfigChange 配置文件与当前状态的一处差异
+type ConfigChange struct {
+	Kind   string   `json:"kind"`
+	Action string   `json:"action"`
+	ID     types.ID `json:"id"`
+	Fields []string `json:"fields,omitempty"`
+
+	value []byte
+}
+
+func (c ConfigChange) String() string {
+	sign := map[string]string{ConfigActionCreate: "+", ConfigActionUpdate: "~", ConfigActionDelete: "-"}[c.Action]
+	s := fmt.Sprintf("%s %s %s", sign, c.Kind, c.ID)
+	if len(c.Fields) > 0 {
+		s += " (" + strings.Join(c.Fields, ", ") + ")"
+	}
+	return s
+}
+
+func LoadDesiredConfig(path string) (*DesiredConfig, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c DesiredConfig
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, fmt.Errorf("parse %s error: %w", path, err)
+	}
+	return &c, nil
+}
+
+func diffConfig(db *leveldb.DB, c *DesiredConfig) ([]ConfigChange, error) {
+	var ret []ConfigChange
+	for _, k := range []struct {
+		kind, prefix string
+		items        *[]json.RawMessage
+	}{
+		{ConfigKindResource, prefixResource, c.Resources},
+		{ConfigKindOutbound, prefixOutbound, c.Outbounds},
+		{ConfigKindApp, prefixApp, c.Apps},
+	} {
+		if k.items == nil {
+			continue
+		}
+		l, err := diffRecords(db, k.kind, k.prefix, *k.items, c.Prune)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, l...)
+	}
+	return ret, nil
+}
+
+func diffRecords(db *leveldb.DB, kind, prefix string, items []json.RawMessage, prune bool) ([]ConfigChange, error) {
+	exist := make(map[types.ID]map[string]json.RawMessage)
+	err := store.LoadRawRecords(db, prefix, func(id types.ID, raw []byte) error {
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		exist[id] = m
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ret []ConfigChange
+	seen := make(map[types.ID]bool)
+	for _, item := range items {
+		var want map[string]json.RawMessage
+		if err := json.Unmarshal(item, &want); err != nil {
+			return nil, fmt.Errorf("%s: %w", kind, err)
+		}
+		var id types.ID
+		if raw, ok := want["id"]; ok {
+			if err := json.Unmarshal(raw, &id); err != nil {
+				return nil, fmt.Errorf("%s: invalid id %s", kind, raw)
+			}
+		}
+		if id == 0 {
+			return nil, fmt.Errorf("%s: id is required", kind)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("%s %s: duplicate id", kind, id)
+		}
+		seen[id] = true
+		if kind == ConfigKindApp && jsonTrue(want["reverse"]) {
+			return nil, fmt.Errorf("%s %s: reverse app is managed by agent", kind, id)
+		}
+
+		cur, ok := exist[id]
+		if !ok {
+			ret = append(ret, ConfigChange{Kind: kind, Action: ConfigActionCreate, ID: id, value: item})
+			continue
+		}
+		var fields []string
+		for f, v := range want {
+			if !jsonEqual(v, cur[f]) {
+				fields = append(fields, f)
+				cur[f] = v
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		sort.Strings(fields)
+		value, err := json.Marshal(cur)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ConfigChange{Kind: kind, Action: ConfigActionUpdate, ID: id, Fields: fields, value: value})
+	}
+	if !prune {
+		return ret, nil
+	}
+	var dels []ConfigChange
+	for id, cur := range exist {
+		// 反向映射的应用由agent管理
+		if seen[id] || (kind == ConfigKindApp && jsonTrue(cur["reverse"])) {
+			continue
+		}
+		dels = append(dels, ConfigChange{Kind: kind, Action: ConfigActionDelete, ID: id})
+	}
+	sort.Slice(dels, func(i, j int) bool { return dels[i].ID < dels[j].ID })
+	return append(ret, dels...), nil
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func jsonTrue(v json.RawMessage) bool {
+	var b bool
+	json.Unmarshal(v, &b)
+	return b
+}
+
+// DiffConfigFile 对比配置文件与工作目录数据库中的配置，网关运行时数据库被占用，需要使用/gateway/reconcile接口
+func DiffConfigFile(workDir, path string) ([]ConfigChange, error) {
+	c, err := LoadDesiredConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openDB(filepath.Join(workDir, dbData), &opt.Options{ErrorIfMissing: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return diffConfig(db, c)
+}
+
+// Reconcile 按配置文件增删改资源、应用和出站，dryRun只返回差异，单项失败不影响其他项
+func (g *Gateway) Reconcile(dryRun bool) ([]ConfigChange, error) {
+	g.reconcileMtx.Lock()
+	defer g.reconcileMtx.Unlock()
+	if g.configFile == "" {
+		return nil, errors.New("config file not set")
+	}
+	c, err := LoadDesiredConfig(g.configFile)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := diffConfig(g.db, c)
+	if err != nil || dryRun {
+		return changes, err
+	}
+	var errs []error
+	for _, ch := range changes {
+		if err := g.applyChange(ch); err != nil {
+			logging.Error("reconcile %s error: %s", ch, err)
+			errs = append(errs, fmt.Errorf("%s %s: %w", ch.Kind, ch.ID, err))
+			continue
+		}
+		logging.Info("reconcile %s", ch)
+	}
+	return changes, errors.Join(errs...)
+}
+
+func (g *Gateway) applyChange(ch ConfigChange) error {
+	switch ch.Kind {
+	case ConfigKindResource:
+		if ch.Action == ConfigActionDelete {
+			return g.prm.DelPortmapApp(ch.ID)
+		}
+		var res PortmapResource
+		if err := json.Unmarshal(ch.value, &res); err != nil {
+			return err
+		}
+		if err := validatePortmapResource(&res); err != nil {
+			return err
+		}
+		return g.prm.UpdatePortmapRes(&res)
+	case ConfigKindOutbound:
+		if ch.Action == ConfigActionDelete {
+			return g.proxyCli.DeleteOutbound(ch.ID)
+		}
+		var ob socksOutbound
+		if err := json.Unmarshal(ch.value, &ob); err != nil {
+			return err
+		}
+		if ch.Action == ConfigActionCreate {
+			return g.proxyCli.AddOutbound(&ob)
+		}
+		return g.proxyCli.UpdateOutbound(&ob)
+	case ConfigKindApp:
+		old := g.pam.GetPortmapApp(ch.ID.Uint64())
+		if ch.Action == ConfigActionDelete {
+			if old != nil && old.Running {
+				old.DelListeners(g.pm)
+			}
+			return g.pam.DelPortmapApp(ch.ID.Uint64())
+		}
+		var app PortmapApp
+		if err := json.Unmarshal(ch.value, &app); err != nil {
+			return err
+		}
+		return g.savePortmapApp(&app, old)
+	}
+	return fmt.Errorf("unknown kind %s", ch.Kind)
+}
+
+func (g *Gateway) reconcile(w http.ResponseWriter, r *http.Request) {
+	rsp := apiutil.ApiResponse{}
+
+	var req struct {
+		DryRun bool `json:"dry_run"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	changes, err := g.Reconcile(req.DryRun)
+	if err != nil {
+		rsp.Code = 500
+		rsp.Message = err.Error()
+	} else {
+		rsp.Message = "ok"
+	}
+	rsp.Data = changes
+	apiutil.SendAPIRespWithOk(w, rsp)
+}
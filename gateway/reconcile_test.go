@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/isletnet/uptp/store"
+)
+
+func TestDiffConfig(t *testing.T) {
+	db := memDB(t)
+	db.Put(store.RecordKey(prefixResource, 1), []byte(`{"id":"1","name":"a","target_port":80,"local_port":0}`), nil)
+	db.Put(store.RecordKey(prefixResource, 2), []byte(`{"id":"2","name":"b"}`), nil)
+	db.Put(store.RecordKey(prefixResource, 4), []byte(`{"id":"4","name":"d"}`), nil)
+	db.Put(store.RecordKey(prefixApp, 9), []byte(`{"id":"9","reverse":true}`), nil)
+
+	c, err := parseDesired(`{"prune":true,"resources":[
+		{"id":"1","name":"a2","target_port":80},
+		{"id":"2","name":"b"},
+		{"id":"3","name":"c"}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := diffConfig(db, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"~ resource 1 (name)", "+ resource 3", "- resource 4"}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %v", changes)
+	}
+	for i, ch := range changes {
+		if ch.String() != want[i] {
+			t.Errorf("change %d = %q, want %q", i, ch, want[i])
+		}
+	}
+	// 未写出的字段保留原值
+	var res PortmapResource
+	json.Unmarshal(changes[0].value, &res)
+	if res.Name != "a2" || res.TargetPort != 80 {
+		t.Errorf("merged = %+v", res)
+	}
+
+	dup, _ := parseDesired(`{"apps":[{"id":"5"},{"id":"5"}]}`)
+	if _, err := diffConfig(db, dup); err == nil {
+		t.Error("duplicate id accepted")
+	}
+	noID, _ := parseDesired(`{"apps":[{"name":"x"}]}`)
+	if _, err := diffConfig(db, noID); err == nil {
+		t.Error("missing id accepted")
+	}
+}
+
+func TestDiffConfigNoPrune(t *testing.T) {
+	db := memDB(t)
+	db.Put(store.RecordKey(prefixResource, 1), []byte(`{"id":"1","name":"a"}`), nil)
+	db.Put(store.RecordKey(prefixResource, 2), []byte(`{"id":"2","name":"b"}`), nil)
+	db.Put(store.RecordKey(prefixApp, 7), []byte(`{"id":"7","name":"app"}`), nil)
+	db.Put(store.RecordKey(prefixOutbound, 8), []byte(`{"id":"8"}`), nil)
+
+	// 没有prune时不删除，没有写出的分类不处理
+	c, _ := parseDesired(`{"resources":[{"id":"1","name":"a2"}]}`)
+	changes, err := diffConfig(db, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].String() != "~ resource 1 (name)" {
+		t.Errorf("changes = %v", changes)
+	}
+
+	// prune只作用于写出的分类，空列表删除该分类的所有记录
+	c, _ = parseDesired(`{"prune":true,"apps":[]}`)
+	changes, err = diffConfig(db, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].String() != "- app 7" {
+		t.Errorf("changes = %v", changes)
+	}
+}
+
+func parseDesired(s string) (*DesiredConfig, error) {
+	var c DesiredConfig
+	err := json.Unmarshal([]byte(s), &c)
+	return &c, err
+}
@@ -0,0 +1,212 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/types"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// 反向端口映射：agent把本地服务注册到网关，网关在本地监听端口，
+// 连接通过/portmap协议转发回agent，agent再连接自己的本地服务
+const (
+	ReverseRegisterID = "/portmap/reverse/1.0.0"
+)
+
+const (
+	ReverseActionRegister   = 1
+	ReverseActionUnregister = 2
+)
+
+// 反向映射只能监听非特权端口，避开网关自己使用的端口
+const (
+	reverseMinPort = 1024
+	reverseMaxPort = 65535
+)
+
+type ReverseReq struct {
+	Action     int      `json:"action"`
+	Token      types.ID `json:"token"`
+	ResID      types.ID `json:"res_id"`
+	Name       string   `json:"name"`
+	Network    string   `json:"network"`
+	ListenIP   string   `json:"listen_ip"`
+	ListenPort int      `json:"listen_port"`
+}
+
+type ReverseResp struct {
+	NodeName string `json:"node_name"`
+	Err      string `json:"err"`
+}
+
+func (g *Gateway) reverse() {
+	g.pe.Libp2pHost().SetStreamHandler(ReverseRegisterID, g.reverseHandler)
+}
+
+func (g *Gateway) reverseHandler(s network.Stream) {
+	defer s.Close()
+	buf := make([]byte, 1024)
+	n, err := s.Read(buf)
+	if err != nil {
+		return
+	}
+	var req ReverseReq
+	err = json.Unmarshal(buf[:n], &req)
+	if err != nil {
+		return
+	}
+	resp := ReverseResp{}
+	err = g.handleReverseReq(s.Conn().RemotePeer().String(), &req)
+	if err != nil {
+		resp.Err = err.Error()
+	} else {
+		resp.NodeName, _ = g.getGatewayName()
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	s.Write(data)
+}
+
+func (g *Gateway) handleReverseReq(peerID string, req *ReverseReq) error {
+	token, err := g.getReverseToken()
+	if err != nil {
+		return err
+	}
+	if token != req.Token.Uint64() {
+		return errors.New("authorize failed")
+	}
+	g.reverseMtx.Lock()
+	defer g.reverseMtx.Unlock()
+	exist := g.pam.FindReverseApp(peerID, req.ResID)
+	switch req.Action {
+	case ReverseActionRegister:
+		if req.Network != "tcp" && req.Network != "udp" {
+			return errors.New("invalid network type, must be tcp or udp")
+		}
+		if req.ListenPort < reverseMinPort || req.ListenPort > reverseMaxPort {
+			return fmt.Errorf("listen port must be in %d-%d", reverseMinPort, reverseMaxPort)
+		}
+		if !reverseListenIPAllowed(req.ListenIP) {
+			return errors.New("listen ip must be empty, 0.0.0.0 or an address of the gateway")
+		}
+		var selfID types.ID
+		if exist != nil {
+			selfID = exist.ID
+		}
+		if err := g.checkReversePort(req.Network, req.ListenPort, selfID); err != nil {
+			return err
+		}
+		app := PortmapApp{
+			ID:        types.ID(rand.Uint64()),
+			Name:      req.Name,
+			PeerID:    peerID,
+			PeerName:  req.Name,
+			ResID:     req.ResID,
+			Network:   req.Network,
+			LocalIP:   req.ListenIP,
+			LocalPort: req.ListenPort,
+			Running:   true,
+			Reverse:   true,
+		}
+		if exist != nil {
+			// 重复注册用于保活，监听不变时不需要重建
+			if exist.Running && exist.Network == app.Network &&
+				exist.LocalIP == app.LocalIP && exist.LocalPort == app.LocalPort {
+				return nil
+			}
+			app.ID = exist.ID
+			if exist.Running {
+				exist.DelListeners(g.pm)
+			}
+		}
+		if err := app.AddListeners(g.pm); err != nil {
+			logging.Error("add reverse portmap listener error: %s", err)
+			return err
+		}
+		return g.pam.UpdatePortmapApp(&app)
+	case ReverseActionUnregister:
+		if exist == nil {
+			return nil
+		}
+		if exist.Running {
+			exist.DelListeners(g.pm)
+		}
+		return g.pam.DelPortmapApp(exist.ID.Uint64())
+	}
+	return errors.New("unknown action")
+}
+
+func reverseListenIPAllowed(ip string) bool {
+	return ip == "" || ip == "0.0.0.0" || isLocalIP(ip)
+}
+
+// isLocalIP 判断是否是本机网卡的地址
+func isLocalIP(ip string) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if in, ok := a.(*net.IPNet); ok && in.IP.String() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReversePort 端口已被应用、资源或网关自己使用时拒绝，Portmap会复用相同端口的监听，不检查会抢占其他应用
+func (g *Gateway) checkReversePort(network string, port int, selfID types.ID) error {
+	if port == apiPort || port == g.pe.GetListenPort() {
+		return errors.New("listen port is used by gateway")
+	}
+	for _, a := range g.pam.GetPortmapApps() {
+		if a.ID != selfID && a.Network == network && a.hasLocalPort(port) {
+			return errors.New("listen port is used by app " + a.Name)
+		}
+	}
+	for _, r := range g.prm.GetResources() {
+		// 资源的目标是网关本机时，端口已被本机服务使用
+		local := r.TargetAddr == "" || r.TargetAddr == "localhost" || isLocalIP(r.TargetAddr)
+		if r.LocalPort == port || (local && r.HasTargetPort(port)) {
+			return errors.New("listen port is used by resource " + r.Name)
+		}
+	}
+	return nil
+}
+
+// ReverseRegister 向网关注册或注销反向端口映射
+func ReverseRegister(h host.Host, peerID string, req ReverseReq) (resp ReverseResp, err error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return
+	}
+	s, err := h.NewStream(context.Background(), pid, ReverseRegisterID)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+	s.Write(data)
+	buf := make([]byte, 1024)
+	n, err := s.Read(buf)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf[:n], &resp)
+	return
+}
@@ -19,12 +19,12 @@ func setTunAddr(ifname, localAddr, remoteAddr string) error {
 	if err != nil {
 		return err
 	}
-	ln.Mask = net.CIDRMask(32, 32)
+	ln.Mask = hostMask(ln.IP)
 	rn, err := netlink.ParseIPNet(remoteAddr)
 	if err != nil {
 		return err
 	}
-	rn.Mask = net.CIDRMask(32, 32)
+	rn.Mask = hostMask(rn.IP)
 
 	addr := &netlink.Addr{
 		IPNet: ln,
@@ -43,12 +43,12 @@ func addTunAddr(ifname, localAddr, remoteAddr string) error {
 	if err != nil {
 		return err
 	}
-	ln.Mask = net.CIDRMask(32, 32)
+	ln.Mask = hostMask(ln.IP)
 	rn, err := netlink.ParseIPNet(remoteAddr)
 	if err != nil {
 		return err
 	}
-	rn.Mask = net.CIDRMask(32, 32)
+	rn.Mask = hostMask(rn.IP)
 
 	addr := &netlink.Addr{
 		IPNet: ln,
@@ -57,6 +57,13 @@ func addTunAddr(ifname, localAddr, remoteAddr string) error {
 	return netlink.AddrAdd(ifce, addr)
 }
 
+func hostMask(ip net.IP) net.IPMask {
+	if ip.To4() != nil {
+		return net.CIDRMask(32, 32)
+	}
+	return net.CIDRMask(128, 128)
+}
+
 func addRoute(dst, gw string) error {
 	_, networkid, err := net.ParseCIDR(dst)
 	if err != nil {
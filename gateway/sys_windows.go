@@ -6,6 +6,10 @@ func setTunAddr(ifname, localAddr, remoteAddr string) error {
 	return errors.New("not supoort")
 }
 
+func addTunAddr(ifname, localAddr, remoteAddr string) error {
+	return errors.New("not supoort")
+}
+
 func addRoute(dst, gw string) error {
 	return errors.New("not supoort")
 }
@@ -18,6 +18,9 @@ document.addEventListener('DOMContentLoaded', function() {
     loadPortmapApps();
     loadProxyConfig();
     loadProxyClients();
+    loadProxyHttp();
+    loadProxyDomain();
+    loadProxyDns();
 });
 
 // 加载端口映射资源列表
@@ -44,7 +47,7 @@ function renderResourceList(resources) {
 
     if (!resources || resources.length === 0) {
         const tr = document.createElement('tr');
-        tr.innerHTML = '<td colspan="6" class="text-center">暂无数据</td>';
+        tr.innerHTML = '<td colspan="7" class="text-center">暂无数据</td>';
         tbody.appendChild(tr);
         return;
     }
@@ -61,7 +64,8 @@ function renderResourceList(resources) {
             <td>${resource.name}</td>
             <td>${resource.network}</td>
             <td>${resource.target_addr}</td>
-            <td>${resource.target_port}</td>
+            <td>${resource.target_ports || resource.target_port}</td>
+            <td>${renderHealth(resource.health)}</td>
             <td>
                 <button class="btn btn-sm btn-outline-primary" onclick="editResource('${resource.id.toString()}')">
                     <i class="bi bi-pencil"></i>
@@ -75,6 +79,17 @@ function renderResourceList(resources) {
     });
 }
 
+// 渲染资源目标健康状态
+function renderHealth(health) {
+    if (!health || health.status === 'unknown') {
+        return '<span class="badge bg-secondary">未知</span>';
+    }
+    if (health.status === 'up') {
+        return `<span class="badge bg-success">正常</span> <small>${health.latency_ms}ms</small>`;
+    }
+    return `<span class="badge bg-danger" title="${health.err || ''}">异常</span>`;
+}
+
 // 显示添加资源模态框
 function showAddModal() {
     document.getElementById('modalTitle').textContent = '添加资源';
@@ -97,6 +112,10 @@ async function editResource(id) {
             document.getElementById('network').value = resource.network;
             document.getElementById('targetAddr').value = resource.target_addr;
             document.getElementById('targetPort').value = resource.target_port;
+            document.getElementById('targetPorts').value = resource.target_ports || '';
+            document.getElementById('resType').value = resource.type || 0;
+            document.getElementById('httpRoutes').value = resource.http_routes ? JSON.stringify(resource.http_routes, null, 2) : '';
+            document.getElementById('healthPath').value = resource.health_path || '';
             resourceModal.show();
         } else {
             showError('获取资源信息失败：' + data.message);
@@ -120,7 +139,19 @@ async function saveResource() {
         network: document.getElementById('network').value,
         target_addr: document.getElementById('targetAddr').value,
         target_port: parseInt(document.getElementById('targetPort').value),
+        target_ports: document.getElementById('targetPorts').value.trim(),
+        type: parseInt(document.getElementById('resType').value),
+        health_path: document.getElementById('healthPath').value.trim(),
     };
+    const httpRoutes = document.getElementById('httpRoutes').value.trim();
+    if (httpRoutes) {
+        try {
+            resource.http_routes = JSON.parse(httpRoutes);
+        } catch (error) {
+            showError('HTTP路由格式错误：' + error.message);
+            return;
+        }
+    }
 
     try {
         const url = resourceId ? `${API_BASE_URL}/update` : `${API_BASE_URL}/add`;
@@ -185,6 +216,7 @@ async function loadGatewayInfo() {
             document.getElementById('gatewayName').textContent = data.data.name || '未设置';
             document.getElementById('gatewayPort').textContent = data.data.running_port;
             document.getElementById('gatewayToken').textContent = data.data.token;
+            document.getElementById('gatewayReverseToken').textContent = data.data.reverse_token;
             document.getElementById('gatewayVersion').textContent = data.data.version || '未知';
         } else {
             showError('加载网关信息失败：' + data.message);
@@ -316,11 +348,11 @@ function renderPortmapList(portmaps) {
     portmaps.forEach(portmap => {
         const tr = document.createElement('tr');
         tr.innerHTML = `
-            <td>${portmap.name}</td>
+            <td>${portmap.name}${portmap.reverse ? ' <span class="badge bg-info">反向</span>' : ''}</td>
             <td>${portmap.peer_name}</td>
             <td>${portmap.network}</td>
             <td>${portmap.local_ip}</td>
-            <td>${portmap.local_port}</td>
+            <td>${portmap.local_ports || portmap.local_port}</td>
             <td>
                 <span class="badge ${portmap.running ? 'bg-success' : 'bg-secondary'}">
                     ${portmap.running ? '运行中' : '已停止'}
@@ -359,10 +391,13 @@ async function editPortmap(id) {
             document.getElementById('portmapId').value = portmap.id;
             document.getElementById('portmapName').value = portmap.name;
             document.getElementById('PortmapPeerId').value = portmap.peer_id;
+            document.getElementById('backupPeers').value = (portmap.backup_peers || []).map(p => p.peer_id + '/' + p.res_id).join(',');
+            document.getElementById('balancePolicy').value = portmap.policy || 'failover';
             document.getElementById('resId').value = portmap.res_id;
             document.getElementById('portmapNetwork').value = portmap.network;
             document.getElementById('localIp').value = portmap.local_ip;
             document.getElementById('localPort').value = portmap.local_port;
+            document.getElementById('localPorts').value = portmap.local_ports || '';
             document.getElementById('running').checked = portmap.running;
             portmapModal.show();
         } else {
@@ -389,6 +424,12 @@ async function savePortmap() {
         network: document.getElementById('portmapNetwork').value,
         local_ip: document.getElementById('localIp').value,
         local_port: parseInt(document.getElementById('localPort').value),
+        local_ports: document.getElementById('localPorts').value.trim(),
+        backup_peers: document.getElementById('backupPeers').value.split(',').map(p => p.trim()).filter(p => p).map(p => {
+            const [peer_id, res_id] = p.split('/');
+            return { peer_id: peer_id.trim(), res_id: (res_id || '0').trim() };
+        }),
+        policy: document.getElementById('balancePolicy').value,
         running: document.getElementById('running').checked
     };
 
@@ -456,6 +497,12 @@ function copyGatewayToken() {
     copyToClipboard(gatewayToken);
 }
 
+// 复制反向映射Token到剪贴板
+function copyGatewayReverseToken() {
+    const reverseToken = document.getElementById('gatewayReverseToken').textContent.trim();
+    copyToClipboard(reverseToken);
+}
+
 // 显示错误信息
 function showError(message) {
     alert(message);
@@ -476,6 +523,7 @@ async function loadProxyConfig() {
             const config = data.data;
             document.getElementById('proxyRoute').value = config.route || '';
             document.getElementById('proxyDns').value = config.dns || '';
+            document.getElementById('proxyDnsAllow').value = config.dns_allow || '';
             document.getElementById('proxyAddr').value = config.proxy_addr || '';
             document.getElementById('proxyUser').value = config.proxy_user || '';
             document.getElementById('proxyPass').value = config.proxy_pass || '';
@@ -492,6 +540,7 @@ async function saveProxyConfig() {
     const config = {
         route: document.getElementById('proxyRoute').value,
         dns: document.getElementById('proxyDns').value,
+        dns_allow: document.getElementById('proxyDnsAllow').value.trim(),
         proxy_addr: document.getElementById('proxyAddr').value,
         proxy_user: document.getElementById('proxyUser').value,
         proxy_pass: document.getElementById('proxyPass').value
@@ -518,6 +567,167 @@ async function saveProxyConfig() {
     }
 }
 
+// 加载出口HTTP代理配置
+async function loadProxyHttp() {
+    try {
+        const response = await fetch(`${PROXY_CLIENT_API_BASE_URL}/http_proxy`);
+        const data = await response.json();
+
+        if (data.code === 0) {
+            document.getElementById('proxyHttpListen').value = data.data.listen || '';
+            document.getElementById('proxyHttpEnable').checked = data.data.enable;
+        } else {
+            showError('加载HTTP代理配置失败：' + data.message);
+        }
+    } catch (error) {
+        showError('加载HTTP代理配置失败：' + error.message);
+    }
+}
+
+// 保存出口HTTP代理配置
+async function saveProxyHttp() {
+    const config = {
+        listen: document.getElementById('proxyHttpListen').value.trim(),
+        enable: document.getElementById('proxyHttpEnable').checked
+    };
+
+    try {
+        const response = await fetch(`${PROXY_CLIENT_API_BASE_URL}/http_proxy`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(config)
+        });
+
+        const data = await response.json();
+        if (data.code === 0) {
+            const toast = new bootstrap.Toast(document.getElementById('copyToast'));
+            toast.show();
+        } else {
+            showError('保存HTTP代理配置失败：' + data.message);
+        }
+    } catch (error) {
+        showError('保存HTTP代理配置失败：' + error.message);
+    }
+}
+
+// 加载域名分流配置
+async function loadProxyDomain() {
+    try {
+        const response = await fetch(`${PROXY_CLIENT_API_BASE_URL}/domain_rules`);
+        const data = await response.json();
+
+        if (data.code === 0) {
+            document.getElementById('proxyDomainListen').value = data.data.dns_listen || '';
+            document.getElementById('proxyDomainUpstream').value = data.data.upstream || '';
+            document.getElementById('proxyDomainFakeRange').value = data.data.fake_ip_range || '';
+            document.getElementById('proxyDomainRules').value = data.data.rules ? JSON.stringify(data.data.rules, null, 2) : '';
+            document.getElementById('proxyDomainEnable').checked = data.data.enable;
+        } else {
+            showError('加载域名分流配置失败：' + data.message);
+        }
+    } catch (error) {
+        showError('加载域名分流配置失败：' + error.message);
+    }
+}
+
+// 保存域名分流配置
+async function saveProxyDomain() {
+    const config = {
+        dns_listen: document.getElementById('proxyDomainListen').value.trim(),
+        upstream: document.getElementById('proxyDomainUpstream').value.trim(),
+        fake_ip_range: document.getElementById('proxyDomainFakeRange').value.trim(),
+        enable: document.getElementById('proxyDomainEnable').checked
+    };
+    const rules = document.getElementById('proxyDomainRules').value.trim();
+    if (rules) {
+        try {
+            config.rules = JSON.parse(rules);
+        } catch (e) {
+            showError('规则格式错误：' + e.message);
+            return;
+        }
+    }
+
+    try {
+        const response = await fetch(`${PROXY_CLIENT_API_BASE_URL}/domain_rules`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(config)
+        });
+
+        const data = await response.json();
+        if (data.code === 0) {
+            const toast = new bootstrap.Toast(document.getElementById('copyToast'));
+            toast.show();
+        } else {
+            showError('保存域名分流配置失败：' + data.message);
+        }
+    } catch (error) {
+        showError('保存域名分流配置失败：' + error.message);
+    }
+}
+
+// 加载TUN DNS转发配置
+async function loadProxyDns() {
+    try {
+        const response = await fetch(`${PROXY_CLIENT_API_BASE_URL}/dns`);
+        const data = await response.json();
+
+        if (data.code === 0) {
+            document.getElementById('proxyDnsListen').value = data.data.listen || '';
+            document.getElementById('proxyDnsOutbound').value = data.data.outbound || '';
+            document.getElementById('proxyDnsOverrides').value = data.data.overrides ? JSON.stringify(data.data.overrides, null, 2) : '';
+            document.getElementById('proxyDnsEnable').checked = data.data.enable;
+        } else {
+            showError('加载DNS转发配置失败：' + data.message);
+        }
+    } catch (error) {
+        showError('加载DNS转发配置失败：' + error.message);
+    }
+}
+
+// 保存TUN DNS转发配置
+async function saveProxyDns() {
+    const config = {
+        listen: document.getElementById('proxyDnsListen').value.trim(),
+        outbound: document.getElementById('proxyDnsOutbound').value.trim(),
+        enable: document.getElementById('proxyDnsEnable').checked
+    };
+    const overrides = document.getElementById('proxyDnsOverrides').value.trim();
+    if (overrides) {
+        try {
+            config.overrides = JSON.parse(overrides);
+        } catch (e) {
+            showError('解析服务器格式错误：' + e.message);
+            return;
+        }
+    }
+
+    try {
+        const response = await fetch(`${PROXY_CLIENT_API_BASE_URL}/dns`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(config)
+        });
+
+        const data = await response.json();
+        if (data.code === 0) {
+            const toast = new bootstrap.Toast(document.getElementById('copyToast'));
+            toast.show();
+        } else {
+            showError('保存DNS转发配置失败：' + data.message);
+        }
+    } catch (error) {
+        showError('保存DNS转发配置失败：' + error.message);
+    }
+}
+
 // 加载代理出口列表
 async function loadProxyClients() {
     try {
@@ -551,7 +761,7 @@ function renderProxyClients(clients) {
         const tr = document.createElement('tr');
         tr.innerHTML = `
             <td>${client.remark}</td>
-            <td>${client.route}</td>
+            <td>${[client.route, ...(client.routes || [])].filter(r => r).join('<br>')}${client.default ? ' <span class="badge bg-info">默认</span>' : ''}</td>
             <td>${client.peer_name}</td>
             <td>
                 <span class="badge bg-${client.open ? 'success' : 'secondary'}">
@@ -596,6 +806,8 @@ async function editProxyClient(id) {
             document.getElementById('clientToken').value = client.token;
             document.getElementById('remark').value = client.remark || '';
             document.getElementById('route').value = client.route || '0.0.0.0/0';
+            document.getElementById('extraRoutes').value = (client.routes || []).join('\n');
+            document.getElementById('defaultRoute').checked = client.default === true;
             document.getElementById('open').checked = client.open !== false;
             proxyClientModal.show();
         } else {
@@ -620,7 +832,9 @@ async function saveProxyClient() {
         token: document.getElementById('clientToken').value,
         remark: document.getElementById('remark').value || '',
         open: document.getElementById('open').checked,
-        route: document.getElementById('route').value || '0.0.0.0/0'
+        route: document.getElementById('route').value || '0.0.0.0/0',
+        routes: document.getElementById('extraRoutes').value.split('\n').map(r => r.trim()).filter(r => r),
+        default: document.getElementById('defaultRoute').checked
     };
 
     try {
@@ -19,6 +19,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
@@ -33,6 +34,7 @@ import (
 type P2PEngine struct {
 	rhost *rhost.RoutedHost
 	dht   *dht.IpfsDHT
+	bw    *metrics.BandwidthCounter
 
 	realPort int
 
@@ -88,7 +90,9 @@ func NewP2PEngine(listenPort int, seed []byte, logFile, dhtDBPath string, clentM
 	if err != nil {
 		return nil, err
 	}
-	ret := P2PEngine{}
+	ret := P2PEngine{
+		bw: metrics.NewBandwidthCounter(),
+	}
 	ipv6BlackHoleSC := &swarm.BlackHoleSuccessCounter{N: 100, MinSuccesses: 5, Name: "IPv6"}
 	opts := []libp2p.Option{
 		libp2p.Security(noise.ID, NewSessionTransport),
@@ -97,6 +101,7 @@ func NewP2PEngine(listenPort int, seed []byte, logFile, dhtDBPath string, clentM
 		libp2p.EnableRelay(),
 		// libp2p.AddrsFactory(ret.addrsFactory),
 		libp2p.DefaultTransports,
+		libp2p.BandwidthReporter(ret.bw),
 	}
 	if clentMode {
 		opts = append(opts, func(cfg *libp2p.Config) error {
@@ -238,6 +243,11 @@ func (pe *P2PEngine) DHT() *dht.IpfsDHT {
 	return pe.dht
 }
 
+// Bandwidth 所有libp2p连接的流量统计
+func (pe *P2PEngine) Bandwidth() metrics.Stats {
+	return pe.bw.GetBandwidthTotals()
+}
+
 func (pe *P2PEngine) Close() error {
 	pe.dht.Host().Close()
 	return pe.dht.Close()
@@ -0,0 +1,164 @@
+package portmap
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 多网关负载均衡策略
+const (
+	BalanceFailover   = "failover"    // 按顺序使用，前面的网关不可用时切换到后面的(主备)
+	BalanceRoundRobin = "round_robin" // 轮询
+	BalanceLeastConn  = "least_conn"  // 最少连接，连接数相同时选延迟低的
+)
+
+const (
+	peerDownDuration = 30 * time.Second
+)
+
+// Upstream 监听端口对应的一组网关，Handshakes为各网关单独的握手数据，没有时使用默认握手，
+// TargetDown为授权时报告资源目标不可用的网关
+type Upstream struct {
+	Peers      []string
+	Policy     string
+	Handshakes map[string][]byte
+	TargetDown map[string]bool
+}
+
+func ValidBalancePolicy(policy string) bool {
+	switch policy {
+	case "", BalanceFailover, BalanceRoundRobin, BalanceLeastConn:
+		return true
+	}
+	return false
+}
+
+// PeerStat 网关的连接统计，Latency为握手耗时的平滑值
+type PeerStat struct {
+	PeerID   string `json:"peer_id"`
+	Conns    int    `json:"conns"`
+	Latency  int64  `json:"latency_ms"`
+	Down     bool   `json:"down"`
+	LastErr  string `json:"last_err,omitempty"`
+	downTime time.Time
+}
+
+type balancer struct {
+	mtx   sync.Mutex
+	peers map[string]*PeerStat
+	rr    map[string]int
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		peers: make(map[string]*PeerStat),
+		rr:    make(map[string]int),
+	}
+}
+
+func (b *balancer) stat(peerID string) *PeerStat {
+	ps, ok := b.peers[peerID]
+	if !ok {
+		ps = &PeerStat{PeerID: peerID}
+		b.peers[peerID] = ps
+	}
+	return ps
+}
+
+// pick 返回尝试顺序，目标不可用的网关排在可用网关后面，最近失败的网关排在最后，全部失败时仍然会尝试
+func (b *balancer) pick(key string, up Upstream) []string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	n := len(up.Peers)
+	if n <= 1 {
+		return up.Peers
+	}
+	ret := make([]string, 0, n)
+	switch up.Policy {
+	case BalanceRoundRobin:
+		start := b.rr[key] % n
+		b.rr[key] = start + 1
+		ret = append(ret, up.Peers[start:]...)
+		ret = append(ret, up.Peers[:start]...)
+	case BalanceLeastConn:
+		ret = append(ret, up.Peers...)
+		sort.SliceStable(ret, func(i, j int) bool {
+			pi, pj := b.stat(ret[i]), b.stat(ret[j])
+			if pi.Conns != pj.Conns {
+				return pi.Conns < pj.Conns
+			}
+			return pi.Latency < pj.Latency
+		})
+	default:
+		ret = append(ret, up.Peers...)
+	}
+	now := time.Now()
+	rank := make(map[string]int, n)
+	for _, p := range ret {
+		switch {
+		case b.isDown(p, now):
+			rank[p] = 2
+		case up.TargetDown[p]:
+			rank[p] = 1
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return rank[ret[i]] < rank[ret[j]]
+	})
+	return ret
+}
+
+// isDown 失败超过peerDownDuration后恢复，调用方需要持有mtx
+func (b *balancer) isDown(peerID string, now time.Time) bool {
+	ps := b.stat(peerID)
+	if ps.Down && now.Sub(ps.downTime) > peerDownDuration {
+		ps.Down = false
+	}
+	return ps.Down
+}
+
+func (b *balancer) onSuccess(peerID string, latency time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	ps := b.stat(peerID)
+	ps.Down = false
+	ps.LastErr = ""
+	ps.Conns++
+	ms := latency.Milliseconds()
+	if ps.Latency == 0 {
+		ps.Latency = ms
+	} else {
+		ps.Latency = (ps.Latency*7 + ms) / 8
+	}
+}
+
+func (b *balancer) onFailure(peerID string, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	ps := b.stat(peerID)
+	ps.Down = true
+	ps.downTime = time.Now()
+	ps.LastErr = err.Error()
+}
+
+func (b *balancer) onClose(peerID string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	ps := b.stat(peerID)
+	if ps.Conns > 0 {
+		ps.Conns--
+	}
+}
+
+func (b *balancer) stats() []PeerStat {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := time.Now()
+	ret := make([]PeerStat, 0, len(b.peers))
+	for id, ps := range b.peers {
+		b.isDown(id, now)
+		ret = append(ret, *ps)
+	}
+	return ret
+}
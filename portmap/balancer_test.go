@@ -0,0 +1,72 @@
+package portmap
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBalancerPolicy(t *testing.T) {
+	b := newBalancer()
+	up := Upstream{Peers: []string{"a", "b", "c"}}
+	if got := b.pick("k", up); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("failover = %v", got)
+	}
+
+	up.Policy = BalanceRoundRobin
+	for _, want := range [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}} {
+		if got := b.pick("k", up); !slices.Equal(got, want) {
+			t.Errorf("round robin = %v, want %v", got, want)
+		}
+	}
+
+	up.Policy = BalanceLeastConn
+	b.onSuccess("a", 50*time.Millisecond)
+	b.onSuccess("a", 50*time.Millisecond)
+	b.onSuccess("b", 30*time.Millisecond)
+	b.onSuccess("c", 10*time.Millisecond)
+	if got := b.pick("k", up); !slices.Equal(got, []string{"c", "b", "a"}) {
+		t.Errorf("least conn = %v", got)
+	}
+	b.onClose("a")
+	b.onClose("a")
+	if got := b.pick("k", up); !slices.Equal(got, []string{"a", "c", "b"}) {
+		t.Errorf("least conn after close = %v", got)
+	}
+}
+
+func TestBalancerDown(t *testing.T) {
+	b := newBalancer()
+	up := Upstream{
+		Peers:      []string{"a", "b", "c"},
+		TargetDown: map[string]bool{"b": true},
+	}
+	if got := b.pick("k", up); !slices.Equal(got, []string{"a", "c", "b"}) {
+		t.Errorf("target down = %v", got)
+	}
+
+	b.onFailure("a", errors.New("handshake failed"))
+	if got := b.pick("k", up); !slices.Equal(got, []string{"c", "b", "a"}) {
+		t.Errorf("peer down = %v", got)
+	}
+
+	// 超过peerDownDuration后恢复
+	b.peers["a"].downTime = time.Now().Add(-peerDownDuration - time.Second)
+	if got := b.pick("k", up); !slices.Equal(got, []string{"a", "c", "b"}) {
+		t.Errorf("peer recovered = %v", got)
+	}
+	for _, ps := range b.stats() {
+		if ps.Down {
+			t.Errorf("peer %s still down", ps.PeerID)
+		}
+	}
+
+	// 全部不可用时仍然返回所有网关
+	for _, p := range up.Peers {
+		b.onFailure(p, errors.New("handshake failed"))
+	}
+	if got := b.pick("k", up); len(got) != 3 {
+		t.Errorf("all down = %v", got)
+	}
+}
@@ -3,6 +3,7 @@ package portmap
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -34,6 +35,15 @@ type handshakeRsp struct {
 	Msg  string `json:"msg"`
 }
 
+// handshakeError 对端拒绝了握手，换stream重试没有意义
+type handshakeError struct {
+	msg string
+}
+
+func (e *handshakeError) Error() string {
+	return "handshak response: " + e.msg
+}
+
 type relayTCPListener struct {
 	// *PortmapConf
 	listener net.Listener
@@ -44,12 +54,7 @@ func (ptl *relayTCPListener) close() error {
 }
 
 func (ptl *relayTCPListener) getPort() int {
-	parsePort := strings.Split(ptl.listener.Addr().String(), ":")
-	if len(parsePort) != 2 {
-		return 0
-	}
-	p, _ := strconv.Atoi(parsePort[1])
-	return p
+	return addrPort(ptl.listener.Addr())
 }
 
 type relayUDPListener struct {
@@ -62,16 +67,14 @@ func (pul *relayUDPListener) close() error {
 	return pul.uc.Close()
 }
 func (pul *relayUDPListener) getPort() int {
-	parsePort := strings.Split(pul.ul.LocalAddr().String(), ":")
-	if len(parsePort) != 2 {
-		return 0
-	}
-	p, _ := strconv.Atoi(parsePort[1])
-	return p
+	return addrPort(pul.ul.LocalAddr())
 }
 
-type GetHandshake func(network string, ip string, port int) (peerID string, handshake []byte)
-type HandleHandshake func(handshake []byte) (network string, addr string, port int, err error)
+type GetHandshake func(network string, ip string, port int) (up Upstream, handshake []byte)
+type HandleHandshake func(peerID string, handshake []byte) (network string, addr string, port int, err error)
+
+// ConnHandler 接管握手成功的stream，addr和port为HandleHandshake的返回值
+type ConnHandler func(conn net.Conn, addr string, port int)
 
 type Portmap struct {
 	listeners map[string]relayListener
@@ -83,12 +86,20 @@ type Portmap struct {
 
 	funcGetHandshake    GetHandshake
 	funcHandleHandshake HandleHandshake
+
+	connHandlers map[string]ConnHandler
+
+	lb   *balancer
+	pool *streamPool
 }
 
 func NewPortMap(h host.Host) *Portmap {
 	var ret Portmap
 	ret.p2pEngine = h
 	ret.listeners = make(map[string]relayListener)
+	ret.connHandlers = make(map[string]ConnHandler)
+	ret.lb = newBalancer()
+	ret.pool = newStreamPool(h)
 	g := nbio.NewGopher(nbio.Config{
 		Network:        "tcp",
 		UDPReadTimeout: time.Minute,
@@ -109,17 +120,38 @@ func (pm *Portmap) SetHandleHandshakeFunc(f HandleHandshake) {
 	pm.funcHandleHandshake = f
 }
 
+// PeerStats 返回各网关的连接数、握手延迟和可用状态
+func (pm *Portmap) PeerStats() []PeerStat {
+	return pm.lb.stats()
+}
+
+// WarmUp 预先连接网关并保持连接，应用运行期间调用
+func (pm *Portmap) WarmUp(peers []string) {
+	pm.pool.warmUp(peers)
+}
+
+// CoolDown 与WarmUp成对调用，网关不再被使用时释放连接池
+func (pm *Portmap) CoolDown(peers []string) {
+	pm.pool.coolDown(peers)
+}
+
+// SetConnHandler 注册自定义网络类型的处理函数，握手返回该网络类型时不再连接目标地址
+func (pm *Portmap) SetConnHandler(network string, h ConnHandler) {
+	pm.connHandlers[network] = h
+}
+
 func (pm *Portmap) Start(server bool) {
 	// nblog.SetLogger(nil)
 	pm.connEngine.Start()
+	pm.pool.start()
 	if server {
 		pm.p2pEngine.SetStreamHandler(portmapID, pm.handleUptpStream)
 	}
 }
 
 func (pm *Portmap) AddListener(network string, ip string, port int) (int, error) {
-	pm.connMtx.RLock()
-	defer pm.connMtx.RUnlock()
+	pm.connMtx.Lock()
+	defer pm.connMtx.Unlock()
 	l, ok := pm.listeners[convertIndex(network, ip, port)]
 	if !ok {
 		var err error
@@ -139,7 +171,7 @@ func (pm *Portmap) AddListener(network string, ip string, port int) (int, error)
 }
 
 func (pm *Portmap) addTCPListener(ip string, port int) (relayListener, error) {
-	l, err := net.Listen("tcp4", fmt.Sprintf("%s:%d", ip, port))
+	l, err := net.Listen(listenNetwork("tcp", ip), joinHostPort(ip, port))
 	if err != nil {
 		return nil, err
 	}
@@ -158,11 +190,12 @@ func (pm *Portmap) addTCPListener(ip string, port int) (relayListener, error) {
 }
 
 func (pm *Portmap) addUDPListener(ip string, port int) (relayListener, error) {
-	la, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", ip, port))
+	network := listenNetwork("udp", ip)
+	la, err := net.ResolveUDPAddr(network, joinHostPort(ip, port))
 	if err != nil {
 		return nil, err
 	}
-	l, err := net.ListenUDP("udp4", la)
+	l, err := net.ListenUDP(network, la)
 	if err != nil {
 		return nil, err
 	}
@@ -186,43 +219,83 @@ func (pm *Portmap) DeleteListener(network string, ip string, port int) {
 }
 
 func (pm *Portmap) relayHandshake(peerID string, hs []byte) (s network.Stream, err error) {
-	// var s network.Stream
-	defer func() {
-		if s != nil && err != nil {
-			s.Reset()
-		}
-	}()
 	pid, err := peer.Decode(peerID)
 	if err != nil {
 		logging.Error("[Portmap:relayHandshake] decode peer id error: %s", err)
 		return nil, err
 	}
-	s, err = pm.p2pEngine.NewStream(context.Background(), pid, portmapID)
+	s, pooled, err := pm.pool.get(pid)
 	if err != nil {
 		logging.Error("[Portmap:relayHandshake] create stream error: %s", err)
 		return nil, err
 	}
+	err = pm.writeHandshake(s, hs)
+	var hsErr *handshakeError
+	if err != nil && pooled && !errors.As(err, &hsErr) {
+		// 池中的stream可能已经失效，重新打开一次
+		s, err = pm.p2pEngine.NewStream(context.Background(), pid, portmapID)
+		if err != nil {
+			logging.Error("[Portmap:relayHandshake] create stream error: %s", err)
+			return nil, err
+		}
+		err = pm.writeHandshake(s, hs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (pm *Portmap) writeHandshake(s network.Stream, hs []byte) (err error) {
+	defer func() {
+		if err != nil {
+			s.Reset()
+		}
+	}()
+	s.SetDeadline(time.Now().Add(handshakeTimeout))
 	// ps = stream.NewVarLenPacketStream(s, 32*1024)
 	_, err = s.Write(hs)
 	if err != nil {
 		logging.Error("[Portmap:relayHandshake] write connection handshake error: %s", err)
-		return nil, err
+		return err
 	}
 	hsBuf := make([]byte, 100)
 	rspLen, err := s.Read(hsBuf)
 	if err != nil {
 		logging.Error("[Portmap:relayHandshake] read connection handshake rsp error: %s", err)
-		return nil, err
+		return err
 	}
 	hsRsp := handshakeRsp{}
 	err = json.Unmarshal(hsBuf[:rspLen], &hsRsp)
 	if err != nil {
 		logging.Error("[Portmap:relayHandshake] unmarshal connection handshake rsp error: %s", err)
-		return
+		return err
 	}
 	if hsRsp.Code != 0 {
 		logging.Error("[Portmap:relayHandshake]  handshake rsp error: %s", hsRsp.Msg)
-		err = fmt.Errorf("handshak response: %s", hsRsp.Msg)
+		return &handshakeError{hsRsp.Msg}
+	}
+	s.SetDeadline(time.Time{})
+	return nil
+}
+
+// relayHandshakeUpstream 按均衡策略依次尝试网关，握手失败时切换到下一个
+func (pm *Portmap) relayHandshakeUpstream(key string, up Upstream, hs []byte) (pid string, s network.Stream, err error) {
+	for _, pid = range pm.lb.pick(key, up) {
+		begin := time.Now()
+		phs := hs
+		if v, ok := up.Handshakes[pid]; ok {
+			phs = v
+		}
+		s, err = pm.relayHandshake(pid, phs)
+		if err == nil {
+			pm.lb.onSuccess(pid, time.Since(begin))
+			return
+		}
+		pm.lb.onFailure(pid, err)
+		if len(up.Peers) > 1 {
+			logging.Warn("[Portmap:relayHandshakeUpstream] peer %s failed, try next: %s", pid, err)
+		}
 	}
 	return
 }
@@ -233,15 +306,18 @@ func (pm *Portmap) onConnData(c *nbio.Conn, data []byte) {
 		c.Close()
 		return
 	}
-	stream, ok := s.(network.Stream)
-	if !ok {
+	var err error
+	switch sess := s.(type) {
+	case *relayConn:
+		err = sess.write(data)
+	case network.Stream:
+		_, err = sess.Write(data)
+	default:
 		c.SetSession(nil)
 		c.Close()
 		return
 	}
-	_, err := stream.Write(data)
 	if err != nil {
-		c.SetSession(nil)
 		c.Close()
 		return
 	}
@@ -251,11 +327,12 @@ func (pm *Portmap) onConnClose(c *nbio.Conn, err error) {
 	if s == nil {
 		return
 	}
-	stream, ok := s.(network.Stream)
-	if !ok {
-		return
+	switch sess := s.(type) {
+	case *relayConn:
+		sess.close()
+	case network.Stream:
+		sess.Close()
 	}
-	stream.Close()
 }
 
 func (pm *Portmap) onConnOpen(c *nbio.Conn) {
@@ -265,6 +342,7 @@ func (pm *Portmap) onConnOpen(c *nbio.Conn) {
 		prot := c.LocalAddr().Network()
 		if len(prot) < 3 {
 			c.Close()
+			return
 		}
 		prot = prot[:3]
 		var port int
@@ -282,26 +360,10 @@ func (pm *Portmap) onConnOpen(c *nbio.Conn) {
 			c.Close()
 			return
 		}
-		pid, hs := pm.funcGetHandshake(prot, ip, port)
-		if hs == nil || pid == "" {
-			c.Close()
-			return
-		}
-		s, err := pm.relayHandshake(pid, hs)
-		if err != nil {
-			c.Close()
-			return
-		}
-		c.SetSession(s)
-		go func() {
-			_, err = io.Copy(c, s)
-			if err != nil {
-				logging.Error("[Portmap:onConn] forward stram to connection error: %s", err)
-			}
-			c.SetSession(nil)
-			s.Close()
-			c.Close()
-		}()
+		// 握手需要网络往返，不能阻塞事件循环，握手完成前收到的数据先缓存
+		rc := &relayConn{}
+		c.SetSession(rc)
+		go pm.relayConnect(c, rc, prot, ip, port)
 		return
 	}
 	_, ok := s.(network.Stream)
@@ -311,6 +373,87 @@ func (pm *Portmap) onConnOpen(c *nbio.Conn) {
 	}
 }
 
+func (pm *Portmap) relayConnect(c *nbio.Conn, rc *relayConn, prot, ip string, port int) {
+	up, hs := pm.funcGetHandshake(prot, ip, port)
+	if hs == nil || len(up.Peers) == 0 {
+		c.Close()
+		return
+	}
+	pid, s, err := pm.relayHandshakeUpstream(convertIndex(prot, ip, port), up, hs)
+	if err != nil {
+		c.Close()
+		return
+	}
+	defer pm.lb.onClose(pid)
+	if err = rc.attach(s); err != nil {
+		s.Reset()
+		c.Close()
+		return
+	}
+	_, err = io.Copy(c, s)
+	if err != nil {
+		logging.Error("[Portmap:onConn] forward stram to connection error: %s", err)
+	}
+	s.Close()
+	c.Close()
+}
+
+// relayConn 本地连接的会话，握手完成后把缓存的数据和后续数据写入stream
+type relayConn struct {
+	mtx    sync.Mutex
+	s      network.Stream
+	buf    []byte
+	closed bool
+}
+
+func (rc *relayConn) write(data []byte) error {
+	rc.mtx.Lock()
+	if rc.closed {
+		rc.mtx.Unlock()
+		return net.ErrClosed
+	}
+	s := rc.s
+	if s == nil {
+		if len(rc.buf)+len(data) > maxPendingDataSize {
+			rc.mtx.Unlock()
+			return errors.New("too much pending data")
+		}
+		rc.buf = append(rc.buf, data...)
+		rc.mtx.Unlock()
+		return nil
+	}
+	rc.mtx.Unlock()
+	_, err := s.Write(data)
+	return err
+}
+
+func (rc *relayConn) attach(s network.Stream) error {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	if rc.closed {
+		return net.ErrClosed
+	}
+	if len(rc.buf) > 0 {
+		if _, err := s.Write(rc.buf); err != nil {
+			return err
+		}
+		rc.buf = nil
+	}
+	rc.s = s
+	return nil
+}
+
+func (rc *relayConn) close() {
+	rc.mtx.Lock()
+	rc.closed = true
+	s := rc.s
+	rc.buf = nil
+	rc.mtx.Unlock()
+	if s != nil {
+		s.Close()
+	}
+}
+
 func (pm *Portmap) handleUptpStream(s network.Stream) {
 	go func(s network.Stream) {
 		// ps := stream.NewVarLenPacketStream(s, 32*1024)
@@ -331,25 +474,45 @@ func (pm *Portmap) handleUptpStream(s network.Stream) {
 		n, err := s.Read(hsbuf)
 		if err != nil {
 			s.Close()
-			logging.Error("[Portmap:handleUptpStream] read connection handshake error: %s", err)
+			// 对端连接池中未使用的stream超时关闭
+			if err != io.EOF {
+				logging.Error("[Portmap:handleUptpStream] read connection handshake error: %s", err)
+			}
 			return
 		}
-		network, addr, port, err := pm.funcHandleHandshake(hsbuf[:n])
+		network, addr, port, err := pm.funcHandleHandshake(s.Conn().RemotePeer().String(), hsbuf[:n])
 		if err != nil {
 			errMsg = err.Error()
 			logging.Error("[Portmap:handleUptpStream] handle handshake error: %s", err)
 			return
 		}
+		if h, ok := pm.connHandlers[network]; ok {
+			rspBuf, err := json.Marshal(handshakeRsp{
+				Msg: "ok",
+			})
+			if err != nil {
+				errMsg = "marshal rsp failed"
+				return
+			}
+			_, err = s.Write(rspBuf)
+			if err != nil {
+				s.Close()
+				logging.Error("[Portmap:handleUptpStream] write connection handshake error: %s", err)
+				return
+			}
+			h(&streamConn{s}, addr, port)
+			return
+		}
 		var conn net.Conn
 		if network == "tcp" {
-			conn, err = net.DialTimeout("tcp", fmt.Sprintf("%s:%d", addr, port), time.Second*5)
+			conn, err = net.DialTimeout("tcp", joinHostPort(addr, port), time.Second*5)
 			if err != nil {
 				errMsg = "connect target addr failed"
 				logging.Error("[Portmap:handleUptpStream] dial tcp connection error: %s", err)
 				return
 			}
 		} else {
-			ua, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", addr, port))
+			ua, err := net.ResolveUDPAddr("udp", joinHostPort(addr, port))
 			if err != nil {
 				errMsg = "resolve target addr failed"
 				logging.Error("[Portmap:handleUptpStream] resolve target udp addr error: %s", err)
@@ -410,6 +573,8 @@ func (pm *Portmap) Close() error {
 	}
 	pm.listeners = make(map[string]relayListener)
 
+	pm.pool.stop()
+
 	// Close connEngine which will close all connections
 	if pm.connEngine != nil {
 		pm.connEngine.Stop()
@@ -420,5 +585,75 @@ func (pm *Portmap) Close() error {
 }
 
 func convertIndex(network string, ip string, port int) string {
-	return fmt.Sprintf("%s://%s:%d", network, ip, port)
+	return fmt.Sprintf("%s://%s", network, joinHostPort(normalizeIP(ip), port))
+}
+
+// joinHostPort 拼接地址和端口，兼容带方括号的IPv6地址
+func joinHostPort(host string, port int) string {
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+}
+
+// normalizeIP 统一IP的文本形式，"::0"与"::"等写法得到相同的listener索引
+func normalizeIP(ip string) string {
+	ip = strings.Trim(ip, "[]")
+	if pip := net.ParseIP(ip); pip != nil {
+		return pip.String()
+	}
+	return ip
+}
+
+// listenNetwork IPv4地址只监听v4，IPv6地址或空地址使用双栈
+func listenNetwork(network string, ip string) string {
+	pip := net.ParseIP(strings.Trim(ip, "[]"))
+	if pip != nil && pip.To4() != nil {
+		return network + "4"
+	}
+	return network
+}
+
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+type streamAddr struct {
+	network string
+	address string
+}
+
+func (a *streamAddr) Network() string {
+	return a.network
+}
+
+func (a *streamAddr) String() string {
+	return a.address
+}
+
+// streamConn 把libp2p stream包装成net.Conn
+type streamConn struct {
+	network.Stream
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return &streamAddr{
+		network: "libp2p",
+		address: c.Conn().LocalPeer().String(),
+	}
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return &streamAddr{
+		network: "libp2p",
+		address: c.Conn().RemotePeer().String(),
+	}
 }
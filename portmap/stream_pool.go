@@ -0,0 +1,228 @@
+package portmap
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	streamPoolSize     = 4
+	pooledStreamTTL    = 30 * time.Second
+	warmupInterval     = 20 * time.Second
+	warmupConnTimeout  = 10 * time.Second
+	warmupProtectTag   = "portmap"
+	handshakeTimeout   = 10 * time.Second
+	maxPendingDataSize = 256 * 1024
+)
+
+type pooledStream struct {
+	s       network.Stream
+	created time.Time
+}
+
+// streamPool 为运行中的应用预先连接网关并保持一定数量已协商协议的stream，
+// 新连接到来时直接发送握手，省去打开stream的往返
+type streamPool struct {
+	h host.Host
+
+	mtx     sync.Mutex
+	refs    map[peer.ID]int
+	streams map[peer.ID][]pooledStream
+	filling map[peer.ID]bool
+
+	exitCh chan struct{}
+	once   sync.Once
+}
+
+func newStreamPool(h host.Host) *streamPool {
+	return &streamPool{
+		h:       h,
+		refs:    make(map[peer.ID]int),
+		streams: make(map[peer.ID][]pooledStream),
+		filling: make(map[peer.ID]bool),
+		exitCh:  make(chan struct{}),
+	}
+}
+
+func (sp *streamPool) start() {
+	go func() {
+		tk := time.NewTicker(warmupInterval)
+		defer tk.Stop()
+		for {
+			select {
+			case <-sp.exitCh:
+				return
+			case <-tk.C:
+			}
+			sp.mtx.Lock()
+			peers := make([]peer.ID, 0, len(sp.refs))
+			for pid := range sp.refs {
+				peers = append(peers, pid)
+			}
+			sp.mtx.Unlock()
+			for _, pid := range peers {
+				sp.expire(pid)
+				go sp.fill(pid)
+			}
+		}
+	}()
+}
+
+func (sp *streamPool) stop() {
+	sp.once.Do(func() {
+		close(sp.exitCh)
+	})
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	for pid, l := range sp.streams {
+		for _, ps := range l {
+			ps.s.Close()
+		}
+		delete(sp.streams, pid)
+	}
+	for pid := range sp.refs {
+		sp.h.ConnManager().Unprotect(pid, warmupProtectTag)
+	}
+	sp.refs = make(map[peer.ID]int)
+}
+
+// warmUp 增加网关的引用计数，第一次引用时预先连接并填充stream
+func (sp *streamPool) warmUp(peers []string) {
+	for _, p := range peers {
+		pid, err := peer.Decode(p)
+		if err != nil {
+			continue
+		}
+		sp.mtx.Lock()
+		sp.refs[pid]++
+		first := sp.refs[pid] == 1
+		sp.mtx.Unlock()
+		if first {
+			sp.h.ConnManager().Protect(pid, warmupProtectTag)
+			go sp.fill(pid)
+		}
+	}
+}
+
+// coolDown 减少网关的引用计数，没有应用使用时关闭预先打开的stream
+func (sp *streamPool) coolDown(peers []string) {
+	for _, p := range peers {
+		pid, err := peer.Decode(p)
+		if err != nil {
+			continue
+		}
+		sp.mtx.Lock()
+		if sp.refs[pid] > 1 {
+			sp.refs[pid]--
+			sp.mtx.Unlock()
+			continue
+		}
+		_, ok := sp.refs[pid]
+		delete(sp.refs, pid)
+		l := sp.streams[pid]
+		delete(sp.streams, pid)
+		sp.mtx.Unlock()
+		for _, ps := range l {
+			ps.s.Close()
+		}
+		if ok {
+			sp.h.ConnManager().Unprotect(pid, warmupProtectTag)
+		}
+	}
+}
+
+// get 优先取出池中的stream，pooled表示stream来自连接池
+func (sp *streamPool) get(pid peer.ID) (s network.Stream, pooled bool, err error) {
+	sp.mtx.Lock()
+	l := sp.streams[pid]
+	for len(l) > 0 {
+		ps := l[len(l)-1]
+		l = l[:len(l)-1]
+		if time.Since(ps.created) < pooledStreamTTL {
+			s = ps.s
+			break
+		}
+		ps.s.Close()
+	}
+	sp.streams[pid] = l
+	_, warm := sp.refs[pid]
+	sp.mtx.Unlock()
+	if warm {
+		go sp.fill(pid)
+	}
+	if s != nil {
+		return s, true, nil
+	}
+	s, err = sp.h.NewStream(context.Background(), pid, portmapID)
+	return s, false, err
+}
+
+// expire 关闭超时的stream，避免长期空闲的stream被中间设备断开
+func (sp *streamPool) expire(pid peer.ID) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	l := sp.streams[pid]
+	n := 0
+	for _, ps := range l {
+		if time.Since(ps.created) < pooledStreamTTL {
+			l[n] = ps
+			n++
+			continue
+		}
+		ps.s.Close()
+	}
+	sp.streams[pid] = l[:n]
+}
+
+func (sp *streamPool) fill(pid peer.ID) {
+	sp.mtx.Lock()
+	if _, ok := sp.refs[pid]; !ok || sp.filling[pid] {
+		sp.mtx.Unlock()
+		return
+	}
+	sp.filling[pid] = true
+	sp.mtx.Unlock()
+	defer func() {
+		sp.mtx.Lock()
+		delete(sp.filling, pid)
+		sp.mtx.Unlock()
+	}()
+
+	if sp.h.Network().Connectedness(pid) != network.Connected {
+		ctx, cancel := context.WithTimeout(context.Background(), warmupConnTimeout)
+		err := sp.h.Connect(ctx, peer.AddrInfo{ID: pid})
+		cancel()
+		if err != nil {
+			logging.Warn("[Portmap:streamPool] connect peer %s error: %s", pid, err)
+			return
+		}
+	}
+	for {
+		sp.mtx.Lock()
+		_, ok := sp.refs[pid]
+		need := ok && len(sp.streams[pid]) < streamPoolSize
+		sp.mtx.Unlock()
+		if !need {
+			return
+		}
+		s, err := sp.h.NewStream(context.Background(), pid, portmapID)
+		if err != nil {
+			logging.Warn("[Portmap:streamPool] open stream to %s error: %s", pid, err)
+			return
+		}
+		sp.mtx.Lock()
+		if _, ok := sp.refs[pid]; !ok {
+			sp.mtx.Unlock()
+			s.Close()
+			return
+		}
+		sp.streams[pid] = append(sp.streams[pid], pooledStream{s: s, created: time.Now()})
+		sp.mtx.Unlock()
+	}
+}
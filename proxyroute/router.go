@@ -0,0 +1,227 @@
+package proxyroute
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isletnet/uptp/socks5"
+)
+
+// Entry 一条路由及其使用统计，K为出站的标识
+type Entry[K comparable] struct {
+	Prefix   netip.Prefix
+	Outbound K
+	Dialer   *socks5.Dialer
+	Default  bool
+
+	dials    atomic.Uint64
+	fails    atomic.Uint64
+	lastDial atomic.Int64
+}
+
+// Record 记录一次通过该路由的连接
+func (e *Entry[K]) Record(err error) {
+	e.dials.Add(1)
+	e.lastDial.Store(time.Now().Unix())
+	if err != nil {
+		e.fails.Add(1)
+	}
+}
+
+// RouteInfo 路由表中的一项，Prefix为空表示默认路由
+type RouteInfo[K comparable] struct {
+	Prefix   string `json:"prefix"`
+	Outbound K      `json:"outbound"`
+	Default  bool   `json:"default,omitempty"`
+	Dials    uint64 `json:"dials"`
+	Fails    uint64 `json:"fails"`
+	LastDial int64  `json:"last_dial"`
+}
+
+type trieNode[K comparable] struct {
+	child [2]*trieNode[K]
+	entry *Entry[K]
+}
+
+// Router 按目标地址最长前缀匹配出站，IPv4和IPv6各用一棵二叉前缀树，
+// 没有匹配的前缀时使用默认路由
+type Router[K comparable] struct {
+	mtx  sync.RWMutex
+	v4   *trieNode[K]
+	v6   *trieNode[K]
+	def  *Entry[K]
+	size int
+}
+
+func NewRouter[K comparable]() *Router[K] {
+	return &Router[K]{
+		v4: &trieNode[K]{},
+		v6: &trieNode[K]{},
+	}
+}
+
+func (r *Router[K]) root(addr netip.Addr) *trieNode[K] {
+	if addr.Is4() {
+		return r.v4
+	}
+	return r.v6
+}
+
+func addrBit(addr netip.Addr, i int) int {
+	b := addr.AsSlice()
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
+
+// AddRoute 添加路由，相同前缀的路由会被替换
+func (r *Router[K]) AddRoute(prefix netip.Prefix, outbound K, dialer *socks5.Dialer) bool {
+	if !prefix.IsValid() {
+		return false
+	}
+	prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+	if !prefix.IsValid() {
+		return false
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	n := r.root(prefix.Addr())
+	for i := 0; i < prefix.Bits(); i++ {
+		b := addrBit(prefix.Addr(), i)
+		if n.child[b] == nil {
+			n.child[b] = &trieNode[K]{}
+		}
+		n = n.child[b]
+	}
+	if n.entry == nil {
+		r.size++
+	}
+	n.entry = &Entry[K]{
+		Prefix:   prefix,
+		Outbound: outbound,
+		Dialer:   dialer,
+	}
+	return true
+}
+
+// DelRoute 删除前缀，不回收空节点，路由表规模很小
+func (r *Router[K]) DelRoute(prefix netip.Prefix) {
+	if !prefix.IsValid() {
+		return
+	}
+	prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	n := r.root(prefix.Addr())
+	for i := 0; i < prefix.Bits() && n != nil; i++ {
+		n = n.child[addrBit(prefix.Addr(), i)]
+	}
+	if n != nil && n.entry != nil {
+		n.entry = nil
+		r.size--
+	}
+}
+
+// DelOutbound 删除出站的所有路由，包括默认路由
+func (r *Router[K]) DelOutbound(outbound K) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.walk(func(n *trieNode[K]) {
+		if n.entry != nil && n.entry.Outbound == outbound {
+			n.entry = nil
+			r.size--
+		}
+	})
+	if r.def != nil && r.def.Outbound == outbound {
+		r.def = nil
+	}
+}
+
+func (r *Router[K]) SetDefault(outbound K, dialer *socks5.Dialer) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.def = &Entry[K]{
+		Outbound: outbound,
+		Dialer:   dialer,
+		Default:  true,
+	}
+}
+
+func (r *Router[K]) DefaultRoute() *Entry[K] {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.def
+}
+
+// Lookup 最长前缀匹配，返回nil表示没有路由
+func (r *Router[K]) Lookup(addr netip.Addr) *Entry[K] {
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return nil
+	}
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	var ret *Entry[K]
+	n := r.root(addr)
+	for i := 0; n != nil; i++ {
+		if n.entry != nil {
+			ret = n.entry
+		}
+		if i >= addr.BitLen() {
+			break
+		}
+		n = n.child[addrBit(addr, i)]
+	}
+	if ret == nil {
+		ret = r.def
+	}
+	return ret
+}
+
+// List 返回所有路由及统计，按前缀排序，默认路由在最后
+func (r *Router[K]) List() []RouteInfo[K] {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	ret := make([]RouteInfo[K], 0, r.size+1)
+	r.walk(func(n *trieNode[K]) {
+		if n.entry != nil {
+			ret = append(ret, n.entry.info())
+		}
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Prefix < ret[j].Prefix
+	})
+	if r.def != nil {
+		ret = append(ret, r.def.info())
+	}
+	return ret
+}
+
+func (r *Router[K]) walk(f func(n *trieNode[K])) {
+	var visit func(n *trieNode[K])
+	visit = func(n *trieNode[K]) {
+		if n == nil {
+			return
+		}
+		f(n)
+		visit(n.child[0])
+		visit(n.child[1])
+	}
+	visit(r.v4)
+	visit(r.v6)
+}
+
+func (e *Entry[K]) info() RouteInfo[K] {
+	ri := RouteInfo[K]{
+		Outbound: e.Outbound,
+		Default:  e.Default,
+		Dials:    e.dials.Load(),
+		Fails:    e.fails.Load(),
+		LastDial: e.lastDial.Load(),
+	}
+	if !e.Default {
+		ri.Prefix = e.Prefix.String()
+	}
+	return ri
+}
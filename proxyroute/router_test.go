@@ -0,0 +1,182 @@
+package proxyroute
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/isletnet/uptp/socks5"
+)
+
+func mustPrefix(t *testing.T, s string) netip.Prefix {
+	t.Helper()
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func lookupOutbound(r *Router[uint64], addr string) uint64 {
+	e := r.Lookup(netip.MustParseAddr(addr))
+	if e == nil {
+		return 0
+	}
+	return e.Outbound
+}
+
+func TestProxyRouterLongestPrefixMatch(t *testing.T) {
+	r := NewRouter[uint64]()
+	d := &socks5.Dialer{}
+	r.AddRoute(mustPrefix(t, "10.0.0.0/8"), 1, d)
+	r.AddRoute(mustPrefix(t, "10.1.0.0/16"), 2, d)
+	r.AddRoute(mustPrefix(t, "10.1.2.0/24"), 3, d)
+	r.AddRoute(mustPrefix(t, "10.1.2.3/32"), 4, d)
+
+	tests := []struct {
+		addr string
+		want uint64
+	}{
+		{"10.9.9.9", 1},
+		{"10.1.9.9", 2},
+		{"10.1.2.9", 3},
+		{"10.1.2.3", 4},
+		{"::ffff:10.1.2.3", 4},
+		{"11.0.0.1", 0},
+		{"fd00::1", 0},
+	}
+	for _, tt := range tests {
+		if got := lookupOutbound(r, tt.addr); got != tt.want {
+			t.Errorf("lookup(%s) = %d, want %d", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestProxyRouterIPv6(t *testing.T) {
+	r := NewRouter[uint64]()
+	d := &socks5.Dialer{}
+	r.AddRoute(mustPrefix(t, "2001:db8::/32"), 1, d)
+	r.AddRoute(mustPrefix(t, "2001:db8:1::/48"), 2, d)
+	r.AddRoute(mustPrefix(t, "0.0.0.0/0"), 3, d)
+
+	tests := []struct {
+		addr string
+		want uint64
+	}{
+		{"2001:db8:2::1", 1},
+		{"2001:db8:1::1", 2},
+		// IPv4的/0不匹配IPv6地址
+		{"2001:db9::1", 0},
+		{"1.2.3.4", 3},
+	}
+	for _, tt := range tests {
+		if got := lookupOutbound(r, tt.addr); got != tt.want {
+			t.Errorf("lookup(%s) = %d, want %d", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestProxyRouterDelete(t *testing.T) {
+	r := NewRouter[uint64]()
+	d := &socks5.Dialer{}
+	r.AddRoute(mustPrefix(t, "192.168.0.0/16"), 1, d)
+	r.AddRoute(mustPrefix(t, "192.168.1.0/24"), 2, d)
+	r.AddRoute(mustPrefix(t, "172.16.0.0/12"), 2, d)
+
+	r.DelRoute(mustPrefix(t, "192.168.1.0/24"))
+	if got := lookupOutbound(r, "192.168.1.1"); got != 1 {
+		t.Errorf("after delRoute lookup = %d, want 1", got)
+	}
+	// 删除不存在的前缀不影响其他路由
+	r.DelRoute(mustPrefix(t, "192.168.2.0/24"))
+	if got := lookupOutbound(r, "192.168.2.1"); got != 1 {
+		t.Errorf("after delRoute missing lookup = %d, want 1", got)
+	}
+
+	r.DelOutbound(2)
+	if got := lookupOutbound(r, "172.16.0.1"); got != 0 {
+		t.Errorf("after delOutbound lookup = %d, want 0", got)
+	}
+	if n := len(r.List()); n != 1 {
+		t.Errorf("list len = %d, want 1", n)
+	}
+}
+
+func TestProxyRouterReplace(t *testing.T) {
+	r := NewRouter[uint64]()
+	d := &socks5.Dialer{}
+	r.AddRoute(mustPrefix(t, "10.0.0.0/8"), 1, d)
+	r.AddRoute(mustPrefix(t, "10.1.1.1/8"), 2, d)
+	if got := lookupOutbound(r, "10.0.0.1"); got != 2 {
+		t.Errorf("lookup = %d, want 2", got)
+	}
+	if n := len(r.List()); n != 1 {
+		t.Errorf("list len = %d, want 1", n)
+	}
+	if r.AddRoute(netip.Prefix{}, 3, d) {
+		t.Error("addRoute accepted invalid prefix")
+	}
+}
+
+func TestProxyRouterDefault(t *testing.T) {
+	r := NewRouter[uint64]()
+	d := &socks5.Dialer{}
+	r.AddRoute(mustPrefix(t, "10.0.0.0/8"), 1, d)
+	r.SetDefault(2, d)
+
+	if got := lookupOutbound(r, "10.0.0.1"); got != 1 {
+		t.Errorf("lookup = %d, want 1", got)
+	}
+	if got := lookupOutbound(r, "8.8.8.8"); got != 2 {
+		t.Errorf("lookup = %d, want 2", got)
+	}
+	if got := lookupOutbound(r, "2001:db8::1"); got != 2 {
+		t.Errorf("lookup = %d, want 2", got)
+	}
+	if !r.Lookup(netip.MustParseAddr("8.8.8.8")).Default {
+		t.Error("default route not marked")
+	}
+
+	// 删除其他出站不影响默认路由
+	r.DelOutbound(1)
+	if got := lookupOutbound(r, "10.0.0.1"); got != 2 {
+		t.Errorf("lookup = %d, want 2", got)
+	}
+	r.DelOutbound(2)
+	if e := r.Lookup(netip.MustParseAddr("8.8.8.8")); e != nil {
+		t.Errorf("lookup after delete default = %v, want nil", e.Outbound)
+	}
+}
+
+func TestProxyRouterMetrics(t *testing.T) {
+	r := NewRouter[uint64]()
+	d := &socks5.Dialer{}
+	r.AddRoute(mustPrefix(t, "10.0.0.0/8"), 1, d)
+	r.AddRoute(mustPrefix(t, "10.1.0.0/16"), 2, d)
+	r.SetDefault(3, d)
+
+	r.Lookup(netip.MustParseAddr("10.1.0.1")).Record(nil)
+	r.Lookup(netip.MustParseAddr("10.1.0.2")).Record(errors.New("dial failed"))
+	r.Lookup(netip.MustParseAddr("10.2.0.1")).Record(nil)
+	r.Lookup(netip.MustParseAddr("8.8.8.8")).Record(nil)
+
+	routes := r.List()
+	if len(routes) != 3 {
+		t.Fatalf("list len = %d, want 3", len(routes))
+	}
+	want := []RouteInfo[uint64]{
+		{Prefix: "10.0.0.0/8", Outbound: 1, Dials: 1},
+		{Prefix: "10.1.0.0/16", Outbound: 2, Dials: 2, Fails: 1},
+		{Outbound: 3, Default: true, Dials: 1},
+	}
+	for i, w := range want {
+		got := routes[i]
+		if got.Prefix != w.Prefix || got.Outbound != w.Outbound || got.Default != w.Default ||
+			got.Dials != w.Dials || got.Fails != w.Fails {
+			t.Errorf("routes[%d] = %+v, want %+v", i, got, w)
+		}
+		if got.LastDial == 0 {
+			t.Errorf("routes[%d] last dial not set", i)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lesismal/nbio/logging"
+	"github.com/txthinking/socks5"
+)
+
+// DialFunc 本地代理建立出站连接的方法，一般为Dialer.DialContext
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+const (
+	localDialTimeout      = 30 * time.Second
+	localHandshakeTimeout = 30 * time.Second
+)
+
+// LocalServer 本地代理，同一个端口同时支持SOCKS5和HTTP代理(CONNECT及普通请求)，
+// 供浏览器、git等应用在不使用TUN的情况下通过网关访问
+type LocalServer struct {
+	ln   net.Listener
+	dial DialFunc
+
+	transport *http.Transport
+
+	mtx   sync.Mutex
+	conns map[net.Conn]struct{}
+	done  bool
+}
+
+func NewLocalServer(addr string, dial DialFunc) (*LocalServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ls := &LocalServer{
+		ln:    ln,
+		dial:  dial,
+		conns: make(map[net.Conn]struct{}),
+	}
+	ls.transport = &http.Transport{
+		DialContext:         dial,
+		Proxy:               nil,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     time.Minute,
+	}
+	return ls, nil
+}
+
+func (ls *LocalServer) Addr() net.Addr {
+	return ls.ln.Addr()
+}
+
+func (ls *LocalServer) Serve() error {
+	for {
+		c, err := ls.ln.Accept()
+		if err != nil {
+			return err
+		}
+		if !ls.track(c) {
+			c.Close()
+			continue
+		}
+		go func() {
+			defer ls.untrack(c)
+			defer c.Close()
+			err := ls.handleConn(c)
+			if shouldLogError(err) {
+				logging.Error("local proxy %s error: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close 关闭监听和所有正在代理的连接
+func (ls *LocalServer) Close() error {
+	err := ls.ln.Close()
+	ls.mtx.Lock()
+	ls.done = true
+	for c := range ls.conns {
+		c.Close()
+	}
+	ls.mtx.Unlock()
+	ls.transport.CloseIdleConnections()
+	return err
+}
+
+func (ls *LocalServer) track(c net.Conn) bool {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	if ls.done {
+		return false
+	}
+	ls.conns[c] = struct{}{}
+	return true
+}
+
+func (ls *LocalServer) untrack(c net.Conn) {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	delete(ls.conns, c)
+}
+
+// handleConn 根据第一个字节区分SOCKS5和HTTP
+func (ls *LocalServer) handleConn(c net.Conn) error {
+	c.SetDeadline(time.Now().Add(localHandshakeTimeout))
+	br := bufio.NewReader(c)
+	b, err := br.Peek(1)
+	if err != nil {
+		return err
+	}
+	rw := &bufConn{Conn: c, r: br}
+	if b[0] == socks5.Ver {
+		return ls.handleSocks5(rw)
+	}
+	return ls.handleHTTP(rw, br)
+}
+
+func (ls *LocalServer) handleSocks5(c *bufConn) error {
+	nrq, err := socks5.NewNegotiationRequestFrom(c)
+	if err != nil {
+		return err
+	}
+	method := socks5.MethodUnsupportAll
+	for _, m := range nrq.Methods {
+		if m == socks5.MethodNone {
+			method = socks5.MethodNone
+			break
+		}
+	}
+	if _, err := socks5.NewNegotiationReply(method).WriteTo(c); err != nil {
+		return err
+	}
+	if method != socks5.MethodNone {
+		return errors.New("no acceptable authentication methods")
+	}
+	req, err := socks5.NewRequestFrom(c)
+	if err != nil {
+		return err
+	}
+	if req.Cmd != socks5.CmdConnect {
+		replyErr(req, c, socks5.RepCommandNotSupported)
+		return socks5.ErrUnsupportCmd
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), localDialTimeout)
+	target, err := ls.dial(ctx, "tcp", req.Address())
+	cancel()
+	if err != nil {
+		replyErr(req, c, socks5.RepHostUnreachable)
+		return err
+	}
+	defer target.Close()
+	reply := socks5.NewReply(socks5.RepSuccess, socks5.ATYPIPv4, []byte{0x00, 0x00, 0x00, 0x00}, []byte{0x00, 0x00})
+	if _, err := reply.WriteTo(c); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+	return tunneling(target, c)
+}
+
+func (ls *LocalServer) handleHTTP(c *bufConn, br *bufio.Reader) error {
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return err
+		}
+		c.SetDeadline(time.Time{})
+		if req.Method == http.MethodConnect {
+			return ls.handleConnect(c, req)
+		}
+		keepAlive, err := ls.forwardHTTP(c, req)
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+func (ls *LocalServer) handleConnect(c *bufConn, req *http.Request) error {
+	ctx, cancel := context.WithTimeout(context.Background(), localDialTimeout)
+	target, err := ls.dial(ctx, "tcp", hostWithPort(req.Host, "443"))
+	cancel()
+	if err != nil {
+		io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return err
+	}
+	defer target.Close()
+	if _, err := io.WriteString(c, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return err
+	}
+	return tunneling(target, c)
+}
+
+// forwardHTTP 转发普通HTTP代理请求，返回客户端连接是否可以继续使用
+func (ls *LocalServer) forwardHTTP(c *bufConn, req *http.Request) (bool, error) {
+	if req.URL.Host == "" {
+		io.WriteString(c, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return false, nil
+	}
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = "http"
+	}
+	req.RequestURI = ""
+	closeAfter := req.Close
+	for _, h := range []string{"Proxy-Connection", "Proxy-Authorization", "Connection", "Keep-Alive", "Te", "Trailer", "Upgrade"} {
+		req.Header.Del(h)
+	}
+	rsp, err := ls.transport.RoundTrip(req)
+	if err != nil {
+		io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return false, err
+	}
+	defer rsp.Body.Close()
+	rsp.Close = closeAfter
+	if err := rsp.Write(c); err != nil {
+		return false, err
+	}
+	return !closeAfter, nil
+}
+
+func hostWithPort(host, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
+
+// bufConn 读取时先消耗探测协议时缓存的数据
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
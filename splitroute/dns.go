@@ -0,0 +1,281 @@
+package splitroute
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/isletnet/uptp/logging"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	fakeIPTTL       = 60
+	dnsForwardTime  = 5 * time.Second
+	maxDNSPacketLen = 4096
+)
+
+// ForwardFunc 把没有命中规则的查询转发给上游，返回上游的应答
+type ForwardFunc func(query []byte) ([]byte, error)
+
+// Answer 命中规则的查询在本地应答：代理和直连规则返回假IP，拒绝规则返回NXDOMAIN，
+// handled为false时需要转发给上游
+func (r *Router) Answer(query []byte) (rsp []byte, handled bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil, false
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 || qs[0].Class != dnsmessage.ClassINET {
+		return nil, false
+	}
+	q := qs[0]
+	domain := normalizeDomain(q.Name.String())
+	rule, ok := r.MatchDomain(domain)
+	if !ok {
+		return nil, false
+	}
+
+	rh := dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeSuccess,
+	}
+	if rule.Action == ActionReject {
+		rh.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), rh)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false
+	}
+	if err := b.Question(q); err != nil {
+		return nil, false
+	}
+	// AAAA等其他类型返回空应答，客户端回退到A记录
+	if rule.Action != ActionReject && q.Type == dnsmessage.TypeA {
+		if err := b.StartAnswers(); err != nil {
+			return nil, false
+		}
+		ip := r.pool.alloc(domain)
+		err = b.AResource(dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   fakeIPTTL,
+		}, dnsmessage.AResource{A: ip.As4()})
+		if err != nil {
+			return nil, false
+		}
+	}
+	rsp, err = b.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return rsp, true
+}
+
+// Exchange 先尝试本地应答，否则转发给上游
+func (r *Router) Exchange(query []byte, forward ForwardFunc) ([]byte, error) {
+	if rsp, ok := r.Answer(query); ok {
+		return rsp, nil
+	}
+	return forward(query)
+}
+
+// UDPForwarder 通过UDP把查询转发给upstream(ip:port)
+func UDPForwarder(upstream string) ForwardFunc {
+	return func(query []byte) ([]byte, error) {
+		c, err := net.DialTimeout("udp", upstream, dnsForwardTime)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(dnsForwardTime))
+		if _, err := c.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, maxDNSPacketLen)
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// ServeDNS 在pc上提供DNS服务，pc关闭后返回
+func (r *Router) ServeDNS(pc net.PacketConn, forward ForwardFunc) error {
+	for {
+		buf := make([]byte, maxDNSPacketLen)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			rsp, err := r.Exchange(buf[:n], forward)
+			if err != nil {
+				logging.Debug("[splitroute] dns exchange for %s error: %s", addr, err)
+				return
+			}
+			pc.WriteTo(rsp, addr)
+		}()
+	}
+}
+
+// dnsPacketConn TUN内DNS流的处理：命中规则的查询直接应答，
+// 其他查询写入上游连接，上游连接在第一次需要时才建立
+type dnsPacketConn struct {
+	r     *Router
+	dial  func() (net.PacketConn, error)
+	laddr net.Addr
+	raddr net.Addr
+
+	upMtx    sync.Mutex
+	upstream net.PacketConn
+
+	mtx      sync.Mutex
+	deadline time.Time
+
+	rspCh   chan []byte
+	closeCh chan struct{}
+	once    sync.Once
+}
+
+// NewDNSPacketConn raddr为客户端查询的DNS服务器地址，应答都以该地址为来源
+func (r *Router) NewDNSPacketConn(laddr, raddr net.Addr, dial func() (net.PacketConn, error)) net.PacketConn {
+	return &dnsPacketConn{
+		r:       r,
+		dial:    dial,
+		laddr:   laddr,
+		raddr:   raddr,
+		rspCh:   make(chan []byte, 16),
+		closeCh: make(chan struct{}),
+	}
+}
+
+func (c *dnsPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	select {
+	case <-c.closeCh:
+		return 0, net.ErrClosed
+	default:
+	}
+	if rsp, ok := c.r.Answer(p); ok {
+		c.push(rsp)
+		return len(p), nil
+	}
+	up, err := c.getUpstream()
+	if err != nil {
+		return 0, err
+	}
+	return up.WriteTo(p, c.raddr)
+}
+
+func (c *dnsPacketConn) getUpstream() (net.PacketConn, error) {
+	c.upMtx.Lock()
+	defer c.upMtx.Unlock()
+	if c.upstream != nil {
+		return c.upstream, nil
+	}
+	up, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.upstream = up
+	go func() {
+		for {
+			buf := make([]byte, maxDNSPacketLen)
+			n, _, err := up.ReadFrom(buf)
+			if err != nil {
+				c.Close()
+				return
+			}
+			c.push(buf[:n])
+		}
+	}()
+	return up, nil
+}
+
+func (c *dnsPacketConn) push(rsp []byte) {
+	select {
+	case c.rspCh <- rsp:
+	case <-c.closeCh:
+	default:
+		// 客户端不读取时丢弃，DNS客户端会重试
+	}
+}
+
+func (c *dnsPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mtx.Lock()
+	deadline := c.deadline
+	c.mtx.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case rsp := <-c.rspCh:
+		return copy(p, rsp), c.raddr, nil
+	case <-c.closeCh:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *dnsPacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.closeCh)
+		c.upMtx.Lock()
+		if c.upstream != nil {
+			c.upstream.Close()
+		}
+		c.upMtx.Unlock()
+	})
+	return nil
+}
+
+func (c *dnsPacketConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *dnsPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *dnsPacketConn) SetReadDeadline(t time.Time) error {
+	c.mtx.Lock()
+	c.deadline = t
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *dnsPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// fixedAddrPacketConn 把已连接的conn包装成PacketConn，读取时总是返回addr，
+// 用于按域名建立的UDP流，tun2socks按假IP地址匹配应答来源
+type fixedAddrPacketConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func NewFixedAddrPacketConn(c net.Conn, addr net.Addr) net.PacketConn {
+	return &fixedAddrPacketConn{Conn: c, addr: addr}
+}
+
+func (c *fixedAddrPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Conn.Read(p)
+	return n, c.addr, err
+}
+
+func (c *fixedAddrPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,91 @@
+package splitroute
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildQuery(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  typ,
+		Class: dnsmessage.ClassINET,
+	})
+	buf, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func parseAnswer(t *testing.T, rsp []byte) (dnsmessage.Header, []dnsmessage.Resource) {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(rsp); err != nil {
+		t.Fatal(err)
+	}
+	return m.Header, m.Answers
+}
+
+func TestAnswer(t *testing.T) {
+	r, err := NewRouter("", Rules{
+		{Match: MatchSuffix, Value: "proxy.com", Action: ActionProxy},
+		{Match: MatchSuffix, Value: "block.com", Action: ActionReject},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsp, ok := r.Answer(buildQuery(t, "www.proxy.com.", dnsmessage.TypeA))
+	if !ok {
+		t.Fatal("matched query not handled")
+	}
+	h, ans := parseAnswer(t, rsp)
+	if h.ID != 1234 || !h.Response || h.RCode != dnsmessage.RCodeSuccess || len(ans) != 1 {
+		t.Fatalf("header %+v, answers %d", h, len(ans))
+	}
+	a := ans[0].Body.(*dnsmessage.AResource)
+	ip := netip.AddrFrom4(a.A)
+	if !r.IsFakeIP(ip) || ans[0].Header.TTL != fakeIPTTL {
+		t.Errorf("answer %s ttl %d", ip, ans[0].Header.TTL)
+	}
+	if d, _, _ := r.LookupFakeIP(ip); d != "www.proxy.com" {
+		t.Errorf("fake ip domain = %q", d)
+	}
+
+	// AAAA返回空应答
+	rsp, ok = r.Answer(buildQuery(t, "www.proxy.com.", dnsmessage.TypeAAAA))
+	if h, ans = parseAnswer(t, rsp); !ok || h.RCode != dnsmessage.RCodeSuccess || len(ans) != 0 {
+		t.Errorf("AAAA: handled %v, rcode %s, answers %d", ok, h.RCode, len(ans))
+	}
+
+	rsp, ok = r.Answer(buildQuery(t, "a.block.com.", dnsmessage.TypeA))
+	if h, ans = parseAnswer(t, rsp); !ok || h.RCode != dnsmessage.RCodeNameError || len(ans) != 0 {
+		t.Errorf("reject: handled %v, rcode %s, answers %d", ok, h.RCode, len(ans))
+	}
+
+	if _, ok := r.Answer(buildQuery(t, "other.com.", dnsmessage.TypeA)); ok {
+		t.Error("unmatched query handled")
+	}
+	if _, ok := r.Answer([]byte{1, 2, 3}); ok {
+		t.Error("broken query handled")
+	}
+}
+
+func TestExchangeForward(t *testing.T) {
+	r, _ := NewRouter("", Rules{{Match: MatchFull, Value: "local.com", Action: ActionDirect}})
+	errForward := errors.New("forwarded")
+	forward := func([]byte) ([]byte, error) { return nil, errForward }
+	if _, err := r.Exchange(buildQuery(t, "local.com.", dnsmessage.TypeA), forward); err != nil {
+		t.Errorf("matched query forwarded: %v", err)
+	}
+	if _, err := r.Exchange(buildQuery(t, "remote.com.", dnsmessage.TypeA), forward); err != errForward {
+		t.Errorf("unmatched query err = %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package splitroute
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+)
+
+const DefaultFakeIPRange = "198.18.0.0/15"
+
+// fakeIPPool 为命中规则的域名分配地址段内的假IP，地址用完后循环复用最早分配的地址
+type fakeIPPool struct {
+	prefix netip.Prefix
+	first  netip.Addr
+	last   netip.Addr
+
+	mtx      sync.Mutex
+	next     netip.Addr
+	byIP     map[netip.Addr]string
+	byDomain map[string]netip.Addr
+}
+
+func newFakeIPPool(prefix netip.Prefix) (*fakeIPPool, error) {
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() || prefix.Bits() > 30 {
+		return nil, errors.New("fake ip range must be an ipv4 prefix no smaller than /30")
+	}
+	// 跳过网络地址和广播地址
+	first := prefix.Addr().Next()
+	last := lastAddr(prefix).Prev()
+	return &fakeIPPool{
+		prefix:   prefix,
+		first:    first,
+		last:     last,
+		next:     first,
+		byIP:     make(map[netip.Addr]string),
+		byDomain: make(map[string]netip.Addr),
+	}, nil
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().As4()
+	bits := p.Bits()
+	for i := bits; i < 32; i++ {
+		b[i/8] |= 1 << (7 - uint(i%8))
+	}
+	return netip.AddrFrom4(b)
+}
+
+func (p *fakeIPPool) contains(ip netip.Addr) bool {
+	return p.prefix.Contains(ip.Unmap())
+}
+
+func (p *fakeIPPool) alloc(domain string) netip.Addr {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if ip, ok := p.byDomain[domain]; ok {
+		return ip
+	}
+	ip := p.next
+	if old, ok := p.byIP[ip]; ok {
+		delete(p.byDomain, old)
+	}
+	p.byIP[ip] = domain
+	p.byDomain[domain] = ip
+	if p.next == p.last {
+		p.next = p.first
+	} else {
+		p.next = p.next.Next()
+	}
+	return ip
+}
+
+func (p *fakeIPPool) lookup(ip netip.Addr) (string, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	d, ok := p.byIP[ip.Unmap()]
+	return d, ok
+}
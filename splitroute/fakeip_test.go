@@ -0,0 +1,70 @@
+package splitroute
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	if _, err := newFakeIPPool(netip.MustParsePrefix("10.0.0.0/31")); err == nil {
+		t.Error("/31 accepted")
+	}
+	if _, err := newFakeIPPool(netip.MustParsePrefix("fd00::/64")); err == nil {
+		t.Error("ipv6 accepted")
+	}
+
+	// /29 去掉网络地址和广播地址后有6个可用地址
+	p, err := newFakeIPPool(netip.MustParsePrefix("10.0.0.0/29"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.alloc("a.com")
+	if a != netip.MustParseAddr("10.0.0.1") {
+		t.Fatalf("first ip = %s", a)
+	}
+	if p.alloc("a.com") != a {
+		t.Error("same domain got a new ip")
+	}
+	for i := 0; i < 5; i++ {
+		p.alloc(string(rune('b'+i)) + ".com")
+	}
+	if ip := p.alloc("f.com"); ip != netip.MustParseAddr("10.0.0.6") {
+		t.Fatalf("last ip = %s", ip)
+	}
+	// 地址用完后复用最早分配的地址，旧域名失效
+	if ip := p.alloc("g.com"); ip != a {
+		t.Fatalf("wrapped ip = %s, want %s", ip, a)
+	}
+	if d, ok := p.lookup(a); !ok || d != "g.com" {
+		t.Errorf("lookup(%s) = %q,%v", a, d, ok)
+	}
+	if ip := p.alloc("a.com"); ip == a {
+		t.Error("expired domain kept its ip")
+	}
+	if !p.contains(netip.MustParseAddr("::ffff:10.0.0.3")) || p.contains(netip.MustParseAddr("10.0.0.8")) {
+		t.Error("contains")
+	}
+}
+
+func TestRouterLookupFakeIP(t *testing.T) {
+	r, err := NewRouter("", Rules{{Match: MatchSuffix, Value: "a.com", Action: ActionProxy}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FakeRange().String() != DefaultFakeIPRange {
+		t.Fatalf("range = %s", r.FakeRange())
+	}
+	ip := r.pool.alloc("www.a.com")
+	d, rule, err := r.LookupFakeIP(ip)
+	if err != nil || d != "www.a.com" || rule.Action != ActionProxy {
+		t.Fatalf("lookup = %q %+v %v", d, rule, err)
+	}
+	// 规则删除后假IP仍能找回域名，规则为空
+	r.SetRules(nil)
+	if _, rule, err := r.LookupFakeIP(ip); err != nil || rule.Action != "" {
+		t.Errorf("lookup after rules removed = %+v %v", rule, err)
+	}
+	if _, _, err := r.LookupFakeIP(ip.Next()); err != ErrFakeIPExpired {
+		t.Errorf("unallocated ip err = %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package splitroute
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+)
+
+var ErrFakeIPExpired = errors.New("fake ip has no domain")
+
+// Router 域名分流，命中规则的域名通过假IP进入TUN，连接时再用假IP找回域名和规则
+type Router struct {
+	pool *fakeIPPool
+
+	mtx   sync.RWMutex
+	rules Rules
+}
+
+func NewRouter(fakeRange string, rules Rules) (*Router, error) {
+	if fakeRange == "" {
+		fakeRange = DefaultFakeIPRange
+	}
+	prefix, err := netip.ParsePrefix(fakeRange)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := newFakeIPPool(prefix)
+	if err != nil {
+		return nil, err
+	}
+	r := &Router{pool: pool}
+	if err := r.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Router) FakeRange() netip.Prefix {
+	return r.pool.prefix
+}
+
+func (r *Router) SetRules(rules Rules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	r.mtx.Lock()
+	r.rules = rules
+	r.mtx.Unlock()
+	return nil
+}
+
+func (r *Router) Rules() Rules {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return append(Rules(nil), r.rules...)
+}
+
+func (r *Router) MatchDomain(domain string) (Rule, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.rules.Match(domain)
+}
+
+func (r *Router) IsFakeIP(ip netip.Addr) bool {
+	return r.pool.contains(ip)
+}
+
+// LookupFakeIP 找回假IP对应的域名及当前生效的规则，规则修改后已分配的假IP按新规则处理，
+// 规则已删除时返回的rule.Action为空，由调用方使用默认出口
+func (r *Router) LookupFakeIP(ip netip.Addr) (domain string, rule Rule, err error) {
+	domain, ok := r.pool.lookup(ip)
+	if !ok {
+		return "", Rule{}, ErrFakeIPExpired
+	}
+	rule, _ = r.MatchDomain(domain)
+	return domain, rule, nil
+}
@@ -0,0 +1,94 @@
+package splitroute
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 规则动作
+const (
+	ActionDirect = "direct"
+	ActionReject = "reject"
+	ActionProxy  = "proxy"
+)
+
+// 域名匹配方式
+const (
+	MatchSuffix  = "suffix"
+	MatchKeyword = "keyword"
+	MatchFull    = "full"
+)
+
+var ErrRejected = errors.New("rejected by domain rule")
+
+// Rule 域名分流规则，Target为ActionProxy时使用的出口，
+// 网关上是出站ID，agent上是代理网关的peer id，为空时使用默认出口
+type Rule struct {
+	Match  string `json:"match"`
+	Value  string `json:"value"`
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"`
+}
+
+func (r *Rule) Validate() error {
+	switch r.Match {
+	case MatchSuffix, MatchKeyword, MatchFull:
+	default:
+		return fmt.Errorf("unknown match type %q", r.Match)
+	}
+	if normalizeDomain(r.Value) == "" {
+		return errors.New("rule value is empty")
+	}
+	switch r.Action {
+	case ActionDirect, ActionReject, ActionProxy:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	return nil
+}
+
+// matchDomain domain已经转为小写且去掉末尾的点
+func (r *Rule) matchDomain(domain string) bool {
+	v := normalizeDomain(r.Value)
+	switch r.Match {
+	case MatchFull:
+		return domain == v
+	case MatchSuffix:
+		// corp.example 同时匹配 corp.example 和 a.corp.example
+		v = strings.TrimPrefix(v, ".")
+		return domain == v || strings.HasSuffix(domain, "."+v)
+	case MatchKeyword:
+		return strings.Contains(domain, v)
+	}
+	return false
+}
+
+// Rules 按顺序匹配，第一条匹配的规则生效
+type Rules []Rule
+
+func (rs Rules) Validate() error {
+	for i := range rs {
+		if err := rs[i].Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (rs Rules) Match(domain string) (Rule, bool) {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return Rule{}, false
+	}
+	for _, r := range rs {
+		if r.matchDomain(domain) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
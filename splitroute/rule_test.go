@@ -0,0 +1,55 @@
+package splitroute
+
+import "testing"
+
+func TestRulesMatch(t *testing.T) {
+	rs := Rules{
+		{Match: MatchFull, Value: "exact.example.com", Action: ActionReject},
+		{Match: MatchSuffix, Value: ".corp.example", Action: ActionProxy, Target: "1"},
+		{Match: MatchKeyword, Value: "ads", Action: ActionReject},
+		{Match: MatchSuffix, Value: "example.com", Action: ActionDirect},
+	}
+	if err := rs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		action string
+		ok     bool
+	}{
+		{"exact.example.com", ActionReject, true},
+		{"EXACT.Example.com.", ActionReject, true},
+		{"corp.example", ActionProxy, true},
+		{"a.b.corp.example", ActionProxy, true},
+		{"xcorp.example", "", false},
+		{"myads.net", ActionReject, true},
+		{"www.example.com", ActionDirect, true},
+		{"example.com", ActionDirect, true},
+		{"example.org", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		r, ok := rs.Match(tt.domain)
+		if ok != tt.ok || r.Action != tt.action {
+			t.Errorf("Match(%q) = %q,%v, want %q,%v", tt.domain, r.Action, ok, tt.action, tt.ok)
+		}
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		ok   bool
+	}{
+		{Rule{Match: MatchSuffix, Value: "a.com", Action: ActionProxy}, true},
+		{Rule{Match: "regex", Value: "a.com", Action: ActionProxy}, false},
+		{Rule{Match: MatchSuffix, Value: " . ", Action: ActionProxy}, false},
+		{Rule{Match: MatchSuffix, Value: "a.com", Action: "drop"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.rule.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v", tt.rule, err)
+		}
+	}
+}
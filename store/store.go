@@ -0,0 +1,161 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/isletnet/uptp/logging"
+	"github.com/isletnet/uptp/types"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var keySchemaVersion = []byte("schema_version")
+
+// Migration 升级数据库结构，Run中的修改写入batch，与版本号一起原子提交
+type Migration struct {
+	Version int
+	Name    string
+	Run     func(db *leveldb.DB, b *leveldb.Batch) error
+}
+
+// SchemaVersion 数据库结构版本，没有版本号的旧数据库为0
+func SchemaVersion(db *leveldb.DB) (int, error) {
+	v, err := db.Get(keySchemaVersion, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(v))
+}
+
+// Migrate 按版本顺序执行未执行过的升级，数据库版本比程序新时返回错误，避免旧程序改坏数据
+func Migrate(db *leveldb.DB, migrations []Migration) error {
+	cur, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	latest := 0
+	for _, m := range migrations {
+		if m.Version <= latest {
+			return fmt.Errorf("migration %q out of order", m.Name)
+		}
+		latest = m.Version
+	}
+	if cur > latest {
+		return fmt.Errorf("data schema version %d is newer than supported %d", cur, latest)
+	}
+	for _, m := range migrations {
+		if m.Version <= cur {
+			continue
+		}
+		b := new(leveldb.Batch)
+		if err := m.Run(db, b); err != nil {
+			return fmt.Errorf("migration %d %s error: %w", m.Version, m.Name, err)
+		}
+		b.Put(keySchemaVersion, []byte(strconv.Itoa(m.Version)))
+		if err := db.Write(b, &opt.WriteOptions{Sync: true}); err != nil {
+			return err
+		}
+		logging.Info("data schema migrated to %d: %s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// RecordKey 单条记录的key，格式为<prefix>/<id>
+func RecordKey(prefix string, id types.ID) []byte {
+	return []byte(prefix + "/" + id.String())
+}
+
+// LoadRecords 读取prefix下的所有记录，按key的顺序回调
+func LoadRecords[T any](db *leveldb.DB, prefix string, f func(id types.ID, v *T)) error {
+	return LoadRawRecords(db, prefix, func(id types.ID, raw []byte) error {
+		v := new(T)
+		if err := json.Unmarshal(raw, v); err != nil {
+			return fmt.Errorf("decode %s/%s error: %w", prefix, id, err)
+		}
+		f(id, v)
+		return nil
+	})
+}
+
+// LoadRawRecords 读取prefix下所有记录的原始JSON
+func LoadRawRecords(db *leveldb.DB, prefix string, f func(id types.ID, raw []byte) error) error {
+	p := []byte(prefix + "/")
+	iter := db.NewIterator(util.BytesPrefix(p), nil)
+	defer iter.Release()
+	for iter.Next() {
+		id, err := strconv.ParseUint(string(iter.Key()[len(p):]), 10, 64)
+		if err != nil {
+			logging.Warn("skip invalid record key %s", iter.Key())
+			continue
+		}
+		if err := f(types.ID(id), iter.Value()); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// PutRecord 序列化记录写入batch
+func PutRecord(b *leveldb.Batch, prefix string, id types.ID, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b.Put(RecordKey(prefix, id), buf)
+	return nil
+}
+
+func DeleteRecord(b *leveldb.Batch, prefix string, id types.ID) {
+	b.Delete(RecordKey(prefix, id))
+}
+
+// DeleteRecords 删除prefix下的所有记录
+func DeleteRecords(db *leveldb.DB, b *leveldb.Batch, prefix string) error {
+	return LoadRawRecords(db, prefix, func(id types.ID, raw []byte) error {
+		DeleteRecord(b, prefix, id)
+		return nil
+	})
+}
+
+// Update 在一个batch中完成多个修改，原子写入
+func Update(db *leveldb.DB, f func(b *leveldb.Batch) error) error {
+	b := new(leveldb.Batch)
+	if err := f(b); err != nil {
+		return err
+	}
+	return db.Write(b, nil)
+}
+
+// SplitMapBlob 把ID到对象的整体JSON拆成每条记录一个key，记录保持原始JSON，不会丢失未知字段
+func SplitMapBlob(db *leveldb.DB, b *leveldb.Batch, blobKey, prefix string) error {
+	v, err := db.Get([]byte(blobKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(v, &m); err != nil {
+		return err
+	}
+	for k, raw := range m {
+		if string(raw) == "null" {
+			continue
+		}
+		id, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			return errors.New("invalid id " + k)
+		}
+		b.Put(RecordKey(prefix, types.ID(id)), raw)
+	}
+	b.Delete([]byte(blobKey))
+	return nil
+}
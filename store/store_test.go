@@ -0,0 +1,88 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/isletnet/uptp/types"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func memDB(t *testing.T) *leveldb.DB {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+type rec struct {
+	Name  string `json:"name"`
+	Extra string `json:"extra"`
+}
+
+func TestMigrateSplit(t *testing.T) {
+	db := memDB(t)
+	db.Put([]byte("things"), []byte(`{"1":{"name":"a","extra":"x"},"20":{"name":"b"},"3":null}`), nil)
+
+	runs := 0
+	ms := []Migration{
+		{Version: 1, Name: "split", Run: func(db *leveldb.DB, b *leveldb.Batch) error {
+			runs++
+			return SplitMapBlob(db, b, "things", "thing")
+		}},
+	}
+	if err := Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	// 已经执行过的升级不再执行
+	if err := Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Errorf("runs = %d", runs)
+	}
+	if v, _ := SchemaVersion(db); v != 1 {
+		t.Errorf("version = %d", v)
+	}
+	if _, err := db.Get([]byte("things"), nil); err != leveldb.ErrNotFound {
+		t.Error("blob not deleted")
+	}
+	got := map[types.ID]rec{}
+	err := LoadRecords(db, "thing", func(id types.ID, r *rec) {
+		got[id] = *r
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].Extra != "x" || got[20].Name != "b" {
+		t.Errorf("records = %v", got)
+	}
+
+	err = Update(db, func(b *leveldb.Batch) error {
+		DeleteRecord(b, "thing", 1)
+		return PutRecord(b, "thing", 2, rec{Name: "c"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	LoadRecords(db, "thing", func(id types.ID, r *rec) { n++ })
+	if n != 2 {
+		t.Errorf("records = %d", n)
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	db := memDB(t)
+	db.Put(keySchemaVersion, []byte("3"), nil)
+	ms := []Migration{{Version: 1, Name: "a", Run: func(*leveldb.DB, *leveldb.Batch) error { return nil }}}
+	if err := Migrate(db, ms); err == nil {
+		t.Error("newer schema accepted")
+	}
+	ms = append(ms, Migration{Version: 1, Name: "dup"})
+	if err := Migrate(memDB(t), ms); err == nil {
+		t.Error("unordered migrations accepted")
+	}
+}